@@ -8,6 +8,7 @@ import (
 	"strings"
 	"time"
 
+	"github.com/gravitational/trace"
 	"github.com/xanderstrike/goplaxt/lib/store"
 	"github.com/xanderstrike/goplaxt/lib/trakt"
 	"github.com/xanderstrike/goplaxt/tracing"
@@ -20,10 +21,34 @@ const maxMemory = 6 * 1024 * 1024
 
 var storage store.Store
 
+// refreshMargin is how long before expiring a token gets refreshed
+var refreshMargin = 24 * time.Hour
+
+// traktClient is what every trakt request goes through
+var traktClient = trakt.NewClient()
+
+// dispatcher delivers the scrobbles webhooks are queued as
+var dispatcher *trakt.Dispatcher
+
 func SetStore(s store.Store) {
 	storage = s
 }
 
+// SetTraktClient changes the client every trakt request goes through
+func SetTraktClient(client *trakt.Client) {
+	traktClient = client
+}
+
+// SetDispatcher changes where webhooks are queued for delivery to trakt
+func SetDispatcher(d *trakt.Dispatcher) {
+	dispatcher = d
+}
+
+// SetRefreshMargin changes how long before expiring a token gets refreshed
+func SetRefreshMargin(margin time.Duration) {
+	refreshMargin = margin
+}
+
 func ApiHandler(w http.ResponseWriter, r *http.Request) {
 	ctx, span := tracing.Tracer.Start(r.Context(), "api")
 	defer span.End()
@@ -40,38 +65,54 @@ func ApiHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	id := args["id"][0]
 	logger.Printf("Webhook call for %s", id)
-
-	user, err := storage.GetUser(id)
-	if err != nil {
-		logger.Errorf("error getting user: %#v", err)
-		http.Error(w, "Failed to find a valid user", http.StatusInternalServerError)
+	if dispatcher == nil {
+		logger.Error("no dispatcher to queue scrobbles with")
+		http.Error(w, "Scrobble queue not ready", http.StatusServiceUnavailable)
 		return
 	}
 
-	if user == nil {
-		log.Println("User not found.")
+	user, err := storage.GetUser(ctx, id)
+	if trace.IsNotFound(err) {
+		logger.Println("User not found.")
 		w.WriteHeader(http.StatusNotFound)
 		json.NewEncoder(w).Encode("user not found")
 		return
 	}
+	if err != nil {
+		logger.Errorf("error getting user: %#v", err)
+		http.Error(w, "Failed to find a valid user", http.StatusInternalServerError)
+		return
+	}
 
 	logger = logger.WithField("user", user.ID)
 
-	tokenAge := time.Since(user.Updated).Hours()
-	if tokenAge > 1440 { // tokens expire after 3 months, so we refresh after 2
-		logger.Println("User access token outdated, refreshing...")
-		result, err := trakt.AuthRequest(SelfRoot(r), user.Username, "", user.RefreshToken, "refresh_token")
+	// Refreshing here keeps revoked users from piling up jobs in the queue
+	tokens := trakt.NewTokenManager(traktClient, storage, SelfRoot(r), refreshMargin)
+	fresh, err := tokens.Fresh(ctx, *user)
+	switch {
+	case fresh != nil:
 		if err != nil {
-			logger.Println(fmt.Errorf("refresh failed, skipping and deleting user %w", err))
-			w.WriteHeader(http.StatusUnauthorized)
-			json.NewEncoder(w).Encode("fail")
-			storage.DeleteUser(user.ID)
-			return
+			logger.Errorf("refreshed tokens were not saved: %v", err)
 		}
-
-		user.UpdateUser(result["access_token"].(string), result["refresh_token"].(string))
-		logger.Println("Refreshed, continuing")
-
+		user = fresh
+	case trace.IsCompareFailed(err):
+		// Another replica is refreshing, dropping this play beats dropping the user
+		logger.Warnf("refresh still running elsewhere: %v", err)
+		http.Error(w, "Token refresh in progress", http.StatusServiceUnavailable)
+		return
+	case trakt.IsInvalidGrant(err):
+		logger.Println(fmt.Errorf("refresh token revoked, skipping and deleting user %w", err))
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode("fail")
+		if _, err := storage.DeleteUser(ctx, user.ID); err != nil {
+			logger.Errorf("failed to delete user: %#v", err)
+		}
+		return
+	default:
+		// Trakt may just be down, the user gets another chance with the next webhook
+		logger.Errorf("refresh failed, skipping: %v", err)
+		http.Error(w, "Failed to refresh trakt token", http.StatusBadGateway)
+		return
 	}
 
 	err = r.ParseMultipartForm(maxMemory)
@@ -83,20 +124,34 @@ func ApiHandler(w http.ResponseWriter, r *http.Request) {
 
 	multipart.NewReader(r.Body, r.Header.Get("Content-Type"))
 
-	re, err := plexhooks.ParseWebhook([]byte(r.PostFormValue("payload")))
+	payload := r.PostFormValue("payload")
+	re, err := plexhooks.ParseWebhook([]byte(payload))
 	if err != nil {
-		logger.Errorf("failed to process webhook: %#v\n%s", err, r.PostFormValue("payload"))
+		logger.Errorf("failed to process webhook: %#v\n%s", err, payload)
 		http.Error(w, "Failed to process webhook", http.StatusInternalServerError)
 		return
 	}
 
-	if strings.ToLower(re.Account.Title) == user.Username {
-		// FIXME - make everything take the pointer
-		// Don't let plex waiting
-		go trakt.Handle(re, *user, logger)
-	} else {
+	if strings.ToLower(re.Account.Title) != user.Username {
 		logger.Errorf("Plex username %s does not equal %s, skipping", strings.ToLower(re.Account.Title), user.Username)
+		json.NewEncoder(w).Encode("success")
+		return
+	}
+	settings, err := trakt.WebhookSettings(args)
+	if err != nil {
+		logger.Errorf("bad scrobble settings in the webhook link: %v", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// Plex doesn't wait for trakt, the dispatcher delivers the scrobble and retries it when trakt fails
+	job := store.NewJob(user.ID, SelfRoot(r), []byte(payload), time.Now())
+	job.Settings = settings.Encode()
+	if err := dispatcher.Enqueue(ctx, job); err != nil {
+		logger.Errorf("failed to queue scrobble: %v", err)
+		http.Error(w, "Failed to queue scrobble", http.StatusServiceUnavailable)
+		return
 	}
+	logger.WithField("job", job.ID).Debug("Queued scrobble")
 
 	json.NewEncoder(w).Encode("success")
 }
@@ -0,0 +1,83 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/xanderstrike/goplaxt/lib/store"
+	"github.com/xanderstrike/goplaxt/lib/trakt"
+)
+
+const heatPlay = `{"event":"media.play","Account":{"title":"halkeye"},"Metadata":{"librarySectionType":"movie","title":"Heat","year":1995}}`
+
+// newWebhookStore saves a user whose tokens don't need a refresh
+func newWebhookStore(t *testing.T) *store.DiskStore {
+	disk := store.NewDiskStore(t.TempDir())
+	require.NoError(t, disk.WriteUser(context.TODO(), store.User{
+		ID:           "id123",
+		Username:     "halkeye",
+		AccessToken:  "access123",
+		RefreshToken: "refresh123",
+		ExpiresAt:    time.Now().Add(30 * 24 * time.Hour),
+		Updated:      time.Now(),
+	}))
+	defer func(s store.Store) { t.Cleanup(func() { storage = s }) }(storage)
+	storage = disk
+	return disk
+}
+
+// webhook posts payload the way plex does, to the webhook link with query
+func webhook(t *testing.T, query url.Values, payload string) *httptest.ResponseRecorder {
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	require.NoError(t, form.WriteField("payload", payload))
+	require.NoError(t, form.Close())
+	r, err := http.NewRequest("POST", "/api?"+query.Encode(), &body)
+	require.NoError(t, err)
+	r.Header.Set("Content-Type", form.FormDataContentType())
+
+	rr := httptest.NewRecorder()
+	ApiHandler(rr, r)
+	return rr
+}
+
+func TestApiHandlerQueuesScrobbles(t *testing.T) {
+	disk := newWebhookStore(t)
+	defer SetDispatcher(dispatcher)
+	SetDispatcher(trakt.NewDispatcher(traktClient, disk, disk))
+
+	rr := webhook(t, url.Values{"id": {"id123"}, "watched": {"95"}}, heatPlay)
+	assert.Equal(t, http.StatusOK, rr.Result().StatusCode)
+
+	job, err := disk.Claim(context.TODO(), time.Now().Add(time.Minute), time.Minute)
+	require.NoError(t, err)
+	assert.Equal(t, "id123", job.UserID)
+	assert.Equal(t, heatPlay, string(job.Payload))
+	assert.Equal(t, "watched=95", job.Settings)
+}
+
+func TestApiHandlerRefusesBadSettings(t *testing.T) {
+	disk := newWebhookStore(t)
+	defer SetDispatcher(dispatcher)
+	SetDispatcher(trakt.NewDispatcher(traktClient, disk, disk))
+
+	rr := webhook(t, url.Values{"id": {"id123"}, "pause": {"later"}}, heatPlay)
+	assert.Equal(t, http.StatusBadRequest, rr.Result().StatusCode)
+}
+
+func TestApiHandlerWithoutDispatcher(t *testing.T) {
+	newWebhookStore(t)
+	defer SetDispatcher(dispatcher)
+	SetDispatcher(nil)
+
+	rr := webhook(t, url.Values{"id": {"id123"}}, heatPlay)
+	assert.Equal(t, http.StatusServiceUnavailable, rr.Result().StatusCode)
+}
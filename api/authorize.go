@@ -2,13 +2,14 @@ package api
 
 import (
 	"fmt"
+	"html/template"
 	"net/http"
 	"os"
 	"strings"
-	"text/template"
 
 	"github.com/xanderstrike/goplaxt/lib/store"
 	"github.com/xanderstrike/goplaxt/lib/trakt"
+	"github.com/xanderstrike/goplaxt/tracing"
 
 	log "github.com/sirupsen/logrus"
 )
@@ -18,28 +19,51 @@ type AuthorizePage struct {
 	Authorized bool
 	URL        string
 	ClientID   string
+	// Error is shown above the authorize button when the last attempt failed
+	Error string
 }
 
 func Authorize(w http.ResponseWriter, r *http.Request) {
+	ctx, span := tracing.Tracer.Start(r.Context(), "authorize")
+	defer span.End()
+	logger := log.WithContext(ctx)
 	args := r.URL.Query()
-	username := strings.ToLower(args["username"][0])
-	log.Print(fmt.Sprintf("Handling auth request for %s", username))
-	code := args["code"][0]
-	result, err := trakt.AuthRequest(SelfRoot(r), username, code, "", "authorization_code")
+	username := strings.ToLower(args.Get("username"))
+	logger.Print(fmt.Sprintf("Handling auth request for %s", username))
+
+	// Trakt sends people back with an error instead of a code when they say no
+	if denied := args.Get("error"); denied != "" {
+		logger.WithField("error", denied).Print("Authorization denied on trakt")
+		authorizeError(w, r, http.StatusForbidden, "Trakt did not authorize Plaxt, so there is nothing to scrobble to. Feel free to try again.")
+		return
+	}
+	code := args.Get("code")
+	if username == "" || code == "" {
+		authorizeError(w, r, http.StatusBadRequest, "This authorization link is incomplete, please start over below.")
+		return
+	}
+
+	token, err := traktClient.ExchangeCode(ctx, SelfRoot(r), username, code)
+	if trakt.IsInvalidGrant(err) {
+		logger.Printf("Trakt refused the authorization code: %v", err)
+		authorizeError(w, r, http.StatusBadRequest, "Trakt did not accept this authorization, it may have expired or been used already. Please authorize again.")
+		return
+	}
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		logger.Errorf("error exchanging authorization code: %v", err)
+		authorizeError(w, r, http.StatusBadGateway, "Plaxt could not talk to Trakt right now, please try again in a moment.")
 		return
 	}
-	user, err := store.NewUser(username, result["access_token"].(string), result["refresh_token"].(string), storage)
+	user, err := store.NewUser(ctx, username, token.Token(), storage)
 	if err != nil {
-		log.Errorf("error saving user: %#v", err)
-		http.Error(w, "Failed to write user credentials", http.StatusInternalServerError)
+		logger.Errorf("error saving user: %#v", err)
+		authorizeError(w, r, http.StatusInternalServerError, "Plaxt could not save your credentials, please try again in a moment.")
 		return
 	}
 
 	url := fmt.Sprintf("%s/api?id=%s", SelfRoot(r), user.ID)
 
-	log.Print(fmt.Sprintf("Authorized as %s", user.ID))
+	logger.Print(fmt.Sprintf("Authorized as %s", user.ID))
 
 	tmpl := template.Must(template.ParseFiles("static/index.html"))
 	data := AuthorizePage{
@@ -50,3 +74,18 @@ func Authorize(w http.ResponseWriter, r *http.Request) {
 	}
 	tmpl.Execute(w, data)
 }
+
+// authorizeError renders the start page again with message above the authorize button
+func authorizeError(w http.ResponseWriter, r *http.Request, status int, message string) {
+	tmpl := template.Must(template.ParseFiles("static/index.html"))
+	data := AuthorizePage{
+		SelfRoot:   SelfRoot(r),
+		Authorized: false,
+		URL:        "https://plaxt.astandke.com/api?id=generate-your-own-silly",
+		ClientID:   os.Getenv("TRAKT_ID"),
+		Error:      message,
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	tmpl.Execute(w, data)
+}
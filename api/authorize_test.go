@@ -0,0 +1,65 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/xanderstrike/goplaxt/lib/trakt"
+)
+
+// inRepoRoot runs the test from the repository root, where static/ lives
+func inRepoRoot(t *testing.T) {
+	wd, err := os.Getwd()
+	require.NoError(t, err)
+	require.NoError(t, os.Chdir(".."))
+	t.Cleanup(func() { os.Chdir(wd) })
+}
+
+func TestAuthorizeDenied(t *testing.T) {
+	inRepoRoot(t)
+
+	rr := httptest.NewRecorder()
+	r, err := http.NewRequest("GET", "/authorize?username=halkeye&error=access_denied", nil)
+	require.NoError(t, err)
+	Authorize(rr, r)
+
+	assert.Equal(t, http.StatusForbidden, rr.Result().StatusCode)
+	assert.Contains(t, rr.Body.String(), "Trakt did not authorize Plaxt")
+	assert.Contains(t, rr.Body.String(), "js-authorize")
+}
+
+func TestAuthorizeMissingCode(t *testing.T) {
+	inRepoRoot(t)
+
+	rr := httptest.NewRecorder()
+	r, err := http.NewRequest("GET", "/authorize", nil)
+	require.NoError(t, err)
+	Authorize(rr, r)
+
+	assert.Equal(t, http.StatusBadRequest, rr.Result().StatusCode)
+	assert.Contains(t, rr.Body.String(), "This authorization link is incomplete")
+}
+
+func TestAuthorizeInvalidGrant(t *testing.T) {
+	inRepoRoot(t)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte(`{"error": "invalid_grant", "error_description": "The provided authorization grant is invalid"}`))
+	}))
+	defer server.Close()
+	defer SetTraktClient(traktClient)
+	SetTraktClient(trakt.NewClient(trakt.WithBaseURL(server.URL)))
+	storage = &MockFailStore{}
+
+	rr := httptest.NewRecorder()
+	r, err := http.NewRequest("GET", "/authorize?username=halkeye&code=code123", nil)
+	require.NoError(t, err)
+	Authorize(rr, r)
+
+	assert.Equal(t, http.StatusBadRequest, rr.Result().StatusCode)
+	assert.Contains(t, rr.Body.String(), "Trakt did not accept this authorization")
+}
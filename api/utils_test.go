@@ -8,6 +8,7 @@ import (
 	"testing"
 
 	"github.com/gorilla/handlers"
+	"github.com/gravitational/trace"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 
@@ -16,17 +17,39 @@ import (
 
 type MockSuccessStore struct{}
 
-func (s MockSuccessStore) Ping(ctx context.Context) error         { return nil }
-func (s MockSuccessStore) WriteUser(user store.User) error        { return nil }
-func (s MockSuccessStore) GetUser(id string) (*store.User, error) { return nil, nil }
-func (s MockSuccessStore) DeleteUser(id string) bool              { return true }
+func (s MockSuccessStore) Ping(ctx context.Context) error                       { return nil }
+func (s MockSuccessStore) WriteUser(ctx context.Context, user store.User) error { return nil }
+func (s MockSuccessStore) CompareAndSwapUser(ctx context.Context, version int64, user store.User) error {
+	return nil
+}
+func (s MockSuccessStore) GetUser(ctx context.Context, id string) (*store.User, error) {
+	return nil, trace.NotFound("no user with id %s", id)
+}
+func (s MockSuccessStore) DeleteUser(ctx context.Context, id string) (bool, error) { return true, nil }
+func (s MockSuccessStore) ListUsers(ctx context.Context, cursor string, limit int) ([]*store.User, string, error) {
+	return nil, "", nil
+}
+func (s MockSuccessStore) CountUsers(ctx context.Context) (int, error) { return 0, nil }
 
 type MockFailStore struct{}
 
-func (s MockFailStore) Ping(ctx context.Context) error         { return errors.New("OH NO") }
-func (s MockFailStore) WriteUser(user store.User) error        { panic(errors.New("OH NO")) }
-func (s MockFailStore) GetUser(id string) (*store.User, error) { panic(errors.New("OH NO")) }
-func (s MockFailStore) DeleteUser(id string) bool              { return false }
+func (s MockFailStore) Ping(ctx context.Context) error { return errors.New("OH NO") }
+func (s MockFailStore) WriteUser(ctx context.Context, user store.User) error {
+	panic(errors.New("OH NO"))
+}
+func (s MockFailStore) CompareAndSwapUser(ctx context.Context, version int64, user store.User) error {
+	panic(errors.New("OH NO"))
+}
+func (s MockFailStore) GetUser(ctx context.Context, id string) (*store.User, error) {
+	panic(errors.New("OH NO"))
+}
+func (s MockFailStore) DeleteUser(ctx context.Context, id string) (bool, error) {
+	return false, errors.New("OH NO")
+}
+func (s MockFailStore) ListUsers(ctx context.Context, cursor string, limit int) ([]*store.User, string, error) {
+	return nil, "", errors.New("OH NO")
+}
+func (s MockFailStore) CountUsers(ctx context.Context) (int, error) { return 0, errors.New("OH NO") }
 
 func TestSelfRoot(t *testing.T) {
 	var (
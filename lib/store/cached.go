@@ -0,0 +1,203 @@
+package store
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/gravitational/trace"
+	"github.com/xanderstrike/goplaxt/tracing"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// invalidationChannel is where replicas announce the users they changed
+const invalidationChannel = "goplaxt:cache:invalidate"
+
+var (
+	cacheLookups = tracing.Int64Counter(
+		"goplaxt.store.cache.lookups",
+		"User lookups served by the store cache, by result",
+	)
+	cacheHit  = attribute.String("result", "hit")
+	cacheMiss = attribute.String("result", "miss")
+)
+
+// CachedStore wraps another store keeping recently read users in memory,
+// the least recently used ones are dropped once size is reached
+type CachedStore struct {
+	inner Store
+	size  int
+	ttl   time.Duration
+	now   func() time.Time
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	order   *list.List
+	// generation changes on every invalidation so reads racing a write don't cache stale users
+	generation uint64
+
+	publisher *redis.Client
+}
+
+type cacheEntry struct {
+	user    User
+	expires time.Time
+}
+
+// NewCachedStore will cache up to size users read from inner for ttl
+func NewCachedStore(inner Store, size int, ttl time.Duration) *CachedStore {
+	return &CachedStore{
+		inner:   inner,
+		size:    size,
+		ttl:     ttl,
+		now:     time.Now,
+		entries: make(map[string]*list.Element),
+		order:   list.New(),
+	}
+}
+
+// ShareInvalidations uses redis pub/sub so every replica drops a user from its
+// cache when any of them changes it. It listens until ctx is done.
+func (s *CachedStore) ShareInvalidations(ctx context.Context, client *redis.Client) error {
+	pubsub := client.Subscribe(invalidationChannel)
+	// Wait for the subscription to be confirmed so no invalidation is missed after returning
+	if _, err := pubsub.Receive(); err != nil {
+		pubsub.Close()
+		return trace.Wrap(err)
+	}
+	s.mu.Lock()
+	s.publisher = client
+	s.mu.Unlock()
+
+	go func() {
+		defer pubsub.Close()
+		messages := pubsub.Channel()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case message, ok := <-messages:
+				if !ok {
+					return
+				}
+				s.evict(message.Payload)
+			}
+		}
+	}()
+	return nil
+}
+
+// Ping will check if the wrapped store works right
+func (s *CachedStore) Ping(ctx context.Context) error {
+	return s.inner.Ping(ctx)
+}
+
+// GetUser will serve a user from memory, reading through to the wrapped store on a miss
+func (s *CachedStore) GetUser(ctx context.Context, id string) (*User, error) {
+	s.mu.Lock()
+	if element, ok := s.entries[id]; ok {
+		entry := element.Value.(*cacheEntry)
+		if s.now().Before(entry.expires) {
+			s.order.MoveToFront(element)
+			user := entry.user
+			s.mu.Unlock()
+			cacheLookups.Add(ctx, 1, cacheHit)
+			return &user, nil
+		}
+		s.remove(element)
+	}
+	generation := s.generation
+	s.mu.Unlock()
+	cacheLookups.Add(ctx, 1, cacheMiss)
+
+	user, err := s.inner.GetUser(ctx, id)
+	if err != nil || user == nil {
+		return user, err
+	}
+	user.store = s
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if generation == s.generation {
+		s.add(*user)
+	}
+	return user, nil
+}
+
+// WriteUser will write through to the wrapped store and forget the cached user
+func (s *CachedStore) WriteUser(ctx context.Context, user User) error {
+	err := s.inner.WriteUser(ctx, user)
+	s.invalidate(ctx, user.ID)
+	return trace.Wrap(err)
+}
+
+// CompareAndSwapUser will swap in the wrapped store and forget the cached user,
+// a failed swap means the cached copy is outdated too
+func (s *CachedStore) CompareAndSwapUser(ctx context.Context, version int64, user User) error {
+	err := s.inner.CompareAndSwapUser(ctx, version, user)
+	s.invalidate(ctx, user.ID)
+	return trace.Wrap(err)
+}
+
+// DeleteUser will delete from the wrapped store and forget the cached user
+func (s *CachedStore) DeleteUser(ctx context.Context, id string) (bool, error) {
+	deleted, err := s.inner.DeleteUser(ctx, id)
+	s.invalidate(ctx, id)
+	return deleted, trace.Wrap(err)
+}
+
+// ListUsers is not cached, it is meant for maintenance jobs walking every user
+func (s *CachedStore) ListUsers(ctx context.Context, cursor string, limit int) ([]*User, string, error) {
+	users, next, err := s.inner.ListUsers(ctx, cursor, limit)
+	for _, user := range users {
+		user.store = s
+	}
+	return users, next, err
+}
+
+// CountUsers will count the users in the wrapped store
+func (s *CachedStore) CountUsers(ctx context.Context) (int, error) {
+	return s.inner.CountUsers(ctx)
+}
+
+// invalidate evicts the user here and, when shared, on every other replica
+func (s *CachedStore) invalidate(ctx context.Context, id string) {
+	s.evict(id)
+	s.mu.Lock()
+	publisher := s.publisher
+	s.mu.Unlock()
+	if publisher != nil {
+		// The ttl still bounds staleness if the announcement gets lost
+		publisher.WithContext(ctx).Publish(invalidationChannel, id)
+	}
+}
+
+func (s *CachedStore) evict(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.generation++
+	if element, ok := s.entries[id]; ok {
+		s.remove(element)
+	}
+}
+
+// add and remove expect s.mu to be held
+func (s *CachedStore) add(user User) {
+	if element, ok := s.entries[user.ID]; ok {
+		s.remove(element)
+	}
+	s.entries[user.ID] = s.order.PushFront(&cacheEntry{
+		user:    user,
+		expires: s.now().Add(s.ttl),
+	})
+	for s.order.Len() > s.size {
+		s.remove(s.order.Back())
+	}
+}
+
+func (s *CachedStore) remove(element *list.Element) {
+	s.order.Remove(element)
+	delete(s.entries, element.Value.(*cacheEntry).user.ID)
+}
@@ -0,0 +1,115 @@
+package store
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// countingStore counts the reads that make it through the cache
+type countingStore struct {
+	Store
+	reads int32
+}
+
+func (s *countingStore) GetUser(ctx context.Context, id string) (*User, error) {
+	atomic.AddInt32(&s.reads, 1)
+	return s.Store.GetUser(ctx, id)
+}
+
+func newCountingStore(t *testing.T) *countingStore {
+	dir, err := ioutil.TempDir("", "goplaxt-keystore")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return &countingStore{Store: NewDiskStore(dir)}
+}
+
+func TestCachedStoreReadsThrough(t *testing.T) {
+	inner := newCountingStore(t)
+	store := NewCachedStore(inner, 10, time.Minute)
+	require.NoError(t, store.WriteUser(context.TODO(), User{ID: "id123", Username: "halkeye", AccessToken: "access123"}))
+
+	for i := 0; i < 3; i++ {
+		user, err := store.GetUser(context.TODO(), "id123")
+		require.NoError(t, err)
+		assert.Equal(t, "access123", user.AccessToken)
+	}
+	assert.EqualValues(t, 1, inner.reads)
+
+	// Writes go through the cache, so saving a user invalidates it
+	user, err := store.GetUser(context.TODO(), "id123")
+	require.NoError(t, err)
+	swapped := *user
+	swapped.AccessToken, swapped.RefreshToken, swapped.Version = "access456", "refresh456", user.Version+2
+	require.NoError(t, store.CompareAndSwapUser(context.TODO(), user.Version, swapped))
+	user, err = store.GetUser(context.TODO(), "id123")
+	require.NoError(t, err)
+	assert.Equal(t, "access456", user.AccessToken)
+	assert.EqualValues(t, 2, inner.reads)
+
+	deleted, err := store.DeleteUser(context.TODO(), "id123")
+	require.NoError(t, err)
+	assert.True(t, deleted)
+	_, err = store.GetUser(context.TODO(), "id123")
+	assert.Error(t, err)
+}
+
+func TestCachedStoreExpiresAndEvicts(t *testing.T) {
+	inner := newCountingStore(t)
+	store := NewCachedStore(inner, 2, time.Minute)
+	now := time.Date(2019, 02, 25, 0, 0, 0, 0, time.UTC)
+	store.now = func() time.Time { return now }
+	for _, id := range []string{"id1", "id2", "id3"} {
+		require.NoError(t, inner.WriteUser(context.TODO(), User{ID: id, Username: "halkeye"}))
+	}
+
+	for _, id := range []string{"id1", "id2", "id1", "id3"} {
+		_, err := store.GetUser(context.TODO(), id)
+		require.NoError(t, err)
+	}
+	assert.EqualValues(t, 3, inner.reads)
+
+	// id2 was the least recently used one when id3 came in
+	_, err := store.GetUser(context.TODO(), "id2")
+	require.NoError(t, err)
+	assert.EqualValues(t, 4, inner.reads)
+
+	now = now.Add(2 * time.Minute)
+	_, err = store.GetUser(context.TODO(), "id2")
+	require.NoError(t, err)
+	assert.EqualValues(t, 5, inner.reads)
+}
+
+func TestCachedStoreSharesInvalidations(t *testing.T) {
+	s, err := miniredis.Run()
+	require.NoError(t, err)
+	defer s.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	backend := NewRedisStore(NewRedisClient(s.Addr(), ""))
+	replicas := make([]*CachedStore, 2)
+	for i := range replicas {
+		client := NewRedisClient(s.Addr(), "")
+		replicas[i] = NewCachedStore(backend, 10, time.Hour)
+		require.NoError(t, replicas[i].ShareInvalidations(ctx, &client))
+	}
+
+	require.NoError(t, replicas[0].WriteUser(ctx, User{ID: "id123", Username: "halkeye", AccessToken: "access123"}))
+	user, err := replicas[1].GetUser(ctx, "id123")
+	require.NoError(t, err)
+	assert.Equal(t, "access123", user.AccessToken)
+
+	require.NoError(t, replicas[0].WriteUser(ctx, User{ID: "id123", Username: "halkeye", AccessToken: "access456"}))
+	assert.Eventually(t, func() bool {
+		user, err := replicas[1].GetUser(ctx, "id123")
+		return err == nil && user.AccessToken == "access456"
+	}, time.Second, 10*time.Millisecond)
+}
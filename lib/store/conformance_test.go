@@ -0,0 +1,117 @@
+package store_test
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/stretchr/testify/require"
+	"github.com/xanderstrike/goplaxt/lib/store"
+	"github.com/xanderstrike/goplaxt/lib/store/storetest"
+)
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "goplaxt-conformance")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return dir
+}
+
+func newDiskStore(t *testing.T) store.Store {
+	return store.NewDiskStore(tempDir(t))
+}
+
+func TestDiskConformance(t *testing.T) {
+	storetest.RunConformance(t, newDiskStore)
+}
+
+func TestRedisConformance(t *testing.T) {
+	storetest.RunConformance(t, func(t *testing.T) store.Store {
+		s, err := miniredis.Run()
+		require.NoError(t, err)
+		t.Cleanup(s.Close)
+		return store.NewRedisStore(store.NewRedisClient(s.Addr(), ""))
+	})
+}
+
+func TestSQLiteConformance(t *testing.T) {
+	storetest.RunConformance(t, func(t *testing.T) store.Store {
+		db, err := store.OpenSQLite(context.TODO(), filepath.Join(tempDir(t), "goplaxt.db"))
+		require.NoError(t, err)
+		t.Cleanup(func() { db.Close() })
+		return store.NewSQLiteStore(db)
+	})
+}
+
+// TestPostgresqlConformance needs a scratch database, its users table is emptied before every test
+func TestPostgresqlConformance(t *testing.T) {
+	connStr := os.Getenv("GOPLAXT_TEST_POSTGRESQL_URL")
+	if connStr == "" {
+		t.Skip("GOPLAXT_TEST_POSTGRESQL_URL is not set")
+	}
+	storetest.RunConformance(t, func(t *testing.T) store.Store {
+		db := store.NewPostgresqlClient(connStr)
+		t.Cleanup(func() { db.Close() })
+		_, err := db.Exec("DELETE FROM users")
+		require.NoError(t, err)
+		return store.NewPostgresqlStore(db)
+	})
+}
+
+func TestEncryptedConformance(t *testing.T) {
+	storetest.RunConformance(t, func(t *testing.T) store.Store {
+		keyring, err := store.NewKeyring("k1", map[string][]byte{"k1": bytes.Repeat([]byte{1}, 32)})
+		require.NoError(t, err)
+		return store.NewEncryptedStore(newDiskStore(t), keyring)
+	})
+}
+
+func TestCachedConformance(t *testing.T) {
+	storetest.RunConformance(t, func(t *testing.T) store.Store {
+		return store.NewCachedStore(newDiskStore(t), 100, time.Minute)
+	})
+}
+
+func TestDiskQueueConformance(t *testing.T) {
+	storetest.RunQueueConformance(t, func(t *testing.T) store.Queue {
+		return store.NewDiskStore(tempDir(t))
+	})
+}
+
+func TestRedisQueueConformance(t *testing.T) {
+	storetest.RunQueueConformance(t, func(t *testing.T) store.Queue {
+		s, err := miniredis.Run()
+		require.NoError(t, err)
+		t.Cleanup(s.Close)
+		return store.NewRedisStore(store.NewRedisClient(s.Addr(), ""))
+	})
+}
+
+func TestSQLiteQueueConformance(t *testing.T) {
+	storetest.RunQueueConformance(t, func(t *testing.T) store.Queue {
+		db, err := store.OpenSQLite(context.TODO(), filepath.Join(tempDir(t), "goplaxt.db"))
+		require.NoError(t, err)
+		t.Cleanup(func() { db.Close() })
+		return store.NewSQLiteStore(db)
+	})
+}
+
+// TestPostgresqlQueueConformance needs a scratch database, its scrobble_jobs table is emptied before every test
+func TestPostgresqlQueueConformance(t *testing.T) {
+	connStr := os.Getenv("GOPLAXT_TEST_POSTGRESQL_URL")
+	if connStr == "" {
+		t.Skip("GOPLAXT_TEST_POSTGRESQL_URL is not set")
+	}
+	storetest.RunQueueConformance(t, func(t *testing.T) store.Queue {
+		db := store.NewPostgresqlClient(connStr)
+		t.Cleanup(func() { db.Close() })
+		_, err := db.Exec("DELETE FROM scrobble_jobs")
+		require.NoError(t, err)
+		return store.NewPostgresqlStore(db)
+	})
+}
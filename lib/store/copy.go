@@ -0,0 +1,103 @@
+package store
+
+import (
+	"context"
+	"time"
+
+	"github.com/gravitational/trace"
+)
+
+// CopyOptions tunes how CopyUsers runs
+type CopyOptions struct {
+	// DryRun reads every user without writing anything
+	DryRun bool
+	// BatchSize is how many users are read per page, defaults to 100
+	BatchSize int
+}
+
+// CopyReport summarizes a CopyUsers run
+type CopyReport struct {
+	SourceCount      int
+	DestinationCount int
+	Read             int
+	Written          int
+	Verified         int
+	// Mismatched holds the ids that did not read back the way they were written
+	Mismatched []string
+}
+
+// CopyUsers streams every user from one store into another keeping their ids,
+// so existing webhook urls keep working. Records are copied as stored, which
+// means encrypted tokens are moved without being decrypted. A dry run doesn't
+// touch to, which can be nil then.
+func CopyUsers(ctx context.Context, from, to Store, opts CopyOptions) (*CopyReport, error) {
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = 100
+	}
+	report := &CopyReport{}
+
+	var err error
+	if report.SourceCount, err = from.CountUsers(ctx); err != nil {
+		return report, trace.Wrap(err)
+	}
+
+	cursor := ""
+	for {
+		users, next, err := from.ListUsers(ctx, cursor, opts.BatchSize)
+		if err != nil {
+			return report, trace.Wrap(err)
+		}
+		for _, user := range users {
+			report.Read++
+			if opts.DryRun {
+				continue
+			}
+			if err := to.WriteUser(ctx, *user); err != nil {
+				return report, trace.Errorf("failed to write user %s: %w", user.ID, err)
+			}
+			report.Written++
+
+			copied, err := to.GetUser(ctx, user.ID)
+			if err != nil || !sameUser(user, copied) {
+				report.Mismatched = append(report.Mismatched, user.ID)
+				continue
+			}
+			report.Verified++
+		}
+		if next == "" {
+			break
+		}
+		cursor = next
+	}
+
+	if opts.DryRun {
+		return report, nil
+	}
+	if report.DestinationCount, err = to.CountUsers(ctx); err != nil {
+		return report, trace.Wrap(err)
+	}
+	return report, nil
+}
+
+// sameUser compares two users, allowing for the millisecond every backend keeps timestamps to
+func sameUser(a, b *User) bool {
+	if b == nil {
+		return false
+	}
+	return a.ID == b.ID &&
+		a.Username == b.Username &&
+		a.AccessToken == b.AccessToken &&
+		a.RefreshToken == b.RefreshToken &&
+		a.Scope == b.Scope &&
+		a.keyID == b.keyID &&
+		sameTime(a.ExpiresAt, b.ExpiresAt) &&
+		sameTime(a.Updated, b.Updated)
+}
+
+func sameTime(a, b time.Time) bool {
+	drift := a.Sub(b)
+	if drift < 0 {
+		drift = -drift
+	}
+	return drift < time.Millisecond
+}
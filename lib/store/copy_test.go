@@ -0,0 +1,63 @@
+package store
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCopyUsersFromDiskToRedis(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goplaxt-keystore")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	s, err := miniredis.Run()
+	require.NoError(t, err)
+	defer s.Close()
+
+	from := NewDiskStore(dir)
+	to := NewRedisStore(NewRedisClient(s.Addr(), ""))
+	for _, id := range []string{"id1", "id2", "id3"} {
+		require.NoError(t, from.WriteUser(context.TODO(), User{
+			ID:           id,
+			Username:     "halkeye",
+			AccessToken:  "access-" + id,
+			RefreshToken: "refresh-" + id,
+			ExpiresAt:    time.Date(2019, 04, 26, 0, 0, 0, 0, time.UTC),
+			Updated:      time.Date(2019, 02, 25, 13, 14, 15, 123456789, time.UTC),
+			keyID:        "k1",
+		}))
+	}
+
+	report, err := CopyUsers(context.TODO(), from, nil, CopyOptions{DryRun: true, BatchSize: 2})
+	require.NoError(t, err)
+	assert.Equal(t, 3, report.SourceCount)
+	assert.Equal(t, 3, report.Read)
+	assert.Equal(t, 0, report.Written)
+	assert.Equal(t, 0, report.DestinationCount)
+
+	report, err = CopyUsers(context.TODO(), from, to, CopyOptions{BatchSize: 2})
+	require.NoError(t, err)
+	assert.Equal(t, 3, report.Written)
+	assert.Equal(t, 3, report.Verified)
+	assert.Equal(t, 3, report.DestinationCount)
+	assert.Empty(t, report.Mismatched)
+
+	assert.Equal(t, "access-id2", s.HGet("goplaxt:user:id2", "access"))
+	assert.Equal(t, "k1", s.HGet("goplaxt:user:id2", "key"))
+}
+
+func TestSameUserComparesTimestamps(t *testing.T) {
+	user := User{ID: "id123", Updated: time.Date(2019, 02, 25, 13, 14, 15, 123456789, time.UTC)}
+	copied := user
+	copied.Updated = copied.Updated.Truncate(time.Millisecond)
+	assert.True(t, sameUser(&user, &copied))
+
+	copied.Updated = user.Updated.Add(-time.Hour)
+	assert.False(t, sameUser(&user, &copied))
+}
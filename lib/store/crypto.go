@@ -0,0 +1,184 @@
+package store
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"io"
+	"strings"
+
+	"github.com/gravitational/trace"
+)
+
+// dataKeySize is the size of the per token AES-256 data key
+const dataKeySize = 32
+
+// Keyring holds the key encryption keys used to protect tokens at rest.
+// The primary key encrypts every write, the others are only kept around
+// so records written before a rotation can still be read.
+type Keyring struct {
+	primary string
+	keys    map[string]cipher.AEAD
+}
+
+// NewKeyring creates a keyring from raw AES keys, writes use the primary key
+func NewKeyring(primary string, keys map[string][]byte) (*Keyring, error) {
+	if _, ok := keys[primary]; !ok {
+		return nil, trace.BadParameter("primary key %q is not in the keyring", primary)
+	}
+	k := &Keyring{
+		primary: primary,
+		keys:    make(map[string]cipher.AEAD, len(keys)),
+	}
+	for id, key := range keys {
+		if id == "" {
+			return nil, trace.BadParameter("key ids can not be empty")
+		}
+		aead, err := newAEAD(key)
+		if err != nil {
+			return nil, trace.BadParameter("invalid key %q: %v", id, err)
+		}
+		k.keys[id] = aead
+	}
+	return k, nil
+}
+
+// ParseKeyring reads a keyring from a "id:base64key,id:base64key" list,
+// the first key listed is the primary one
+func ParseKeyring(spec string) (*Keyring, error) {
+	var primary string
+	keys := make(map[string][]byte)
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		parts := strings.SplitN(entry, ":", 2)
+		if len(parts) != 2 {
+			return nil, trace.BadParameter("key entries must look like id:base64key")
+		}
+		key, err := base64.StdEncoding.DecodeString(parts[1])
+		if err != nil {
+			return nil, trace.BadParameter("key %q is not valid base64: %v", parts[0], err)
+		}
+		if _, ok := keys[parts[0]]; ok {
+			return nil, trace.BadParameter("key %q is listed more than once", parts[0])
+		}
+		if primary == "" {
+			primary = parts[0]
+		}
+		keys[parts[0]] = key
+	}
+	if primary == "" {
+		return nil, trace.BadParameter("no keys found")
+	}
+	return NewKeyring(primary, keys)
+}
+
+// sealUser returns a copy of the user with its tokens encrypted by the primary key
+func (k *Keyring) sealUser(user User) (User, error) {
+	var err error
+	if user.AccessToken, err = k.seal(user.ID, "access", user.AccessToken); err != nil {
+		return user, trace.Wrap(err)
+	}
+	if user.RefreshToken, err = k.seal(user.ID, "refresh", user.RefreshToken); err != nil {
+		return user, trace.Wrap(err)
+	}
+	user.keyID = k.primary
+	return user, nil
+}
+
+// openUser returns a copy of the user with its tokens decrypted, plaintext records are returned as is
+func (k *Keyring) openUser(user User) (User, error) {
+	if user.keyID == "" {
+		return user, nil
+	}
+	var err error
+	if user.AccessToken, err = k.open(user.keyID, user.ID, "access", user.AccessToken); err != nil {
+		return user, trace.Wrap(err)
+	}
+	if user.RefreshToken, err = k.open(user.keyID, user.ID, "refresh", user.RefreshToken); err != nil {
+		return user, trace.Wrap(err)
+	}
+	user.keyID = ""
+	return user, nil
+}
+
+// seal encrypts a value with a fresh data key and wraps that key with the primary key.
+// The record id and field are authenticated so sealed values can't be swapped around.
+func (k *Keyring) seal(id, field, plaintext string) (string, error) {
+	dataKey := make([]byte, dataKeySize)
+	if _, err := io.ReadFull(rand.Reader, dataKey); err != nil {
+		return "", trace.Wrap(err)
+	}
+	wrappedKey, err := encrypt(k.keys[k.primary], dataKey, []byte(id))
+	if err != nil {
+		return "", trace.Wrap(err)
+	}
+	dataAEAD, err := newAEAD(dataKey)
+	if err != nil {
+		return "", trace.Wrap(err)
+	}
+	ciphertext, err := encrypt(dataAEAD, []byte(plaintext), []byte(id+"."+field))
+	if err != nil {
+		return "", trace.Wrap(err)
+	}
+	return base64.StdEncoding.EncodeToString(append(wrappedKey, ciphertext...)), nil
+}
+
+func (k *Keyring) open(keyID, id, field, sealed string) (string, error) {
+	kek, ok := k.keys[keyID]
+	if !ok {
+		return "", trace.NotFound("encryption key %q is not in the keyring", keyID)
+	}
+	raw, err := base64.StdEncoding.DecodeString(sealed)
+	if err != nil {
+		return "", trace.Wrap(err)
+	}
+	wrappedSize := kek.NonceSize() + dataKeySize + kek.Overhead()
+	if len(raw) < wrappedSize {
+		return "", trace.BadParameter("sealed %s is too short", field)
+	}
+	dataKey, err := decrypt(kek, raw[:wrappedSize], []byte(id))
+	if err != nil {
+		return "", trace.Wrap(err)
+	}
+	dataAEAD, err := newAEAD(dataKey)
+	if err != nil {
+		return "", trace.Wrap(err)
+	}
+	plaintext, err := decrypt(dataAEAD, raw[wrappedSize:], []byte(id+"."+field))
+	if err != nil {
+		return "", trace.Wrap(err)
+	}
+	return string(plaintext), nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	return cipher.NewGCM(block)
+}
+
+func encrypt(aead cipher.AEAD, plaintext, additionalData []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, trace.Wrap(err)
+	}
+	return aead.Seal(nonce, nonce, plaintext, additionalData), nil
+}
+
+func decrypt(aead cipher.AEAD, sealed, additionalData []byte) ([]byte, error) {
+	if len(sealed) < aead.NonceSize() {
+		return nil, trace.BadParameter("ciphertext is too short")
+	}
+	nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	plaintext, err := aead.Open(nil, nonce, ciphertext, additionalData)
+	if err != nil {
+		return nil, trace.AccessDenied("failed to decrypt: %v", err)
+	}
+	return plaintext, nil
+}
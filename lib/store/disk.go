@@ -2,115 +2,554 @@ package store
 
 import (
 	"context"
-	"fmt"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/gravitational/trace"
-	"github.com/peterbourgon/diskv"
+	"go.opentelemetry.io/otel/attribute"
+	oteltrace "go.opentelemetry.io/otel/trace"
 )
 
-// DiskStore is a storage engine that writes to the disk
-type DiskStore struct{}
+// legacyFields are the files a user was split into before records were kept as json
+var legacyFields = []string{"username", "updated", "access", "refresh", "key"}
 
-// NewDiskStore will instantiate the disk storage
-func NewDiskStore() *DiskStore {
-	return &DiskStore{}
+// DiskStore is a storage engine that writes one json record per user to the disk
+type DiskStore struct {
+	basePath string
 }
 
-// Ping will check if the connection works right
-func (s DiskStore) Ping(ctx context.Context) error {
-	// TODO not sure what can fail here
-	return nil
+// diskRecord is what gets written to <id>.json
+type diskRecord struct {
+	Username     string    `json:"username"`
+	AccessToken  string    `json:"access"`
+	RefreshToken string    `json:"refresh"`
+	Scope        string    `json:"scope,omitempty"`
+	ExpiresAt    time.Time `json:"expires_at"`
+	Updated      time.Time `json:"updated"`
+	KeyID        string    `json:"key,omitempty"`
+	Version      int64     `json:"version,omitempty"`
 }
 
-// WriteUser will write a user object to disk
-func (s DiskStore) WriteUser(user User) error {
-	fields := map[string]string{
-		"username": user.Username,
-		"access":   user.AccessToken,
-		"refresh":  user.RefreshToken,
-		"updated":  user.Updated.Format("01-02-2006"),
+// diskSwaps serialises writes and compare and swaps within the process,
+// replicas need their users in sqlite, postgres or redis
+var diskSwaps sync.Mutex
+
+// NewDiskStore will instantiate the disk storage under basePath
+func NewDiskStore(basePath string) *DiskStore {
+	return &DiskStore{
+		basePath: basePath,
 	}
-	for k, v := range fields {
-		err := s.writeField(user.ID, k, v)
-		if err != nil {
-			return trace.Errorf("failed to write field %s: %w", k, err)
+}
+
+func (s DiskStore) startSpan(ctx context.Context, name, path string) (context.Context, oteltrace.Span) {
+	return startSpan(ctx, "disk."+name, attribute.String("disk.path", path))
+}
+
+// Ping will check if the keystore directory is usable
+func (s DiskStore) Ping(ctx context.Context) (err error) {
+	_, span := s.startSpan(ctx, "Ping", s.basePath)
+	defer func() { endSpan(span, err) }()
+
+	return trace.ConvertSystemError(os.MkdirAll(s.basePath, 0700))
+}
+
+// WriteUser will atomically replace the user record on disk, keeping the version it is at
+func (s DiskStore) WriteUser(ctx context.Context, user User) error {
+	diskSwaps.Lock()
+	defer diskSwaps.Unlock()
+
+	stored, err := s.GetUser(ctx, user.ID)
+	if err != nil && !trace.IsNotFound(err) {
+		return trace.Wrap(err)
+	}
+	if stored != nil {
+		user.Version = stored.Version
+	}
+	return trace.Wrap(s.writeUser(ctx, user))
+}
+
+// writeUser replaces the user record on disk as it is
+func (s DiskStore) writeUser(ctx context.Context, user User) (err error) {
+	path, err := s.recordPath(user.ID)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	ctx, span := s.startSpan(ctx, "WriteUser", path)
+	defer func() { endSpan(span, err) }()
+
+	if err := ctx.Err(); err != nil {
+		return trace.Wrap(err)
+	}
+	data, err := json.Marshal(diskRecord{
+		Username:     user.Username,
+		AccessToken:  user.AccessToken,
+		RefreshToken: user.RefreshToken,
+		Scope:        user.Scope,
+		ExpiresAt:    user.ExpiresAt,
+		Updated:      user.Updated,
+		KeyID:        user.keyID,
+		Version:      user.Version,
+	})
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	if err := writeAtomic(path, data); err != nil {
+		return trace.Wrap(err)
+	}
+
+	// The record supersedes whatever was left in the legacy layout
+	for _, field := range legacyFields {
+		if err := os.Remove(s.legacyPath(user.ID, field)); err != nil && !os.IsNotExist(err) {
+			return trace.ConvertSystemError(err)
 		}
 	}
 	return nil
 }
 
-// GetUser will load a user from disk
-func (s DiskStore) GetUser(id string) (*User, error) {
-	un, err := s.readField(id, "username")
+// writeAtomic writes next to path and renames over it, so a crash leaves either
+// the old or the new file but never half of one
+func writeAtomic(path string, data []byte) error {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return trace.ConvertSystemError(err)
+	}
+	tmp, err := ioutil.TempFile(dir, filepath.Base(path)+".tmp-")
 	if err != nil {
-		return nil, err
+		return trace.ConvertSystemError(err)
 	}
-	ud, err := s.readField(id, "updated")
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return trace.ConvertSystemError(err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return trace.ConvertSystemError(err)
+	}
+	if err := tmp.Close(); err != nil {
+		return trace.ConvertSystemError(err)
+	}
+	return trace.ConvertSystemError(os.Rename(tmp.Name(), path))
+}
+
+// CompareAndSwapUser will replace the user record only while it is still at version
+func (s DiskStore) CompareAndSwapUser(ctx context.Context, version int64, user User) error {
+	diskSwaps.Lock()
+	defer diskSwaps.Unlock()
+
+	stored, err := s.GetUser(ctx, user.ID)
 	if err != nil {
-		return nil, err
+		return trace.Wrap(err)
+	}
+	if stored.Version != version {
+		return trace.CompareFailed("user %s is no longer at version %d", user.ID, version)
 	}
-	ac, err := s.readField(id, "access")
+	return trace.Wrap(s.writeUser(ctx, user))
+}
+
+// GetUser will load a user from disk, falling back to the legacy one file per field layout
+func (s DiskStore) GetUser(ctx context.Context, id string) (_ *User, err error) {
+	path, err := s.recordPath(id)
 	if err != nil {
-		return nil, err
+		return nil, trace.Wrap(err)
+	}
+	ctx, span := s.startSpan(ctx, "GetUser", path)
+	defer func() { endSpan(span, err) }()
+
+	if err := ctx.Err(); err != nil {
+		return nil, trace.Wrap(err)
+	}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s.getLegacyUser(id)
 	}
-	re, err := s.readField(id, "refresh")
 	if err != nil {
-		return nil, err
+		return nil, trace.ConvertSystemError(err)
+	}
+	var record diskRecord
+	if err := json.Unmarshal(data, &record); err != nil {
+		return nil, trace.Errorf("corrupt record %s: %v", path, err)
+	}
+	user := User{
+		ID:           id,
+		Username:     strings.ToLower(record.Username),
+		AccessToken:  record.AccessToken,
+		RefreshToken: record.RefreshToken,
+		Scope:        record.Scope,
+		ExpiresAt:    record.ExpiresAt,
+		Updated:      record.Updated,
+		Version:      record.Version,
+		store:        s,
+		keyID:        record.KeyID,
+	}
+
+	return &user, nil
+}
+
+func (s DiskStore) getLegacyUser(id string) (*User, error) {
+	fields := make(map[string]string, len(legacyFields))
+	for _, field := range legacyFields {
+		value, err := ioutil.ReadFile(s.legacyPath(id, field))
+		switch {
+		case os.IsNotExist(err) && field == "username":
+			return nil, trace.NotFound("no user with id %s", id)
+		case os.IsNotExist(err) && field == "key":
+			// Users written before encryption existed have no key field
+			continue
+		}
+		if err != nil {
+			return nil, trace.ConvertSystemError(err)
+		}
+		fields[field] = string(value)
 	}
-	updated, _ := time.Parse("01-02-2006", ud)
+	updated, _ := time.Parse("01-02-2006", fields["updated"])
 	user := User{
 		ID:           id,
-		Username:     strings.ToLower(un),
-		AccessToken:  ac,
-		RefreshToken: re,
+		Username:     strings.ToLower(fields["username"]),
+		AccessToken:  fields["access"],
+		RefreshToken: fields["refresh"],
 		Updated:      updated,
+		store:        s,
+		keyID:        fields["key"],
 	}
 
 	return &user, nil
 }
 
-func (s DiskStore) DeleteUser(id string) bool {
-	s.eraseField(id, "username")
-	s.eraseField(id, "updated")
-	s.eraseField(id, "access")
-	s.eraseField(id, "refresh")
-	return true
+// DeleteUser will remove a user from disk, reporting whether it existed
+func (s DiskStore) DeleteUser(ctx context.Context, id string) (_ bool, err error) {
+	path, err := s.recordPath(id)
+	if err != nil {
+		return false, trace.Wrap(err)
+	}
+	ctx, span := s.startSpan(ctx, "DeleteUser", path)
+	defer func() { endSpan(span, err) }()
+
+	if err := ctx.Err(); err != nil {
+		return false, trace.Wrap(err)
+	}
+	found := false
+	paths := []string{path}
+	for _, field := range legacyFields {
+		paths = append(paths, s.legacyPath(id, field))
+	}
+	for _, path := range paths {
+		err := os.Remove(path)
+		switch {
+		case os.IsNotExist(err):
+			continue
+		case err != nil:
+			return found, trace.ConvertSystemError(err)
+		}
+		found = true
+	}
+	return found, nil
 }
 
-func (s DiskStore) writeField(id, field, value string) error {
-	return s.write(fmt.Sprintf("%s.%s", id, field), value)
+// ListUsers will walk the keystore directory, returning users sorted by id after cursor
+func (s DiskStore) ListUsers(ctx context.Context, cursor string, limit int) (_ []*User, _ string, err error) {
+	ctx, span := s.startSpan(ctx, "ListUsers", s.basePath)
+	defer func() { endSpan(span, err) }()
+
+	if limit <= 0 {
+		return nil, "", trace.BadParameter("limit must be positive")
+	}
+	ids, err := s.userIDs()
+	if err != nil {
+		return nil, "", trace.Wrap(err)
+	}
+	start := sort.SearchStrings(ids, cursor)
+	if start < len(ids) && ids[start] == cursor {
+		start++
+	}
+
+	var users []*User
+	for _, id := range ids[start:] {
+		if err := ctx.Err(); err != nil {
+			return nil, "", trace.Wrap(err)
+		}
+		user, err := s.GetUser(ctx, id)
+		if err != nil {
+			return nil, "", trace.Wrap(err)
+		}
+		users = append(users, user)
+		if len(users) == limit {
+			return users, id, nil
+		}
+	}
+	return users, "", nil
 }
 
-func (s DiskStore) readField(id, field string) (string, error) {
-	return s.read(fmt.Sprintf("%s.%s", id, field))
+// CountUsers will count the users in the keystore directory
+func (s DiskStore) CountUsers(ctx context.Context) (_ int, err error) {
+	_, span := s.startSpan(ctx, "CountUsers", s.basePath)
+	defer func() { endSpan(span, err) }()
+
+	ids, err := s.userIDs()
+	return len(ids), trace.Wrap(err)
 }
 
-func (s DiskStore) eraseField(id, field string) error {
-	d := diskv.New(diskv.Options{
-		BasePath:     "keystore",
-		Transform:    flatTransform,
-		CacheSizeMax: 1024 * 1024,
-	})
-	return d.Erase(fmt.Sprintf("%s.%s", id, field))
+// userIDs returns the sorted ids of every user in either layout
+func (s DiskStore) userIDs() ([]string, error) {
+	entries, err := ioutil.ReadDir(s.basePath)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, trace.ConvertSystemError(err)
+	}
+	seen := make(map[string]bool)
+	var ids []string
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		var id string
+		switch name := entry.Name(); {
+		case strings.HasSuffix(name, ".json"):
+			id = strings.TrimSuffix(name, ".json")
+		case strings.HasSuffix(name, ".username"):
+			id = strings.TrimSuffix(name, ".username")
+		default:
+			continue
+		}
+		if !seen[id] {
+			seen[id] = true
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	return ids, nil
 }
 
-func (s DiskStore) write(key, value string) error {
-	d := diskv.New(diskv.Options{
-		BasePath:     "keystore",
-		Transform:    flatTransform,
-		CacheSizeMax: 1024 * 1024,
-	})
-	return d.Write(key, []byte(value))
+// recordPath returns where a user record lives, refusing ids that would escape the keystore
+func (s DiskStore) recordPath(id string) (string, error) {
+	if id == "" || strings.ContainsAny(id, `/\`) || strings.HasPrefix(id, ".") {
+		return "", trace.BadParameter("invalid user id %q", id)
+	}
+	return filepath.Join(s.basePath, id+".json"), nil
 }
 
-func (s DiskStore) read(key string) (string, error) {
-	d := diskv.New(diskv.Options{
-		BasePath:     "keystore",
-		Transform:    flatTransform,
-		CacheSizeMax: 1024 * 1024,
-	})
-	value, err := d.Read(key)
-	return string(value), err
+func (s DiskStore) legacyPath(id, field string) string {
+	return filepath.Join(s.basePath, id+"."+field)
+}
+
+// diskJobs serialises access to the spool within the process, replicas need
+// a queue in sqlite, postgres or redis
+var diskJobs sync.Mutex
+
+// spoolPath is the directory scrobble jobs are spooled to, one json file each
+func (s DiskStore) spoolPath() string {
+	return filepath.Join(s.basePath, "queue")
+}
+
+// deadPath is the directory dead jobs are moved to, out of the way of claims
+func (s DiskStore) deadPath() string {
+	return filepath.Join(s.spoolPath(), "dead")
+}
+
+// jobPath returns where a job lives in dir, refusing ids that would escape it
+func (s DiskStore) jobPath(dir, id string) (string, error) {
+	if id == "" || strings.ContainsAny(id, `/\`) || strings.HasPrefix(id, ".") {
+		return "", trace.BadParameter("invalid job id %q", id)
+	}
+	return filepath.Join(dir, id+".json"), nil
+}
+
+func (s DiskStore) writeJob(dir string, job Job) error {
+	path, err := s.jobPath(dir, job.ID)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	data, err := json.Marshal(job)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	return trace.Wrap(writeAtomic(path, data))
+}
+
+// jobs reads every job in dir, ordered by when they are due
+func (s DiskStore) jobs(dir string) ([]*Job, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, trace.ConvertSystemError(err)
+	}
+	var jobs []*Job
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+		data, err := ioutil.ReadFile(filepath.Join(dir, entry.Name()))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, trace.ConvertSystemError(err)
+		}
+		var job Job
+		if err := json.Unmarshal(data, &job); err != nil {
+			return nil, trace.Errorf("corrupt job %s: %v", entry.Name(), err)
+		}
+		jobs = append(jobs, &job)
+	}
+	sort.SliceStable(jobs, func(i, j int) bool { return jobs[i].RunAt.Before(jobs[j].RunAt) })
+	return jobs, nil
+}
+
+// Enqueue will spool the job to disk
+func (s DiskStore) Enqueue(ctx context.Context, job Job) (err error) {
+	_, span := s.startSpan(ctx, "Enqueue", s.spoolPath())
+	defer func() { endSpan(span, err) }()
+
+	if err := ctx.Err(); err != nil {
+		return trace.Wrap(err)
+	}
+	diskJobs.Lock()
+	defer diskJobs.Unlock()
+	return trace.Wrap(s.writeJob(s.spoolPath(), job))
+}
+
+// Claim will push back the earliest due job in the spool
+func (s DiskStore) Claim(ctx context.Context, now time.Time, lease time.Duration) (_ *Job, err error) {
+	_, span := s.startSpan(ctx, "Claim", s.spoolPath())
+	defer func() { endSpan(span, err) }()
+
+	if err := ctx.Err(); err != nil {
+		return nil, trace.Wrap(err)
+	}
+	diskJobs.Lock()
+	defer diskJobs.Unlock()
+	jobs, err := s.jobs(s.spoolPath())
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	for _, job := range jobs {
+		if job.RunAt.After(now) {
+			break
+		}
+		job.RunAt = now.Add(lease)
+		job.Claim = uuid()
+		if err := s.writeJob(s.spoolPath(), *job); err != nil {
+			return nil, trace.Wrap(err)
+		}
+		return job, nil
+	}
+	return nil, trace.NotFound("no scrobble job is due")
+}
+
+// Release will write the job back to the spool, moving it to the dead jobs once it is dead
+func (s DiskStore) Release(ctx context.Context, job Job) (err error) {
+	_, span := s.startSpan(ctx, "Release", s.spoolPath())
+	defer func() { endSpan(span, err) }()
+
+	diskJobs.Lock()
+	defer diskJobs.Unlock()
+	path, err := s.claimedJob(job)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	if !job.Dead {
+		return trace.Wrap(s.writeJob(s.spoolPath(), job))
+	}
+	if err := s.writeJob(s.deadPath(), job); err != nil {
+		return trace.Wrap(err)
+	}
+	return trace.ConvertSystemError(os.Remove(path))
+}
+
+// Complete will remove the job from the spool
+func (s DiskStore) Complete(ctx context.Context, job Job) (err error) {
+	_, span := s.startSpan(ctx, "Complete", s.spoolPath())
+	defer func() { endSpan(span, err) }()
+
+	diskJobs.Lock()
+	defer diskJobs.Unlock()
+	path, err := s.claimedJob(job)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	return trace.ConvertSystemError(os.Remove(path))
+}
+
+// claimedJob returns the path of job, pending or dead, while it still holds
+// the claim of the worker, diskJobs must be held
+func (s DiskStore) claimedJob(job Job) (string, error) {
+	path, err := s.jobPath(s.spoolPath(), job.ID)
+	if err != nil {
+		return "", trace.Wrap(err)
+	}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		path = filepath.Join(s.deadPath(), filepath.Base(path))
+		data, err = ioutil.ReadFile(path)
+	}
+	if err != nil {
+		return "", trace.ConvertSystemError(err)
+	}
+	var stored Job
+	if err := json.Unmarshal(data, &stored); err != nil {
+		return "", trace.Errorf("corrupt job %s: %v", job.ID, err)
+	}
+	if stored.Claim != job.Claim {
+		return "", trace.CompareFailed("scrobble job %s was claimed again", job.ID)
+	}
+	return path, nil
+}
+
+// DeadJobs will read the oldest dead jobs
+func (s DiskStore) DeadJobs(ctx context.Context, limit int) (_ []*Job, err error) {
+	_, span := s.startSpan(ctx, "DeadJobs", s.deadPath())
+	defer func() { endSpan(span, err) }()
+
+	if limit <= 0 {
+		return nil, trace.BadParameter("limit must be positive")
+	}
+	diskJobs.Lock()
+	defer diskJobs.Unlock()
+	dead, err := s.jobs(s.deadPath())
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	sort.SliceStable(dead, func(i, j int) bool { return dead[i].ReceivedAt.Before(dead[j].ReceivedAt) })
+	if len(dead) > limit {
+		dead = dead[:limit]
+	}
+	return dead, nil
+}
+
+// PurgeDead will remove the old dead jobs from disk
+func (s DiskStore) PurgeDead(ctx context.Context, before time.Time) (_ int, err error) {
+	_, span := s.startSpan(ctx, "PurgeDead", s.deadPath())
+	defer func() { endSpan(span, err) }()
+
+	diskJobs.Lock()
+	defer diskJobs.Unlock()
+	dead, err := s.jobs(s.deadPath())
+	if err != nil {
+		return 0, trace.Wrap(err)
+	}
+	purged := 0
+	for _, job := range dead {
+		if !job.ReceivedAt.Before(before) {
+			continue
+		}
+		path, err := s.jobPath(s.deadPath(), job.ID)
+		if err != nil {
+			return purged, trace.Wrap(err)
+		}
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return purged, trace.ConvertSystemError(err)
+		}
+		purged++
+	}
+	return purged, nil
 }
@@ -0,0 +1,177 @@
+package store
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDiskListingUsers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goplaxt-keystore")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	store := NewDiskStore(dir)
+	for _, id := range []string{"id3", "id1", "id2"} {
+		require.NoError(t, store.WriteUser(context.TODO(), User{
+			ID:           id,
+			Username:     "halkeye",
+			AccessToken:  "access-" + id,
+			RefreshToken: "refresh-" + id,
+			Updated:      time.Date(2019, 02, 25, 0, 0, 0, 0, time.UTC),
+		}))
+	}
+
+	users, next, err := store.ListUsers(context.TODO(), "", 2)
+	require.NoError(t, err)
+	require.Len(t, users, 2)
+	assert.Equal(t, "id1", users[0].ID)
+	assert.Equal(t, "id2", users[1].ID)
+	assert.Equal(t, "access-id2", users[1].AccessToken)
+	assert.Equal(t, "id2", next)
+
+	users, next, err = store.ListUsers(context.TODO(), next, 2)
+	require.NoError(t, err)
+	require.Len(t, users, 1)
+	assert.Equal(t, "id3", users[0].ID)
+	assert.Equal(t, "", next)
+
+	count, err := store.CountUsers(context.TODO())
+	require.NoError(t, err)
+	assert.Equal(t, 3, count)
+}
+
+func TestDiskListingEmptyKeystore(t *testing.T) {
+	store := NewDiskStore("does-not-exist")
+
+	users, next, err := store.ListUsers(context.TODO(), "", 10)
+	assert.NoError(t, err)
+	assert.Empty(t, users)
+	assert.Equal(t, "", next)
+
+	count, err := store.CountUsers(context.TODO())
+	assert.NoError(t, err)
+	assert.Equal(t, 0, count)
+}
+
+func TestDiskSavingUserAsSingleRecord(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goplaxt-keystore")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	store := NewDiskStore(dir)
+	updated := time.Date(2019, 02, 25, 10, 30, 15, 500, time.UTC)
+	require.NoError(t, store.WriteUser(context.TODO(), User{
+		ID:           "id123",
+		Username:     "Halkeye",
+		AccessToken:  "access123",
+		RefreshToken: "refresh123",
+		Updated:      updated,
+	}))
+
+	entries, err := ioutil.ReadDir(dir)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	assert.Equal(t, "id123.json", entries[0].Name())
+
+	user, err := store.GetUser(context.TODO(), "id123")
+	require.NoError(t, err)
+	assert.Equal(t, "halkeye", user.Username)
+	assert.Equal(t, "access123", user.AccessToken)
+	assert.True(t, updated.Equal(user.Updated))
+}
+
+func TestDiskReadingLegacyLayout(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goplaxt-keystore")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	legacy := map[string]string{
+		"username": "Halkeye",
+		"access":   "access123",
+		"refresh":  "refresh123",
+		"updated":  "02-25-2019",
+	}
+	for field, value := range legacy {
+		require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "id123."+field), []byte(value), 0600))
+	}
+
+	store := NewDiskStore(dir)
+	user, err := store.GetUser(context.TODO(), "id123")
+	require.NoError(t, err)
+	assert.Equal(t, "halkeye", user.Username)
+	assert.Equal(t, "refresh123", user.RefreshToken)
+	assert.Equal(t, time.Date(2019, 02, 25, 0, 0, 0, 0, time.UTC), user.Updated)
+
+	count, err := store.CountUsers(context.TODO())
+	require.NoError(t, err)
+	assert.Equal(t, 1, count)
+
+	// Writing the user moves it over to the new layout
+	swapped := *user
+	swapped.AccessToken, swapped.RefreshToken, swapped.Version = "access456", "refresh456", user.Version+2
+	require.NoError(t, store.CompareAndSwapUser(context.TODO(), user.Version, swapped))
+	entries, err := ioutil.ReadDir(dir)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	assert.Equal(t, "id123.json", entries[0].Name())
+
+	deleted, err := store.DeleteUser(context.TODO(), "id123")
+	require.NoError(t, err)
+	assert.True(t, deleted)
+	_, err = store.GetUser(context.TODO(), "id123")
+	assert.Error(t, err)
+}
+
+func TestDiskRejectsPathsOutsideTheKeystore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goplaxt-keystore")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	store := NewDiskStore(dir)
+	for _, id := range []string{"", "../id123", "a/b", ".hidden"} {
+		_, err := store.GetUser(context.TODO(), id)
+		assert.Error(t, err, id)
+		assert.Error(t, store.WriteUser(context.TODO(), User{ID: id}), id)
+	}
+}
+
+func TestDiskCancelledContext(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goplaxt-keystore")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	store := NewDiskStore(dir)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	assert.Error(t, store.WriteUser(ctx, User{ID: "id123"}))
+	count, err := store.CountUsers(context.TODO())
+	require.NoError(t, err)
+	assert.Equal(t, 0, count)
+}
+
+func TestDiskQueueMovesDeadJobsOutOfTheSpool(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goplaxt-keystore")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	store := NewDiskStore(dir)
+	now := time.Date(2019, 02, 25, 0, 0, 0, 0, time.UTC)
+	require.NoError(t, store.Enqueue(context.TODO(), NewJob("id123", "https://plaxt.example.com", []byte(`{}`), now)))
+	job, err := store.Claim(context.TODO(), now, time.Minute)
+	require.NoError(t, err)
+	job.Dead = true
+	require.NoError(t, store.Release(context.TODO(), *job))
+
+	_, err = os.Stat(filepath.Join(dir, "queue", job.ID+".json"))
+	assert.True(t, os.IsNotExist(err), "claims shouldn't have to read dead jobs")
+	_, err = os.Stat(filepath.Join(dir, "queue", "dead", job.ID+".json"))
+	assert.NoError(t, err)
+}
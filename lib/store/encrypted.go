@@ -0,0 +1,147 @@
+package store
+
+import (
+	"context"
+
+	"github.com/gravitational/trace"
+)
+
+// EncryptedStore wraps another store and keeps user tokens encrypted at rest
+type EncryptedStore struct {
+	inner   Store
+	keyring *Keyring
+}
+
+// NewEncryptedStore will encrypt everything written to inner with the keyring
+func NewEncryptedStore(inner Store, keyring *Keyring) *EncryptedStore {
+	return &EncryptedStore{
+		inner:   inner,
+		keyring: keyring,
+	}
+}
+
+// Ping will check if the wrapped store works right
+func (s *EncryptedStore) Ping(ctx context.Context) error {
+	return s.inner.Ping(ctx)
+}
+
+// WriteUser will encrypt the user tokens with the primary key and write them
+func (s *EncryptedStore) WriteUser(ctx context.Context, user User) error {
+	sealed, err := s.keyring.sealUser(user)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	return trace.Wrap(s.inner.WriteUser(ctx, sealed))
+}
+
+// CompareAndSwapUser will encrypt the user tokens and swap them in the wrapped store
+func (s *EncryptedStore) CompareAndSwapUser(ctx context.Context, version int64, user User) error {
+	sealed, err := s.keyring.sealUser(user)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	return trace.Wrap(s.inner.CompareAndSwapUser(ctx, version, sealed))
+}
+
+// GetUser will load and decrypt a user, plaintext records are encrypted on the way out
+func (s *EncryptedStore) GetUser(ctx context.Context, id string) (*User, error) {
+	user, err := s.inner.GetUser(ctx, id)
+	if err != nil || user == nil {
+		return user, err
+	}
+	opened, err := s.open(user)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	// A refresh in flight, on an odd version, seals the user when it is done
+	if user.keyID == "" && user.Version%2 == 0 {
+		if _, err := s.seal(ctx, user.Version, *opened); err != nil {
+			return nil, trace.Errorf("failed to encrypt plaintext user: %w", err)
+		}
+	}
+	return opened, nil
+}
+
+// DeleteUser will remove a user from the wrapped store
+func (s *EncryptedStore) DeleteUser(ctx context.Context, id string) (bool, error) {
+	return s.inner.DeleteUser(ctx, id)
+}
+
+// ListUsers will page through the wrapped store decrypting every user
+func (s *EncryptedStore) ListUsers(ctx context.Context, cursor string, limit int) ([]*User, string, error) {
+	users, next, err := s.inner.ListUsers(ctx, cursor, limit)
+	if err != nil {
+		return nil, "", trace.Wrap(err)
+	}
+	for i, user := range users {
+		if users[i], err = s.open(user); err != nil {
+			return nil, "", trace.Wrap(err)
+		}
+	}
+	return users, next, nil
+}
+
+// CountUsers will count the users in the wrapped store
+func (s *EncryptedStore) CountUsers(ctx context.Context) (int, error) {
+	return s.inner.CountUsers(ctx)
+}
+
+// Reencrypt seals every user again that isn't sealed with the primary key,
+// encrypting plaintext users that haven't been read yet and moving the others
+// off rotated keys. It returns how many users were written, a user changed
+// meanwhile is left to whoever changed it.
+func (s *EncryptedStore) Reencrypt(ctx context.Context, batchSize int) (int, error) {
+	written := 0
+	cursor := ""
+	for {
+		users, next, err := s.inner.ListUsers(ctx, cursor, batchSize)
+		if err != nil {
+			return written, trace.Wrap(err)
+		}
+		for _, user := range users {
+			// A refresh in flight, on an odd version, seals the user when it is done
+			if user.keyID == s.keyring.primary || user.Version%2 == 1 {
+				continue
+			}
+			opened, err := s.keyring.openUser(*user)
+			if err != nil {
+				return written, trace.Wrap(err)
+			}
+			sealed, err := s.seal(ctx, user.Version, opened)
+			if err != nil {
+				return written, trace.Wrap(err)
+			}
+			if sealed {
+				written++
+			}
+		}
+		if next == "" {
+			return written, nil
+		}
+		cursor = next
+	}
+}
+
+// seal writes opened again with the primary key while the stored user is still
+// at version, telling if it was written. The tokens stay the same, so does the
+// version, and a user changed meanwhile was sealed by whoever changed it.
+func (s *EncryptedStore) seal(ctx context.Context, version int64, opened User) (bool, error) {
+	sealed, err := s.keyring.sealUser(opened)
+	if err != nil {
+		return false, trace.Wrap(err)
+	}
+	err = s.inner.CompareAndSwapUser(ctx, version, sealed)
+	if trace.IsCompareFailed(err) || trace.IsNotFound(err) {
+		return false, nil
+	}
+	return err == nil, trace.Wrap(err)
+}
+
+func (s *EncryptedStore) open(user *User) (*User, error) {
+	opened, err := s.keyring.openUser(*user)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	opened.store = s
+	return &opened, nil
+}
@@ -0,0 +1,203 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/gravitational/trace"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testKey(b byte) []byte {
+	return bytes.Repeat([]byte{b}, 32)
+}
+
+func TestParseKeyring(t *testing.T) {
+	spec := "new:" + base64.StdEncoding.EncodeToString(testKey(1)) + ", old:" + base64.StdEncoding.EncodeToString(testKey(2))
+	keyring, err := ParseKeyring(spec)
+	require.NoError(t, err)
+	assert.Equal(t, "new", keyring.primary)
+	assert.Len(t, keyring.keys, 2)
+
+	_, err = ParseKeyring("")
+	assert.Error(t, err)
+	_, err = ParseKeyring("nokey")
+	assert.Error(t, err)
+	_, err = ParseKeyring("short:" + base64.StdEncoding.EncodeToString([]byte("tiny")))
+	assert.Error(t, err)
+	_, err = ParseKeyring(spec + ",new:" + base64.StdEncoding.EncodeToString(testKey(3)))
+	assert.True(t, trace.IsBadParameter(err), "expected a duplicate key id to be refused, got %v", err)
+}
+
+func TestEncryptedStoreWritesCiphertext(t *testing.T) {
+	s, err := miniredis.Run()
+	require.NoError(t, err)
+	defer s.Close()
+
+	keyring, err := NewKeyring("k1", map[string][]byte{"k1": testKey(1)})
+	require.NoError(t, err)
+	store := NewEncryptedStore(NewRedisStore(NewRedisClient(s.Addr(), "")), keyring)
+
+	err = store.WriteUser(context.TODO(), User{
+		ID:           "id123",
+		Username:     "halkeye",
+		AccessToken:  "access123",
+		RefreshToken: "refresh123",
+		Updated:      time.Date(2019, 02, 25, 0, 0, 0, 0, time.UTC),
+	})
+	require.NoError(t, err)
+
+	assert.Equal(t, "k1", s.HGet("goplaxt:user:id123", "key"))
+	assert.NotContains(t, s.HGet("goplaxt:user:id123", "access"), "access123")
+	assert.NotContains(t, s.HGet("goplaxt:user:id123", "refresh"), "refresh123")
+
+	user, err := store.GetUser(context.TODO(), "id123")
+	require.NoError(t, err)
+	assert.Equal(t, "access123", user.AccessToken)
+	assert.Equal(t, "refresh123", user.RefreshToken)
+}
+
+func TestEncryptedStoreMigratesPlaintext(t *testing.T) {
+	s, err := miniredis.Run()
+	require.NoError(t, err)
+	defer s.Close()
+
+	s.HSet("goplaxt:user:id123", "username", "halkeye")
+	s.HSet("goplaxt:user:id123", "access", "access123")
+	s.HSet("goplaxt:user:id123", "refresh", "refresh123")
+	s.HSet("goplaxt:user:id123", "updated", "02-25-2019")
+
+	keyring, err := NewKeyring("k1", map[string][]byte{"k1": testKey(1)})
+	require.NoError(t, err)
+	store := NewEncryptedStore(NewRedisStore(NewRedisClient(s.Addr(), "")), keyring)
+
+	user, err := store.GetUser(context.TODO(), "id123")
+	require.NoError(t, err)
+	assert.Equal(t, "access123", user.AccessToken)
+	assert.Equal(t, "k1", s.HGet("goplaxt:user:id123", "key"))
+	assert.NotEqual(t, "access123", s.HGet("goplaxt:user:id123", "access"))
+	assert.Equal(t, "0", s.HGet("goplaxt:user:id123", "version"))
+
+	user, err = store.GetUser(context.TODO(), "id123")
+	require.NoError(t, err)
+	assert.Equal(t, "access123", user.AccessToken)
+}
+
+func TestEncryptedStoreLeavesClaimedPlaintext(t *testing.T) {
+	s, err := miniredis.Run()
+	require.NoError(t, err)
+	defer s.Close()
+
+	s.HSet("goplaxt:user:id123", "username", "halkeye")
+	s.HSet("goplaxt:user:id123", "access", "access123")
+	s.HSet("goplaxt:user:id123", "refresh", "refresh123")
+	s.HSet("goplaxt:user:id123", "updated", "02-25-2019")
+	s.HSet("goplaxt:user:id123", "version", "3")
+
+	keyring, err := NewKeyring("k1", map[string][]byte{"k1": testKey(1)})
+	require.NoError(t, err)
+	store := NewEncryptedStore(NewRedisStore(NewRedisClient(s.Addr(), "")), keyring)
+
+	user, err := store.GetUser(context.TODO(), "id123")
+	require.NoError(t, err)
+	assert.Equal(t, "access123", user.AccessToken)
+	assert.Equal(t, "access123", s.HGet("goplaxt:user:id123", "access"), "a refresh in flight owns the user")
+
+	written, err := store.Reencrypt(context.TODO(), 10)
+	require.NoError(t, err)
+	assert.Equal(t, 0, written)
+	assert.Equal(t, "access123", s.HGet("goplaxt:user:id123", "access"))
+}
+
+func TestEncryptedStoreReencryptsPlaintext(t *testing.T) {
+	s, err := miniredis.Run()
+	require.NoError(t, err)
+	defer s.Close()
+
+	s.HSet("goplaxt:user:id123", "username", "halkeye")
+	s.HSet("goplaxt:user:id123", "access", "access123")
+	s.HSet("goplaxt:user:id123", "refresh", "refresh123")
+	s.HSet("goplaxt:user:id123", "updated", "02-25-2019")
+
+	keyring, err := NewKeyring("k1", map[string][]byte{"k1": testKey(1)})
+	require.NoError(t, err)
+	store := NewEncryptedStore(NewRedisStore(NewRedisClient(s.Addr(), "")), keyring)
+
+	written, err := store.Reencrypt(context.TODO(), 10)
+	require.NoError(t, err)
+	assert.Equal(t, 1, written)
+	assert.Equal(t, "k1", s.HGet("goplaxt:user:id123", "key"))
+	assert.NotEqual(t, "access123", s.HGet("goplaxt:user:id123", "access"))
+
+	user, err := store.GetUser(context.TODO(), "id123")
+	require.NoError(t, err)
+	assert.Equal(t, "access123", user.AccessToken)
+	written, err = store.Reencrypt(context.TODO(), 10)
+	require.NoError(t, err)
+	assert.Equal(t, 0, written)
+}
+
+func TestEncryptedStoreKeyRotation(t *testing.T) {
+	s, err := miniredis.Run()
+	require.NoError(t, err)
+	defer s.Close()
+
+	backend := NewRedisStore(NewRedisClient(s.Addr(), ""))
+	oldKeyring, err := NewKeyring("old", map[string][]byte{"old": testKey(1)})
+	require.NoError(t, err)
+	require.NoError(t, NewEncryptedStore(backend, oldKeyring).WriteUser(context.TODO(), User{
+		ID:           "id123",
+		Username:     "halkeye",
+		AccessToken:  "access123",
+		RefreshToken: "refresh123",
+	}))
+
+	rotated, err := NewKeyring("new", map[string][]byte{"new": testKey(2), "old": testKey(1)})
+	require.NoError(t, err)
+	store := NewEncryptedStore(backend, rotated)
+
+	user, err := store.GetUser(context.TODO(), "id123")
+	require.NoError(t, err)
+	assert.Equal(t, "refresh123", user.RefreshToken)
+	assert.Equal(t, "old", s.HGet("goplaxt:user:id123", "key"))
+
+	written, err := store.Reencrypt(context.TODO(), 10)
+	require.NoError(t, err)
+	assert.Equal(t, 1, written)
+	assert.Equal(t, "new", s.HGet("goplaxt:user:id123", "key"))
+
+	swapped := *user
+	swapped.AccessToken, swapped.RefreshToken, swapped.Version = "access456", "refresh456", user.Version+2
+	require.NoError(t, store.CompareAndSwapUser(context.TODO(), user.Version, swapped))
+
+	user, err = store.GetUser(context.TODO(), "id123")
+	require.NoError(t, err)
+	assert.Equal(t, "access456", user.AccessToken)
+
+	missing, err := NewKeyring("other", map[string][]byte{"other": testKey(3)})
+	require.NoError(t, err)
+	_, err = NewEncryptedStore(backend, missing).GetUser(context.TODO(), "id123")
+	assert.Error(t, err)
+}
+
+func TestSealedValuesAreBoundToTheirRecord(t *testing.T) {
+	keyring, err := NewKeyring("k1", map[string][]byte{"k1": testKey(1)})
+	require.NoError(t, err)
+
+	sealed, err := keyring.seal("id123", "access", "access123")
+	require.NoError(t, err)
+
+	opened, err := keyring.open("k1", "id123", "access", sealed)
+	require.NoError(t, err)
+	assert.Equal(t, "access123", opened)
+
+	_, err = keyring.open("k1", "id456", "access", sealed)
+	assert.Error(t, err)
+	_, err = keyring.open("k1", "id123", "refresh", sealed)
+	assert.Error(t, err)
+}
@@ -6,11 +6,19 @@ import (
 
 // Store is the interface for All the store types
 type Store interface {
-	WriteUser(user User) error
-	GetUser(id string) (*User, error)
-	DeleteUser(id string) bool
+	// WriteUser creates or replaces user, a stored user keeps its version so
+	// a compare and swap in flight still finds out it was written meanwhile
+	WriteUser(ctx context.Context, user User) error
+	// CompareAndSwapUser writes user only while the stored user is still at
+	// version, failing with a trace.CompareFailed error once someone else got
+	// there first. user.Version is written as is, callers bump it themselves
+	CompareAndSwapUser(ctx context.Context, version int64, user User) error
+	// GetUser fails with a trace.NotFound error for unknown ids
+	GetUser(ctx context.Context, id string) (*User, error)
+	DeleteUser(ctx context.Context, id string) (bool, error)
+	// ListUsers returns up to limit users following cursor, and the cursor of
+	// the next page which is empty once every user has been returned
+	ListUsers(ctx context.Context, cursor string, limit int) ([]*User, string, error)
+	CountUsers(ctx context.Context) (int, error)
 	Ping(ctx context.Context) error
 }
-
-// Utils
-func flatTransform(s string) []string { return []string{} }
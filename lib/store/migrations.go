@@ -0,0 +1,267 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/gravitational/trace"
+)
+
+// postgresqlMigrationLock is the advisory lock key held while migrating,
+// so replicas booting at the same time apply each migration only once
+const postgresqlMigrationLock = 0x676f706c617874
+
+// migration is a single, ordered schema change
+type migration struct {
+	version int
+	name    string
+	up      string
+}
+
+// postgresqlMigrations must only ever be appended to, released versions are never edited
+var postgresqlMigrations = []migration{
+	{
+		version: 1,
+		name:    "create users",
+		up: `
+			CREATE TABLE IF NOT EXISTS users (
+				id varchar(255) NOT NULL,
+				username varchar(255) NOT NULL,
+				access varchar(255) NOT NULL,
+				refresh varchar(255) NOT NULL,
+				updated timestamp with time zone NOT NULL,
+				PRIMARY KEY(id)
+			)
+		`,
+	},
+	{
+		version: 2,
+		name:    "encrypted tokens",
+		up: `
+			ALTER TABLE users
+				ALTER COLUMN access TYPE text,
+				ALTER COLUMN refresh TYPE text,
+				ADD COLUMN key_id varchar(255) NOT NULL DEFAULT ''
+		`,
+	},
+	{
+		version: 3,
+		name:    "token expiry",
+		up: `
+			ALTER TABLE users
+				ADD COLUMN expires_at timestamp with time zone NULL,
+				ADD COLUMN scope varchar(255) NOT NULL DEFAULT ''
+		`,
+	},
+	{
+		version: 4,
+		name:    "user version",
+		up:      `ALTER TABLE users ADD COLUMN version bigint NOT NULL DEFAULT 0`,
+	},
+	{
+		version: 5,
+		name:    "scrobble jobs",
+		up: `
+			CREATE TABLE IF NOT EXISTS scrobble_jobs (
+				id varchar(255) NOT NULL,
+				user_id varchar(255) NOT NULL,
+				root text NOT NULL,
+				payload text NOT NULL,
+				received_at timestamp with time zone NOT NULL,
+				run_at timestamp with time zone NOT NULL,
+				attempts integer NOT NULL DEFAULT 0,
+				last_error text NOT NULL DEFAULT '',
+				dead boolean NOT NULL DEFAULT false,
+				claim varchar(255) NOT NULL DEFAULT '',
+				PRIMARY KEY(id)
+			);
+			CREATE INDEX IF NOT EXISTS scrobble_jobs_due ON scrobble_jobs (dead, run_at)
+		`,
+	},
+	{
+		version: 6,
+		name:    "scrobble settings",
+		up:      `ALTER TABLE scrobble_jobs ADD COLUMN settings text NOT NULL DEFAULT ''`,
+	},
+}
+
+// sqliteMigrations mirror postgresqlMigrations version for version, so both
+// backends always share the same schema
+var sqliteMigrations = []migration{
+	{
+		version: 1,
+		name:    "create users",
+		up: `
+			CREATE TABLE IF NOT EXISTS users (
+				id varchar(255) NOT NULL,
+				username varchar(255) NOT NULL,
+				access text NOT NULL,
+				refresh text NOT NULL,
+				updated timestamp NOT NULL,
+				PRIMARY KEY(id)
+			)
+		`,
+	},
+	{
+		version: 2,
+		name:    "encrypted tokens",
+		up:      `ALTER TABLE users ADD COLUMN key_id varchar(255) NOT NULL DEFAULT ''`,
+	},
+	{
+		version: 3,
+		name:    "token expiry",
+		up: `
+			ALTER TABLE users ADD COLUMN expires_at timestamp NULL;
+			ALTER TABLE users ADD COLUMN scope varchar(255) NOT NULL DEFAULT ''
+		`,
+	},
+	{
+		version: 4,
+		name:    "user version",
+		up:      `ALTER TABLE users ADD COLUMN version integer NOT NULL DEFAULT 0`,
+	},
+	{
+		version: 5,
+		name:    "scrobble jobs",
+		up: `
+			CREATE TABLE IF NOT EXISTS scrobble_jobs (
+				id varchar(255) NOT NULL,
+				user_id varchar(255) NOT NULL,
+				root text NOT NULL,
+				payload text NOT NULL,
+				received_at timestamp NOT NULL,
+				run_at timestamp NOT NULL,
+				attempts integer NOT NULL DEFAULT 0,
+				last_error text NOT NULL DEFAULT '',
+				dead boolean NOT NULL DEFAULT false,
+				claim varchar(255) NOT NULL DEFAULT '',
+				PRIMARY KEY(id)
+			);
+			CREATE INDEX IF NOT EXISTS scrobble_jobs_due ON scrobble_jobs (dead, run_at)
+		`,
+	},
+	{
+		version: 6,
+		name:    "scrobble settings",
+		up:      `ALTER TABLE scrobble_jobs ADD COLUMN settings text NOT NULL DEFAULT ''`,
+	},
+}
+
+// MigratePostgresql applies every pending migration in order and returns the versions it applied
+func MigratePostgresql(ctx context.Context, db *sql.DB) ([]int, error) {
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	defer conn.Close()
+
+	// The advisory lock belongs to the session, so lock and unlock share the connection
+	if _, err := conn.ExecContext(ctx, "SELECT pg_advisory_lock($1)", postgresqlMigrationLock); err != nil {
+		return nil, trace.Errorf("failed to take migration lock: %v", err)
+	}
+	defer conn.ExecContext(context.Background(), "SELECT pg_advisory_unlock($1)", postgresqlMigrationLock)
+
+	return runMigrations(ctx, conn, postgresqlMigrations, `
+		CREATE TABLE IF NOT EXISTS schema_migrations (
+			version integer NOT NULL,
+			name varchar(255) NOT NULL,
+			applied timestamp with time zone NOT NULL DEFAULT now(),
+			PRIMARY KEY(version)
+		)
+	`, applyMigration)
+}
+
+// MigrateSQLite applies every pending migration in order and returns the versions it applied
+func MigrateSQLite(ctx context.Context, db *sql.DB) ([]int, error) {
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	defer conn.Close()
+
+	// sqlite has no advisory locks, taking the write lock before reading the
+	// version keeps a racing process waiting until the run is committed
+	if _, err := conn.ExecContext(ctx, "BEGIN IMMEDIATE"); err != nil {
+		return nil, trace.Errorf("failed to take migration lock: %v", err)
+	}
+	applied, err := runMigrations(ctx, conn, sqliteMigrations, `
+		CREATE TABLE IF NOT EXISTS schema_migrations (
+			version integer NOT NULL,
+			name varchar(255) NOT NULL,
+			applied timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+			PRIMARY KEY(version)
+		)
+	`, func(ctx context.Context, conn *sql.Conn, m migration) error {
+		// sqlite runs schema changes in transactions too, the one above covers them all
+		return recordMigration(ctx, conn, m)
+	})
+	if err != nil {
+		conn.ExecContext(context.Background(), "ROLLBACK")
+		return nil, trace.Wrap(err)
+	}
+	if _, err := conn.ExecContext(ctx, "COMMIT"); err != nil {
+		return nil, trace.Wrap(err)
+	}
+	return applied, nil
+}
+
+// execer runs statements on a connection or in a transaction
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}
+
+func runMigrations(ctx context.Context, conn *sql.Conn, migrations []migration, table string, apply func(context.Context, *sql.Conn, migration) error) ([]int, error) {
+	if _, err := conn.ExecContext(ctx, table); err != nil {
+		return nil, trace.Errorf("failed to create schema_migrations: %v", err)
+	}
+
+	current, err := currentVersion(ctx, conn)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	var applied []int
+	for _, m := range migrations {
+		if m.version <= current {
+			continue
+		}
+		if err := apply(ctx, conn, m); err != nil {
+			return applied, trace.Wrap(err)
+		}
+		applied = append(applied, m.version)
+	}
+	return applied, nil
+}
+
+func currentVersion(ctx context.Context, conn *sql.Conn) (int, error) {
+	var version sql.NullInt64
+	err := conn.QueryRowContext(ctx, "SELECT max(version) FROM schema_migrations").Scan(&version)
+	if err != nil {
+		return 0, trace.Errorf("failed to read schema version: %v", err)
+	}
+	return int(version.Int64), nil
+}
+
+// applyMigration applies m in a transaction of its own
+func applyMigration(ctx context.Context, conn *sql.Conn, m migration) error {
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	if err := recordMigration(ctx, tx, m); err != nil {
+		tx.Rollback()
+		return trace.Wrap(err)
+	}
+	return trace.Wrap(tx.Commit())
+}
+
+// recordMigration applies m and records it in the transaction db is in
+func recordMigration(ctx context.Context, db execer, m migration) error {
+	if _, err := db.ExecContext(ctx, m.up); err != nil {
+		return trace.Errorf("migration %d (%s) failed: %v", m.version, m.name, err)
+	}
+	if _, err := db.ExecContext(ctx, "INSERT INTO schema_migrations (version, name) VALUES ($1, $2)", m.version, m.name); err != nil {
+		return trace.Errorf("failed to record migration %d: %v", m.version, err)
+	}
+	return nil
+}
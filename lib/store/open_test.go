@@ -0,0 +1,26 @@
+package store
+
+import (
+	"context"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/gravitational/trace"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOpenRedisDatabase(t *testing.T) {
+	s, err := miniredis.Run()
+	require.NoError(t, err)
+	defer s.Close()
+
+	store, err := Open(context.TODO(), "redis://"+s.Addr()+"/2")
+	require.NoError(t, err)
+	require.NoError(t, store.WriteUser(context.TODO(), User{ID: "id123", Username: "halkeye"}))
+	assert.Equal(t, "halkeye", s.DB(2).HGet("goplaxt:user:id123", "username"))
+	assert.False(t, s.Exists("goplaxt:user:id123"), "the user should not be in the default database")
+
+	_, err = Open(context.TODO(), "redis://"+s.Addr()+"/two")
+	assert.True(t, trace.IsBadParameter(err), "expected a bad parameter error, got %v", err)
+}
@@ -1,7 +1,9 @@
 package store
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"testing"
 	"time"
 
@@ -17,16 +19,21 @@ func TestPostgresqlLoadingUser(t *testing.T) {
 	defer db.Close()
 
 	mock.ExpectQuery(
-		"SELECT username, access, refresh, updated FROM users WHERE id=.*",
+		"SELECT id, username, access, refresh, updated, key_id, expires_at, scope, version FROM users WHERE id=.*",
 	).WithArgs(
 		"id123",
 	).WillReturnRows(
-		sqlmock.NewRows([]string{"username", "access", "refresh", "updated"}).
+		sqlmock.NewRows([]string{"id", "username", "access", "refresh", "updated", "key_id", "expires_at", "scope", "version"}).
 			AddRow(
+				"id123",
 				"halkeye",
 				"access123",
 				"refresh123",
 				time.Date(2019, 02, 25, 0, 0, 0, 0, time.UTC),
+				"",
+				time.Date(2019, 05, 26, 0, 0, 0, 0, time.UTC),
+				"public",
+				0,
 			),
 	)
 
@@ -37,9 +44,11 @@ func TestPostgresqlLoadingUser(t *testing.T) {
 		Username:     "halkeye",
 		AccessToken:  "access123",
 		RefreshToken: "refresh123",
+		Scope:        "public",
+		ExpiresAt:    time.Date(2019, 05, 26, 0, 0, 0, 0, time.UTC),
 		Updated:      time.Date(2019, 02, 25, 0, 0, 0, 0, time.UTC),
 	})
-	user, _ := store.GetUser("id123")
+	user, _ := store.GetUser(context.TODO(), "id123")
 	actual, _ := json.Marshal(user)
 
 	assert.EqualValues(t, string(expected), string(actual))
@@ -54,12 +63,17 @@ func TestPostgresqlSavingUser(t *testing.T) {
 
 	mock.ExpectExec("INSERT INTO ").WillReturnResult(sqlmock.NewResult(1, 1))
 	mock.ExpectQuery("SELECT").WithArgs("id123").WillReturnRows(
-		sqlmock.NewRows([]string{"username", "access", "refresh", "updated"}).
+		sqlmock.NewRows([]string{"id", "username", "access", "refresh", "updated", "key_id", "expires_at", "scope", "version"}).
 			AddRow(
+				"id123",
 				"halkeye",
 				"access123",
 				"refresh123",
 				time.Date(2019, 02, 25, 0, 0, 0, 0, time.UTC),
+				"",
+				time.Date(2019, 05, 26, 0, 0, 0, 0, time.UTC),
+				"public",
+				0,
 			),
 	)
 
@@ -69,15 +83,87 @@ func TestPostgresqlSavingUser(t *testing.T) {
 		Username:     "halkeye",
 		AccessToken:  "access123",
 		RefreshToken: "refresh123",
+		Scope:        "public",
+		ExpiresAt:    time.Date(2019, 05, 26, 0, 0, 0, 0, time.UTC),
 		Updated:      time.Date(2019, 02, 25, 0, 0, 0, 0, time.UTC),
 		store:        store,
 	}
 
-	originalUser.save()
+	originalUser.save(context.TODO())
 
 	expected, err := json.Marshal(originalUser)
-	user, _ := store.GetUser("id123")
+	user, _ := store.GetUser(context.TODO(), "id123")
 	actual, err := json.Marshal(user)
 
 	assert.EqualValues(t, string(expected), string(actual))
 }
+
+func TestPostgresqlDeletingUser(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	mock.ExpectExec("DELETE FROM users WHERE id=.*").WithArgs("id123").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("DELETE FROM users WHERE id=.*").WithArgs("id123").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("DELETE FROM users WHERE id=.*").WithArgs("id123").WillReturnError(errors.New("connection lost"))
+
+	store := NewPostgresqlStore(db)
+
+	deleted, err := store.DeleteUser(context.TODO(), "id123")
+	assert.NoError(t, err)
+	assert.True(t, deleted)
+
+	deleted, err = store.DeleteUser(context.TODO(), "id123")
+	assert.NoError(t, err)
+	assert.False(t, deleted)
+
+	deleted, err = store.DeleteUser(context.TODO(), "id123")
+	assert.Error(t, err)
+	assert.False(t, deleted)
+
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestPostgresqlListingUsers(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+	defer db.Close()
+
+	updated := time.Date(2019, 02, 25, 0, 0, 0, 0, time.UTC)
+	columns := []string{"id", "username", "access", "refresh", "updated", "key_id", "expires_at", "scope", "version"}
+	mock.ExpectQuery("SELECT id, username, access, refresh, updated, key_id, expires_at, scope, version FROM users WHERE id > .* ORDER BY id LIMIT .*").
+		WithArgs("", 2).
+		WillReturnRows(sqlmock.NewRows(columns).
+			AddRow("id1", "Halkeye", "access1", "refresh1", updated, "", nil, "", 0).
+			AddRow("id2", "halkeye", "access2", "refresh2", updated, "", nil, "", 0))
+	mock.ExpectQuery("SELECT id, username, access, refresh, updated, key_id, expires_at, scope, version FROM users WHERE id > .* ORDER BY id LIMIT .*").
+		WithArgs("id2", 2).
+		WillReturnRows(sqlmock.NewRows(columns).
+			AddRow("id3", "halkeye", "access3", "refresh3", updated, "", nil, "", 0))
+	mock.ExpectQuery("SELECT count\\(\\*\\) FROM users").
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(3))
+
+	store := NewPostgresqlStore(db)
+
+	users, next, err := store.ListUsers(context.TODO(), "", 2)
+	assert.NoError(t, err)
+	assert.Len(t, users, 2)
+	assert.Equal(t, "halkeye", users[0].Username)
+	assert.Equal(t, "id2", next)
+
+	users, next, err = store.ListUsers(context.TODO(), next, 2)
+	assert.NoError(t, err)
+	assert.Len(t, users, 1)
+	assert.Equal(t, "id3", users[0].ID)
+	assert.Equal(t, "", next)
+
+	count, err := store.CountUsers(context.TODO())
+	assert.NoError(t, err)
+	assert.Equal(t, 3, count)
+
+	assert.NoError(t, mock.ExpectationsWereMet())
+}
@@ -0,0 +1,64 @@
+package store
+
+import (
+	"context"
+	"time"
+)
+
+// Job is a scrobble waiting to be delivered to trakt
+type Job struct {
+	ID     string
+	UserID string
+	// Root is the url the webhook came in on, token refreshes have to send it to trakt again
+	Root string
+	// Payload is the plex webhook as it was received
+	Payload []byte
+	// Settings are the scrobble settings of the webhook link, url encoded
+	Settings   string
+	ReceivedAt time.Time
+	// RunAt is when the job is next due, claiming a job pushes it back by the lease
+	RunAt     time.Time
+	Attempts  int
+	LastError string
+	// Dead jobs ran out of attempts, they are kept around to look at but never run again
+	Dead bool
+	// Claim is the token of the worker the job was last handed out to, every
+	// claim hands out a new one so a worker whose lease ran out can't settle
+	// the job anymore
+	Claim string
+}
+
+// NewJob creates a job for a webhook of user, due right away. receivedAt is
+// truncated to what every storage keeps, postgres only has microseconds, so
+// the job reads back with the time it was created with.
+func NewJob(userID, root string, payload []byte, receivedAt time.Time) Job {
+	receivedAt = receivedAt.Truncate(time.Microsecond)
+	return Job{
+		ID:         uuid(),
+		UserID:     userID,
+		Root:       root,
+		Payload:    payload,
+		ReceivedAt: receivedAt,
+		RunAt:      receivedAt,
+	}
+}
+
+// Queue holds the scrobbles waiting for trakt, every replica sharing the
+// storage takes jobs from it
+type Queue interface {
+	Enqueue(ctx context.Context, job Job) error
+	// Claim hands out the job that has been due the longest at now, hiding it
+	// from every other worker until lease passes, so jobs of a worker that died
+	// come back on their own. It fails with a trace.NotFound error when no job is due
+	Claim(ctx context.Context, now time.Time, lease time.Duration) (*Job, error)
+	// Release writes a claimed job back with the RunAt, Attempts, LastError and
+	// Dead the worker set. It fails with a trace.CompareFailed error when the
+	// job was claimed again since
+	Release(ctx context.Context, job Job) error
+	// Complete removes a delivered job, failing like Release when it was claimed again since
+	Complete(ctx context.Context, job Job) error
+	// DeadJobs returns up to limit jobs that ran out of attempts, oldest first
+	DeadJobs(ctx context.Context, limit int) ([]*Job, error)
+	// PurgeDead removes the dead jobs received before before, returning how many
+	PurgeDead(ctx context.Context, before time.Time) (int, error)
+}
@@ -2,12 +2,17 @@ package store
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/go-redis/redis"
 	"github.com/gravitational/trace"
+	"go.opentelemetry.io/otel/attribute"
+	semconv "go.opentelemetry.io/otel/semconv/v1.4.0"
+	oteltrace "go.opentelemetry.io/otel/trace"
 )
 
 // RedisStore is a storage engine that writes to redis
@@ -38,48 +43,565 @@ func NewRedisStore(client redis.Client) RedisStore {
 	}
 }
 
+// clientFor returns the redis client bound to ctx, go-redis v6 never looks at
+// the context while talking to the server so expired contexts are refused here
+func (s RedisStore) clientFor(ctx context.Context) (*redis.Client, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, trace.Wrap(err)
+	}
+	return s.client.WithContext(ctx), nil
+}
+
+func (s RedisStore) startSpan(ctx context.Context, name, key string) (context.Context, oteltrace.Span) {
+	return startSpan(
+		ctx,
+		"redis."+name,
+		semconv.DBSystemRedis,
+		semconv.DBRedisDBIndexKey.Int(s.client.Options().DB),
+		attribute.String("db.redis.key", key),
+	)
+}
+
 // Ping will check if the connection works right
-func (s RedisStore) Ping(ctx context.Context) error {
-	_, err := s.client.WithContext(ctx).Ping().Result()
+func (s RedisStore) Ping(ctx context.Context) (err error) {
+	ctx, span := s.startSpan(ctx, "Ping", "")
+	defer func() { endSpan(span, err) }()
+
+	client, err := s.clientFor(ctx)
+	if err != nil {
+		return err
+	}
+	_, err = client.Ping().Result()
 	return err
 }
 
 // WriteUser will write a user object to redis
-func (s RedisStore) WriteUser(user User) error {
+func (s RedisStore) WriteUser(ctx context.Context, user User) (err error) {
+	key := fmt.Sprintf("goplaxt:user:%s", user.ID)
+	ctx, span := s.startSpan(ctx, "WriteUser", key)
+	defer func() { endSpan(span, err) }()
+
+	client, err := s.clientFor(ctx)
+	if err != nil {
+		return err
+	}
+	fields := userHash(user)
+	delete(fields, "version")
+	_, err = client.TxPipelined(func(pipe redis.Pipeliner) error {
+		pipe.HMSet(key, fields)
+		// Only a new user takes the version it was given
+		pipe.HSetNX(key, "version", user.Version)
+		return nil
+	})
+	return trace.Wrap(err)
+}
+
+// CompareAndSwapUser will watch the user hash so the write is dropped if anyone touches it meanwhile
+func (s RedisStore) CompareAndSwapUser(ctx context.Context, version int64, user User) (err error) {
+	key := fmt.Sprintf("goplaxt:user:%s", user.ID)
+	ctx, span := s.startSpan(ctx, "CompareAndSwapUser", key)
+	defer func() { endSpan(span, err) }()
+
+	client, err := s.clientFor(ctx)
+	if err != nil {
+		return err
+	}
+	err = client.Watch(func(tx *redis.Tx) error {
+		data, err := tx.HGetAll(key).Result()
+		if err != nil {
+			return trace.Wrap(err)
+		}
+		if len(data) == 0 {
+			return trace.NotFound("no user with id %s", user.ID)
+		}
+		if stored, _ := strconv.ParseInt(data["version"], 10, 64); stored != version {
+			return trace.CompareFailed("user %s is no longer at version %d", user.ID, version)
+		}
+		_, err = tx.Pipelined(func(pipe redis.Pipeliner) error {
+			return pipe.HMSet(key, userHash(user)).Err()
+		})
+		return err
+	}, key)
+	if err == redis.TxFailedErr {
+		return trace.CompareFailed("user %s changed while swapping it", user.ID)
+	}
+	return trace.Wrap(err)
+}
+
+// userHash is how a user is kept in its redis hash
+func userHash(user User) map[string]interface{} {
 	data := make(map[string]interface{})
 	data["username"] = user.Username
 	data["access"] = user.AccessToken
 	data["refresh"] = user.RefreshToken
-	data["updated"] = user.Updated.Format("01-02-2006")
-	status := s.client.HMSet(fmt.Sprintf("goplaxt:user:%s", user.ID), data)
-	return trace.Wrap(status.Err())
+	data["updated"] = user.Updated.Format(time.RFC3339Nano)
+	data["key"] = user.keyID
+	data["scope"] = user.Scope
+	data["expires"] = ""
+	if !user.ExpiresAt.IsZero() {
+		data["expires"] = user.ExpiresAt.Format(time.RFC3339Nano)
+	}
+	data["version"] = user.Version
+	return data
 }
 
 // GetUser will load a user from redis
-func (s RedisStore) GetUser(id string) (*User, error) {
-	data, err := s.client.HGetAll("goplaxt:user:" + id).Result()
-	// FIXME - return err
+func (s RedisStore) GetUser(ctx context.Context, id string) (_ *User, err error) {
+	key := "goplaxt:user:" + id
+	ctx, span := s.startSpan(ctx, "GetUser", key)
+	defer func() { endSpan(span, err) }()
+
+	client, err := s.clientFor(ctx)
+	if err != nil {
+		return nil, err
+	}
+	data, err := client.HGetAll(key).Result()
 	if err != nil {
 		return nil, trace.Wrap(err)
 	}
-	updated, err := time.Parse("01-02-2006", data["updated"])
-	// FIXME - return err
+	if len(data) == 0 {
+		return nil, trace.NotFound("no user with id %s", id)
+	}
+	return s.userFromHash(id, data)
+}
+
+func (s RedisStore) userFromHash(id string, data map[string]string) (*User, error) {
+	updated, err := time.Parse(time.RFC3339Nano, data["updated"])
+	if err != nil {
+		// Users written before full timestamps were kept only have the day
+		updated, err = time.Parse("01-02-2006", data["updated"])
+	}
 	if err != nil {
 		return nil, trace.Wrap(err)
 	}
+	var version int64
+	if data["version"] != "" {
+		if version, err = strconv.ParseInt(data["version"], 10, 64); err != nil {
+			return nil, trace.Wrap(err)
+		}
+	}
+	var expiresAt time.Time
+	if data["expires"] != "" {
+		if expiresAt, err = time.Parse(time.RFC3339Nano, data["expires"]); err != nil {
+			return nil, trace.Wrap(err)
+		}
+	}
 	user := User{
 		ID:           id,
 		Username:     strings.ToLower(data["username"]),
 		AccessToken:  data["access"],
 		RefreshToken: data["refresh"],
+		Scope:        data["scope"],
+		ExpiresAt:    expiresAt,
 		Updated:      updated,
+		Version:      version,
 		store:        s,
+		keyID:        data["key"],
 	}
 
 	return &user, nil
 }
 
-// TODO: Not Implemented
-func (s RedisStore) DeleteUser(id string) bool {
-	return true
+// DeleteUser will remove a user from redis, reporting whether it existed
+func (s RedisStore) DeleteUser(ctx context.Context, id string) (_ bool, err error) {
+	key := "goplaxt:user:" + id
+	ctx, span := s.startSpan(ctx, "DeleteUser", key)
+	defer func() { endSpan(span, err) }()
+
+	client, err := s.clientFor(ctx)
+	if err != nil {
+		return false, err
+	}
+	deleted, err := client.Del(key).Result()
+	if err != nil {
+		return false, trace.Wrap(err)
+	}
+	return deleted > 0, nil
+}
+
+// ListUsers will scan redis for users, the cursor is the redis SCAN cursor so
+// pages are only roughly limit sized and come in no particular order
+func (s RedisStore) ListUsers(ctx context.Context, cursor string, limit int) (_ []*User, _ string, err error) {
+	ctx, span := s.startSpan(ctx, "ListUsers", "goplaxt:user:*")
+	defer func() { endSpan(span, err) }()
+
+	if limit <= 0 {
+		return nil, "", trace.BadParameter("limit must be positive")
+	}
+	var position uint64
+	if cursor != "" {
+		position, err = strconv.ParseUint(cursor, 10, 64)
+		if err != nil {
+			return nil, "", trace.BadParameter("invalid cursor %q", cursor)
+		}
+	}
+	client, err := s.clientFor(ctx)
+	if err != nil {
+		return nil, "", err
+	}
+	keys, next, err := client.Scan(position, "goplaxt:user:*", int64(limit)).Result()
+	if err != nil {
+		return nil, "", trace.Wrap(err)
+	}
+
+	pipe := client.Pipeline()
+	commands := make([]*redis.StringStringMapCmd, len(keys))
+	for i, key := range keys {
+		commands[i] = pipe.HGetAll(key)
+	}
+	if len(keys) > 0 {
+		if _, err := pipe.Exec(); err != nil {
+			return nil, "", trace.Wrap(err)
+		}
+	}
+
+	users := make([]*User, 0, len(keys))
+	for i, key := range keys {
+		data, err := commands[i].Result()
+		if err != nil {
+			return nil, "", trace.Wrap(err)
+		}
+		// The key may have been deleted between the scan and the read
+		if len(data) == 0 {
+			continue
+		}
+		user, err := s.userFromHash(strings.TrimPrefix(key, "goplaxt:user:"), data)
+		if err != nil {
+			return nil, "", trace.Wrap(err)
+		}
+		users = append(users, user)
+	}
+
+	if next == 0 {
+		return users, "", nil
+	}
+	return users, strconv.FormatUint(next, 10), nil
+}
+
+// CountUsers will scan the whole keyspace counting users
+func (s RedisStore) CountUsers(ctx context.Context) (_ int, err error) {
+	ctx, span := s.startSpan(ctx, "CountUsers", "goplaxt:user:*")
+	defer func() { endSpan(span, err) }()
+
+	count := 0
+	var position uint64
+	for {
+		client, err := s.clientFor(ctx)
+		if err != nil {
+			return 0, err
+		}
+		keys, next, err := client.Scan(position, "goplaxt:user:*", 1000).Result()
+		if err != nil {
+			return 0, trace.Wrap(err)
+		}
+		count += len(keys)
+		if next == 0 {
+			return count, nil
+		}
+		position = next
+	}
+}
+
+// Scrobble jobs are kept in a hash each, with their ids in a sorted set of
+// pending jobs scored by when they are due and one of dead jobs scored by when
+// they came in
+const (
+	pendingJobsKey = "goplaxt:jobs:pending"
+	deadJobsKey    = "goplaxt:jobs:dead"
+)
+
+func jobKey(id string) string {
+	return "goplaxt:job:" + id
+}
+
+// jobScore is a time as a sorted set score, milliseconds fit a float exactly
+func jobScore(t time.Time) float64 {
+	return float64(t.UnixNano() / int64(time.Millisecond))
+}
+
+// jobHash is how a job is kept in its redis hash
+func jobHash(job Job) map[string]interface{} {
+	return map[string]interface{}{
+		"user":       job.UserID,
+		"root":       job.Root,
+		"payload":    string(job.Payload),
+		"settings":   job.Settings,
+		"received":   job.ReceivedAt.Format(time.RFC3339Nano),
+		"run_at":     job.RunAt.Format(time.RFC3339Nano),
+		"attempts":   job.Attempts,
+		"last_error": job.LastError,
+		"dead":       strconv.FormatBool(job.Dead),
+		"claim":      job.Claim,
+	}
+}
+
+func jobFromHash(id string, data map[string]string) (*Job, error) {
+	received, err := time.Parse(time.RFC3339Nano, data["received"])
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	runAt, err := time.Parse(time.RFC3339Nano, data["run_at"])
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	attempts, err := strconv.Atoi(data["attempts"])
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	return &Job{
+		ID:         id,
+		UserID:     data["user"],
+		Root:       data["root"],
+		Payload:    []byte(data["payload"]),
+		Settings:   data["settings"],
+		ReceivedAt: received,
+		RunAt:      runAt,
+		Attempts:   attempts,
+		LastError:  data["last_error"],
+		Dead:       data["dead"] == "true",
+		Claim:      data["claim"],
+	}, nil
+}
+
+// Enqueue will write the job hash and mark it pending in one transaction
+func (s RedisStore) Enqueue(ctx context.Context, job Job) (err error) {
+	key := jobKey(job.ID)
+	ctx, span := s.startSpan(ctx, "Enqueue", key)
+	defer func() { endSpan(span, err) }()
+
+	client, err := s.clientFor(ctx)
+	if err != nil {
+		return err
+	}
+	_, err = client.TxPipelined(func(pipe redis.Pipeliner) error {
+		pipe.HMSet(key, jobHash(job))
+		pipe.ZAdd(pendingJobsKey, redis.Z{Score: jobScore(job.RunAt), Member: job.ID})
+		return nil
+	})
+	return trace.Wrap(err)
+}
+
+// Claim will watch the hash of every due job in turn, so only one worker gets to push it back
+func (s RedisStore) Claim(ctx context.Context, now time.Time, lease time.Duration) (_ *Job, err error) {
+	ctx, span := s.startSpan(ctx, "Claim", pendingJobsKey)
+	defer func() { endSpan(span, err) }()
+
+	client, err := s.clientFor(ctx)
+	if err != nil {
+		return nil, err
+	}
+	ids, err := client.ZRangeByScore(pendingJobsKey, redis.ZRangeBy{
+		Min:   "-inf",
+		Max:   strconv.FormatFloat(jobScore(now), 'f', -1, 64),
+		Count: 10,
+	}).Result()
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	runAt := now.Add(lease)
+	for _, id := range ids {
+		key := jobKey(id)
+		var job *Job
+		err := client.Watch(func(tx *redis.Tx) error {
+			score, err := tx.ZScore(pendingJobsKey, id).Result()
+			if err == redis.Nil || (err == nil && score > jobScore(now)) {
+				// Someone else claimed or finished it since the range was read
+				return nil
+			}
+			if err != nil {
+				return trace.Wrap(err)
+			}
+			data, err := tx.HGetAll(key).Result()
+			if err != nil {
+				return trace.Wrap(err)
+			}
+			if job, err = jobFromHash(id, data); err != nil {
+				return trace.Wrap(err)
+			}
+			job.RunAt = runAt
+			job.Claim = uuid()
+			_, err = tx.Pipelined(func(pipe redis.Pipeliner) error {
+				pipe.HMSet(key, map[string]interface{}{
+					"run_at": runAt.Format(time.RFC3339Nano),
+					"claim":  job.Claim,
+				})
+				pipe.ZAdd(pendingJobsKey, redis.Z{Score: jobScore(runAt), Member: id})
+				return nil
+			})
+			return err
+		}, key)
+		switch {
+		case err == redis.TxFailedErr:
+			continue
+		case err != nil:
+			return nil, trace.Wrap(err)
+		case job != nil:
+			return job, nil
+		}
+	}
+	return nil, trace.NotFound("no scrobble job is due")
+}
+
+// Release will write the job hash back, moving it to the dead jobs once it is dead
+func (s RedisStore) Release(ctx context.Context, job Job) (err error) {
+	key := jobKey(job.ID)
+	ctx, span := s.startSpan(ctx, "Release", key)
+	defer func() { endSpan(span, err) }()
+
+	return s.settleJob(ctx, job, func(pipe redis.Pipeliner) {
+		pipe.HMSet(key, jobHash(job))
+		if job.Dead {
+			pipe.ZRem(pendingJobsKey, job.ID)
+			pipe.ZAdd(deadJobsKey, redis.Z{Score: jobScore(job.ReceivedAt), Member: job.ID})
+		} else {
+			pipe.ZAdd(pendingJobsKey, redis.Z{Score: jobScore(job.RunAt), Member: job.ID})
+		}
+	})
+}
+
+// Complete will remove the job hash and its id from both sets
+func (s RedisStore) Complete(ctx context.Context, job Job) (err error) {
+	key := jobKey(job.ID)
+	ctx, span := s.startSpan(ctx, "Complete", key)
+	defer func() { endSpan(span, err) }()
+
+	return s.settleJob(ctx, job, func(pipe redis.Pipeliner) {
+		pipe.Del(key)
+		pipe.ZRem(pendingJobsKey, job.ID)
+		pipe.ZRem(deadJobsKey, job.ID)
+	})
+}
+
+// settleJob watches the job hash, running settle in a transaction only while
+// the job still holds the claim of the worker
+func (s RedisStore) settleJob(ctx context.Context, job Job, settle func(redis.Pipeliner)) error {
+	client, err := s.clientFor(ctx)
+	if err != nil {
+		return err
+	}
+	key := jobKey(job.ID)
+	err = client.Watch(func(tx *redis.Tx) error {
+		data, err := tx.HGetAll(key).Result()
+		if err != nil {
+			return trace.Wrap(err)
+		}
+		if len(data) == 0 {
+			return trace.NotFound("no scrobble job with id %s", job.ID)
+		}
+		if data["claim"] != job.Claim {
+			return trace.CompareFailed("scrobble job %s was claimed again", job.ID)
+		}
+		_, err = tx.Pipelined(func(pipe redis.Pipeliner) error {
+			settle(pipe)
+			return nil
+		})
+		return err
+	}, key)
+	if err == redis.TxFailedErr {
+		return trace.CompareFailed("scrobble job %s was claimed again", job.ID)
+	}
+	return trace.Wrap(err)
+}
+
+// DeadJobs will read the oldest dead jobs
+func (s RedisStore) DeadJobs(ctx context.Context, limit int) (_ []*Job, err error) {
+	ctx, span := s.startSpan(ctx, "DeadJobs", deadJobsKey)
+	defer func() { endSpan(span, err) }()
+
+	if limit <= 0 {
+		return nil, trace.BadParameter("limit must be positive")
+	}
+	client, err := s.clientFor(ctx)
+	if err != nil {
+		return nil, err
+	}
+	ids, err := client.ZRange(deadJobsKey, 0, int64(limit-1)).Result()
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	jobs := make([]*Job, 0, len(ids))
+	for _, id := range ids {
+		data, err := client.HGetAll(jobKey(id)).Result()
+		if err != nil {
+			return nil, trace.Wrap(err)
+		}
+		if len(data) == 0 {
+			continue
+		}
+		job, err := jobFromHash(id, data)
+		if err != nil {
+			return nil, trace.Wrap(err)
+		}
+		jobs = append(jobs, job)
+	}
+	return jobs, nil
+}
+
+// UpdateSession will watch the session key so update is retried when another replica changed it meanwhile
+func (s RedisStore) UpdateSession(ctx context.Context, key string, ttl time.Duration, update func(*Session)) (err error) {
+	key = "goplaxt:session:" + key
+	ctx, span := s.startSpan(ctx, "UpdateSession", key)
+	defer func() { endSpan(span, err) }()
+
+	client, err := s.clientFor(ctx)
+	if err != nil {
+		return err
+	}
+	for attempt := 0; attempt < 10; attempt++ {
+		err = client.Watch(func(tx *redis.Tx) error {
+			var session Session
+			data, err := tx.Get(key).Bytes()
+			switch {
+			case err == redis.Nil:
+			case err != nil:
+				return trace.Wrap(err)
+			default:
+				if err := json.Unmarshal(data, &session); err != nil {
+					return trace.Wrap(err)
+				}
+			}
+			update(&session)
+			if data, err = json.Marshal(session); err != nil {
+				return trace.Wrap(err)
+			}
+			_, err = tx.Pipelined(func(pipe redis.Pipeliner) error {
+				return pipe.Set(key, data, ttl).Err()
+			})
+			return err
+		}, key)
+		if err != redis.TxFailedErr {
+			return trace.Wrap(err)
+		}
+	}
+	return trace.CompareFailed("session %s kept changing", key)
+}
+
+// PurgeDead will delete the hashes of the old dead jobs along with their ids
+func (s RedisStore) PurgeDead(ctx context.Context, before time.Time) (_ int, err error) {
+	ctx, span := s.startSpan(ctx, "PurgeDead", deadJobsKey)
+	defer func() { endSpan(span, err) }()
+
+	client, err := s.clientFor(ctx)
+	if err != nil {
+		return 0, err
+	}
+	ids, err := client.ZRangeByScore(deadJobsKey, redis.ZRangeBy{
+		Min: "-inf",
+		Max: "(" + strconv.FormatFloat(jobScore(before), 'f', -1, 64),
+	}).Result()
+	if err != nil || len(ids) == 0 {
+		return 0, trace.Wrap(err)
+	}
+	_, err = client.TxPipelined(func(pipe redis.Pipeliner) error {
+		for _, id := range ids {
+			pipe.Del(jobKey(id))
+			pipe.ZRem(deadJobsKey, id)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, trace.Wrap(err)
+	}
+	return len(ids), nil
 }
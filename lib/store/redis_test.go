@@ -31,7 +31,7 @@ func TestLoadingUser(t *testing.T) {
 		RefreshToken: "refresh123",
 		Updated:      time.Date(2019, 02, 25, 0, 0, 0, 0, time.UTC),
 	})
-	user, err := store.GetUser("id123")
+	user, err := store.GetUser(context.TODO(), "id123")
 	if err != nil {
 		panic(err)
 	}
@@ -57,15 +57,15 @@ func TestSavingUser(t *testing.T) {
 		store:        store,
 	}
 
-	originalUser.save()
+	originalUser.save(context.TODO())
 
 	assert.Equal(t, s.HGet("goplaxt:user:id123", "username"), "halkeye")
 	assert.Equal(t, s.HGet("goplaxt:user:id123", "access"), "access123")
 	assert.Equal(t, s.HGet("goplaxt:user:id123", "refresh"), "refresh123")
-	assert.Equal(t, s.HGet("goplaxt:user:id123", "updated"), "02-25-2019")
+	assert.Equal(t, s.HGet("goplaxt:user:id123", "updated"), "2019-02-25T00:00:00Z")
 
 	expected, _ := json.Marshal(originalUser)
-	user, _ := store.GetUser("id123")
+	user, _ := store.GetUser(context.TODO(), "id123")
 	actual, _ := json.Marshal(user)
 
 	assert.EqualValues(t, string(expected), string(actual))
@@ -81,3 +81,75 @@ func TestPing(t *testing.T) {
 	store := NewRedisStore(NewRedisClient(s.Addr(), ""))
 	assert.Equal(t, store.Ping(context.TODO()), nil)
 }
+
+func TestDeletingUser(t *testing.T) {
+	s, err := miniredis.Run()
+	if err != nil {
+		panic(err)
+	}
+	defer s.Close()
+
+	store := NewRedisStore(NewRedisClient(s.Addr(), ""))
+	s.HSet("goplaxt:user:id123", "username", "halkeye")
+
+	deleted, err := store.DeleteUser(context.TODO(), "id123")
+	assert.NoError(t, err)
+	assert.True(t, deleted)
+	assert.False(t, s.Exists("goplaxt:user:id123"))
+
+	deleted, err = store.DeleteUser(context.TODO(), "id123")
+	assert.NoError(t, err)
+	assert.False(t, deleted)
+}
+
+func TestListingUsers(t *testing.T) {
+	s, err := miniredis.Run()
+	if err != nil {
+		panic(err)
+	}
+	defer s.Close()
+
+	store := NewRedisStore(NewRedisClient(s.Addr(), ""))
+	for _, id := range []string{"id1", "id2", "id3"} {
+		s.HSet("goplaxt:user:"+id, "username", "halkeye")
+		s.HSet("goplaxt:user:"+id, "updated", "02-25-2019")
+	}
+	s.Set("unrelated", "value")
+
+	seen := map[string]bool{}
+	cursor := ""
+	for {
+		users, next, err := store.ListUsers(context.TODO(), cursor, 2)
+		assert.NoError(t, err)
+		for _, user := range users {
+			assert.Equal(t, "halkeye", user.Username)
+			seen[user.ID] = true
+		}
+		if next == "" {
+			break
+		}
+		cursor = next
+	}
+	assert.Equal(t, map[string]bool{"id1": true, "id2": true, "id3": true}, seen)
+
+	count, err := store.CountUsers(context.TODO())
+	assert.NoError(t, err)
+	assert.Equal(t, 3, count)
+}
+
+func TestCancelledContext(t *testing.T) {
+	s, err := miniredis.Run()
+	if err != nil {
+		panic(err)
+	}
+	defer s.Close()
+
+	store := NewRedisStore(NewRedisClient(s.Addr(), ""))
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	assert.Error(t, store.WriteUser(ctx, User{ID: "id123"}))
+	assert.False(t, s.Exists("goplaxt:user:id123"))
+	_, err = store.GetUser(ctx, "id123")
+	assert.Error(t, err)
+}
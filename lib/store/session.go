@@ -0,0 +1,76 @@
+package store
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Session is where the playback of an item on one player of a user stands, or
+// what the player itself last started
+type Session struct {
+	State string `json:"state"`
+	// Event is the last webhook applied to the session and EventAt when it was received
+	Event   string    `json:"event"`
+	EventAt time.Time `json:"event_at"`
+	// ReceivedAt is when the latest webhook for the session came in, applied or not
+	ReceivedAt time.Time `json:"received_at"`
+	// Item and Payload are only kept for a whole player, the rating key of the
+	// item it last started and the webhook that started it
+	Item    string `json:"item,omitempty"`
+	Payload []byte `json:"payload,omitempty"`
+}
+
+// SessionStore keeps playback sessions, replicas share them when they are kept in redis
+type SessionStore interface {
+	// UpdateSession runs update on the session stored under key, an empty one
+	// when there is none, and keeps the result for ttl. update runs again when
+	// the session changed meanwhile, so it must not have other side effects
+	UpdateSession(ctx context.Context, key string, ttl time.Duration, update func(*Session)) error
+}
+
+type memorySession struct {
+	session   Session
+	expiresAt time.Time
+}
+
+// MemorySessions keeps sessions in memory, for a single replica
+type MemorySessions struct {
+	mu        sync.Mutex
+	sessions  map[string]*memorySession
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+// NewMemorySessions creates an empty session store
+func NewMemorySessions() *MemorySessions {
+	return &MemorySessions{
+		sessions: make(map[string]*memorySession),
+		now:      time.Now,
+	}
+}
+
+// UpdateSession runs update under a lock
+func (m *MemorySessions) UpdateSession(ctx context.Context, key string, ttl time.Duration, update func(*Session)) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := m.now()
+	// Sessions nobody touches anymore are dropped once every ttl
+	if now.Sub(m.lastSweep) > ttl {
+		for key, stored := range m.sessions {
+			if now.After(stored.expiresAt) {
+				delete(m.sessions, key)
+			}
+		}
+		m.lastSweep = now
+	}
+	stored, ok := m.sessions[key]
+	if !ok || now.After(stored.expiresAt) {
+		stored = &memorySession{}
+		m.sessions[key] = stored
+	}
+	update(&stored.session)
+	stored.expiresAt = now.Add(ttl)
+	return nil
+}
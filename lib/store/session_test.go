@@ -0,0 +1,62 @@
+package store
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testSessionStore(t *testing.T, sessions SessionStore, expire func(time.Duration)) {
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.NoError(t, sessions.UpdateSession(context.TODO(), "user:player:1", time.Minute, func(session *Session) {
+				session.State += "x"
+			}))
+		}()
+	}
+	wg.Wait()
+
+	var seen Session
+	require.NoError(t, sessions.UpdateSession(context.TODO(), "user:player:1", time.Minute, func(session *Session) {
+		seen = *session
+	}))
+	assert.Equal(t, strings.Repeat("x", 10), seen.State)
+
+	expire(2 * time.Minute)
+	require.NoError(t, sessions.UpdateSession(context.TODO(), "user:player:1", time.Minute, func(session *Session) {
+		seen = *session
+	}))
+	assert.Equal(t, Session{}, seen)
+}
+
+func TestMemorySessions(t *testing.T) {
+	sessions := NewMemorySessions()
+	now := time.Now()
+	var mu sync.Mutex
+	sessions.now = func() time.Time {
+		mu.Lock()
+		defer mu.Unlock()
+		return now
+	}
+	testSessionStore(t, sessions, func(d time.Duration) {
+		mu.Lock()
+		defer mu.Unlock()
+		now = now.Add(d)
+	})
+}
+
+func TestRedisSessions(t *testing.T) {
+	s, err := miniredis.Run()
+	require.NoError(t, err)
+	defer s.Close()
+	testSessionStore(t, NewRedisStore(NewRedisClient(s.Addr(), "")), s.FastForward)
+}
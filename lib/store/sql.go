@@ -0,0 +1,439 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+	"time"
+
+	"github.com/gravitational/trace"
+	"go.opentelemetry.io/otel/attribute"
+	semconv "go.opentelemetry.io/otel/semconv/v1.4.0"
+	oteltrace "go.opentelemetry.io/otel/trace"
+)
+
+// sqlStore holds the queries shared by every database/sql backend, they are
+// written so both postgres and sqlite understand them
+type sqlStore struct {
+	db *sql.DB
+	// system tells postgres and sqlite spans apart
+	system attribute.KeyValue
+}
+
+func (s sqlStore) startSpan(ctx context.Context, name, statement string) (context.Context, oteltrace.Span) {
+	return s.startTableSpan(ctx, name, "users", statement)
+}
+
+func (s sqlStore) startTableSpan(ctx context.Context, name, table, statement string) (context.Context, oteltrace.Span) {
+	return startSpan(
+		ctx,
+		"sql."+name,
+		s.system,
+		semconv.DBSQLTableKey.String(table),
+		semconv.DBStatementKey.String(statement),
+	)
+}
+
+// Ping will check if the connection works right
+func (s sqlStore) Ping(ctx context.Context) (err error) {
+	ctx, span := s.startSpan(ctx, "Ping", "")
+	defer func() { endSpan(span, err) }()
+
+	conn, err := s.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	return conn.PingContext(ctx)
+}
+
+const upsertUser = `
+	INSERT INTO users
+		(id, username, access, refresh, updated, key_id, expires_at, scope, version)
+		VALUES($1, $2, $3, $4, $5, $6, $7, $8, $9)
+	ON CONFLICT(id)
+	DO UPDATE set username=EXCLUDED.username, access=EXCLUDED.access, refresh=EXCLUDED.refresh, updated=EXCLUDED.updated, key_id=EXCLUDED.key_id, expires_at=EXCLUDED.expires_at, scope=EXCLUDED.scope
+`
+
+// WriteUser will write a user object to the database
+func (s sqlStore) WriteUser(ctx context.Context, user User) (err error) {
+	ctx, span := s.startSpan(ctx, "WriteUser", upsertUser)
+	defer func() { endSpan(span, err) }()
+
+	expiresAt := sql.NullTime{Time: user.ExpiresAt, Valid: !user.ExpiresAt.IsZero()}
+	_, err = s.db.ExecContext(
+		ctx,
+		upsertUser,
+		user.ID,
+		user.Username,
+		user.AccessToken,
+		user.RefreshToken,
+		user.Updated,
+		user.keyID,
+		expiresAt,
+		user.Scope,
+		user.Version,
+	)
+
+	return trace.Wrap(err)
+}
+
+const swapUser = `
+	UPDATE users
+	SET username=$2, access=$3, refresh=$4, updated=$5, key_id=$6, expires_at=$7, scope=$8, version=$9
+	WHERE id=$1 AND version=$10
+`
+
+// CompareAndSwapUser will update the user row only while it is still at version
+func (s sqlStore) CompareAndSwapUser(ctx context.Context, version int64, user User) (err error) {
+	ctx, span := s.startSpan(ctx, "CompareAndSwapUser", swapUser)
+	defer func() { endSpan(span, err) }()
+
+	expiresAt := sql.NullTime{Time: user.ExpiresAt, Valid: !user.ExpiresAt.IsZero()}
+	result, err := s.db.ExecContext(
+		ctx,
+		swapUser,
+		user.ID,
+		user.Username,
+		user.AccessToken,
+		user.RefreshToken,
+		user.Updated,
+		user.keyID,
+		expiresAt,
+		user.Scope,
+		user.Version,
+		version,
+	)
+	if err != nil {
+		return trace.Errorf("update error: %v", err)
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	if affected > 0 {
+		return nil
+	}
+	// Nothing matched, tell a missing user apart from a newer version
+	if _, err := s.GetUser(ctx, user.ID); err != nil {
+		return trace.Wrap(err)
+	}
+	return trace.CompareFailed("user %s is no longer at version %d", user.ID, version)
+}
+
+// userColumns are read by scanUser, in this order
+const userColumns = "id, username, access, refresh, updated, key_id, expires_at, scope, version"
+
+const selectUser = "SELECT " + userColumns + " FROM users WHERE id=$1"
+
+// GetUser will load a user from the database
+func (s sqlStore) GetUser(ctx context.Context, id string) (_ *User, err error) {
+	ctx, span := s.startSpan(ctx, "GetUser", selectUser)
+	defer func() { endSpan(span, err) }()
+
+	user, err := s.scanUser(s.db.QueryRowContext(ctx, selectUser, id))
+	switch {
+	case err == sql.ErrNoRows:
+		return nil, trace.NotFound("no user with id %s", id)
+	case err != nil:
+		return nil, trace.Errorf("query error: %v", err)
+	}
+
+	return user, nil
+}
+
+// scanUser reads the userColumns of a row
+func (s sqlStore) scanUser(row interface{ Scan(...interface{}) error }) (*User, error) {
+	var username string
+	var expiresAt sql.NullTime
+	user := User{store: s}
+
+	err := row.Scan(
+		&user.ID,
+		&username,
+		&user.AccessToken,
+		&user.RefreshToken,
+		&user.Updated,
+		&user.keyID,
+		&expiresAt,
+		&user.Scope,
+		&user.Version,
+	)
+	if err != nil {
+		return nil, err
+	}
+	user.Username = strings.ToLower(username)
+	user.ExpiresAt = expiresAt.Time
+
+	return &user, nil
+}
+
+const deleteUser = "DELETE FROM users WHERE id=$1"
+
+// DeleteUser will remove a user from the database, reporting whether it existed
+func (s sqlStore) DeleteUser(ctx context.Context, id string) (_ bool, err error) {
+	ctx, span := s.startSpan(ctx, "DeleteUser", deleteUser)
+	defer func() { endSpan(span, err) }()
+
+	result, err := s.db.ExecContext(ctx, deleteUser, id)
+	if err != nil {
+		return false, trace.Errorf("delete error: %v", err)
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return false, trace.Wrap(err)
+	}
+	return affected > 0, nil
+}
+
+const listUsers = "SELECT " + userColumns + " FROM users WHERE id > $1 ORDER BY id LIMIT $2"
+
+// ListUsers will page through users ordered by id, starting after cursor
+func (s sqlStore) ListUsers(ctx context.Context, cursor string, limit int) (_ []*User, _ string, err error) {
+	ctx, span := s.startSpan(ctx, "ListUsers", listUsers)
+	defer func() { endSpan(span, err) }()
+
+	if limit <= 0 {
+		return nil, "", trace.BadParameter("limit must be positive")
+	}
+	rows, err := s.db.QueryContext(ctx, listUsers, cursor, limit)
+	if err != nil {
+		return nil, "", trace.Errorf("query error: %v", err)
+	}
+	defer rows.Close()
+
+	var users []*User
+	for rows.Next() {
+		user, err := s.scanUser(rows)
+		if err != nil {
+			return nil, "", trace.Errorf("scan error: %v", err)
+		}
+		users = append(users, user)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, "", trace.Errorf("query error: %v", err)
+	}
+
+	if len(users) < limit {
+		return users, "", nil
+	}
+	return users, users[len(users)-1].ID, nil
+}
+
+const countUsers = "SELECT count(*) FROM users"
+
+// CountUsers will count the rows in the users table
+func (s sqlStore) CountUsers(ctx context.Context) (_ int, err error) {
+	ctx, span := s.startSpan(ctx, "CountUsers", countUsers)
+	defer func() { endSpan(span, err) }()
+
+	var count int
+	err = s.db.QueryRowContext(ctx, countUsers).Scan(&count)
+	if err != nil {
+		return 0, trace.Errorf("query error: %v", err)
+	}
+	return count, nil
+}
+
+const insertJob = `
+	INSERT INTO scrobble_jobs
+		(id, user_id, root, payload, received_at, run_at, attempts, last_error, dead, settings)
+		VALUES($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+`
+
+// Enqueue will insert a job into the scrobble_jobs table
+func (s sqlStore) Enqueue(ctx context.Context, job Job) (err error) {
+	ctx, span := s.startTableSpan(ctx, "Enqueue", "scrobble_jobs", insertJob)
+	defer func() { endSpan(span, err) }()
+
+	_, err = s.db.ExecContext(
+		ctx,
+		insertJob,
+		job.ID,
+		job.UserID,
+		job.Root,
+		string(job.Payload),
+		job.ReceivedAt.UTC(),
+		job.RunAt.UTC(),
+		job.Attempts,
+		job.LastError,
+		job.Dead,
+		job.Settings,
+	)
+	return trace.Wrap(err)
+}
+
+// dueJobs are the candidates a claim races for, sqlite has no SKIP LOCKED so
+// every claim is a compare and swap on the claim column instead
+const dueJobs = "SELECT id, claim FROM scrobble_jobs WHERE dead = false AND run_at <= $1 ORDER BY run_at LIMIT 10"
+
+const claimJob = "UPDATE scrobble_jobs SET run_at=$3, claim=$4 WHERE id=$1 AND claim=$2"
+
+// Claim will take the earliest due job that no other worker claimed meanwhile
+func (s sqlStore) Claim(ctx context.Context, now time.Time, lease time.Duration) (_ *Job, err error) {
+	ctx, span := s.startTableSpan(ctx, "Claim", "scrobble_jobs", claimJob)
+	defer func() { endSpan(span, err) }()
+
+	rows, err := s.db.QueryContext(ctx, dueJobs, now.UTC())
+	if err != nil {
+		return nil, trace.Errorf("query error: %v", err)
+	}
+	type candidate struct{ id, claim string }
+	var candidates []candidate
+	for rows.Next() {
+		var c candidate
+		if err := rows.Scan(&c.id, &c.claim); err != nil {
+			rows.Close()
+			return nil, trace.Errorf("scan error: %v", err)
+		}
+		candidates = append(candidates, c)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, trace.Errorf("query error: %v", err)
+	}
+
+	for _, c := range candidates {
+		result, err := s.db.ExecContext(ctx, claimJob, c.id, c.claim, now.Add(lease).UTC(), uuid())
+		if err != nil {
+			return nil, trace.Errorf("update error: %v", err)
+		}
+		affected, err := result.RowsAffected()
+		if err != nil {
+			return nil, trace.Wrap(err)
+		}
+		if affected > 0 {
+			return s.getJob(ctx, c.id)
+		}
+	}
+	return nil, trace.NotFound("no scrobble job is due")
+}
+
+// jobColumns are read by scanJob, in this order
+const jobColumns = "id, user_id, root, payload, received_at, run_at, attempts, last_error, dead, settings, claim"
+
+const selectJob = "SELECT " + jobColumns + " FROM scrobble_jobs WHERE id=$1"
+
+func (s sqlStore) getJob(ctx context.Context, id string) (*Job, error) {
+	job, err := scanJob(s.db.QueryRowContext(ctx, selectJob, id))
+	switch {
+	case err == sql.ErrNoRows:
+		return nil, trace.NotFound("no scrobble job with id %s", id)
+	case err != nil:
+		return nil, trace.Errorf("query error: %v", err)
+	}
+	return job, nil
+}
+
+// scanJob reads the jobColumns of a row
+func scanJob(row interface{ Scan(...interface{}) error }) (*Job, error) {
+	var job Job
+	var payload string
+	err := row.Scan(
+		&job.ID,
+		&job.UserID,
+		&job.Root,
+		&payload,
+		&job.ReceivedAt,
+		&job.RunAt,
+		&job.Attempts,
+		&job.LastError,
+		&job.Dead,
+		&job.Settings,
+		&job.Claim,
+	)
+	if err != nil {
+		return nil, err
+	}
+	job.Payload = []byte(payload)
+	return &job, nil
+}
+
+const releaseJob = "UPDATE scrobble_jobs SET run_at=$2, attempts=$3, last_error=$4, dead=$5 WHERE id=$1 AND claim=$6"
+
+// Release will update the job as long as it still holds the claim of the worker
+func (s sqlStore) Release(ctx context.Context, job Job) (err error) {
+	ctx, span := s.startTableSpan(ctx, "Release", "scrobble_jobs", releaseJob)
+	defer func() { endSpan(span, err) }()
+
+	result, err := s.db.ExecContext(ctx, releaseJob, job.ID, job.RunAt.UTC(), job.Attempts, job.LastError, job.Dead, job.Claim)
+	if err != nil {
+		return trace.Errorf("update error: %v", err)
+	}
+	return trace.Wrap(s.checkClaim(ctx, result, job))
+}
+
+const deleteJob = "DELETE FROM scrobble_jobs WHERE id=$1 AND claim=$2"
+
+// Complete will remove a delivered job as long as it still holds the claim of the worker
+func (s sqlStore) Complete(ctx context.Context, job Job) (err error) {
+	ctx, span := s.startTableSpan(ctx, "Complete", "scrobble_jobs", deleteJob)
+	defer func() { endSpan(span, err) }()
+
+	result, err := s.db.ExecContext(ctx, deleteJob, job.ID, job.Claim)
+	if err != nil {
+		return trace.Errorf("delete error: %v", err)
+	}
+	return trace.Wrap(s.checkClaim(ctx, result, job))
+}
+
+// checkClaim tells a missing job apart from one claimed again when result didn't touch job
+func (s sqlStore) checkClaim(ctx context.Context, result sql.Result, job Job) error {
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return trace.Wrap(err)
+	}
+	if affected > 0 {
+		return nil
+	}
+	if _, err := s.getJob(ctx, job.ID); err != nil {
+		return trace.Wrap(err)
+	}
+	return trace.CompareFailed("scrobble job %s was claimed again", job.ID)
+}
+
+const deadJobs = "SELECT " + jobColumns + " FROM scrobble_jobs WHERE dead = true ORDER BY received_at LIMIT $1"
+
+// DeadJobs will list the jobs that ran out of attempts
+func (s sqlStore) DeadJobs(ctx context.Context, limit int) (_ []*Job, err error) {
+	ctx, span := s.startTableSpan(ctx, "DeadJobs", "scrobble_jobs", deadJobs)
+	defer func() { endSpan(span, err) }()
+
+	if limit <= 0 {
+		return nil, trace.BadParameter("limit must be positive")
+	}
+	rows, err := s.db.QueryContext(ctx, deadJobs, limit)
+	if err != nil {
+		return nil, trace.Errorf("query error: %v", err)
+	}
+	defer rows.Close()
+
+	var jobs []*Job
+	for rows.Next() {
+		job, err := scanJob(rows)
+		if err != nil {
+			return nil, trace.Errorf("scan error: %v", err)
+		}
+		jobs = append(jobs, job)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, trace.Errorf("query error: %v", err)
+	}
+	return jobs, nil
+}
+
+const purgeDeadJobs = "DELETE FROM scrobble_jobs WHERE dead = true AND received_at < $1"
+
+// PurgeDead will delete the old dead jobs
+func (s sqlStore) PurgeDead(ctx context.Context, before time.Time) (_ int, err error) {
+	ctx, span := s.startTableSpan(ctx, "PurgeDead", "scrobble_jobs", purgeDeadJobs)
+	defer func() { endSpan(span, err) }()
+
+	result, err := s.db.ExecContext(ctx, purgeDeadJobs, before.UTC())
+	if err != nil {
+		return 0, trace.Wrap(err)
+	}
+	purged, err := result.RowsAffected()
+	return int(purged), trace.Wrap(err)
+}
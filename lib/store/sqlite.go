@@ -0,0 +1,53 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/gravitational/trace"
+	// SQLite db library loading
+	semconv "go.opentelemetry.io/otel/semconv/v1.4.0"
+	_ "modernc.org/sqlite"
+)
+
+// SQLiteStore is a storage engine that writes to a local sqlite database
+type SQLiteStore struct {
+	sqlStore
+}
+
+// NewSQLiteClient opens the database file at path and brings its schema up to date
+func NewSQLiteClient(path string) *sql.DB {
+	db, err := OpenSQLite(context.Background(), path)
+	if err != nil {
+		panic(err)
+	}
+	return db
+}
+
+// ConnectSQLite opens the database file at path, leaving its schema as it is
+func ConnectSQLite(path string) (*sql.DB, error) {
+	// Wait on the write lock instead of failing right away when writers overlap,
+	// and store times in a format that can be read back whatever their zone
+	db, err := sql.Open("sqlite", path+"?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)&_time_format=sqlite")
+	return db, trace.Wrap(err)
+}
+
+// OpenSQLite opens the database file at path and brings its schema up to date
+func OpenSQLite(ctx context.Context, path string) (*sql.DB, error) {
+	db, err := ConnectSQLite(path)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	if _, err := MigrateSQLite(ctx, db); err != nil {
+		db.Close()
+		return nil, trace.Wrap(err)
+	}
+	return db, nil
+}
+
+// NewSQLiteStore creates new store
+func NewSQLiteStore(db *sql.DB) SQLiteStore {
+	return SQLiteStore{
+		sqlStore{db: db, system: semconv.DBSystemSqlite},
+	}
+}
@@ -0,0 +1,122 @@
+package store
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestSQLiteStore(t *testing.T) SQLiteStore {
+	dir, err := ioutil.TempDir("", "goplaxt-sqlite")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	db, err := OpenSQLite(context.TODO(), filepath.Join(dir, "goplaxt.db"))
+	require.NoError(t, err)
+	t.Cleanup(func() { db.Close() })
+	return NewSQLiteStore(db)
+}
+
+func TestSQLiteSavingAndLoadingUser(t *testing.T) {
+	store := newTestSQLiteStore(t)
+	assert.NoError(t, store.Ping(context.TODO()))
+
+	originalUser := &User{
+		ID:           "id123",
+		Username:     "Halkeye",
+		AccessToken:  "access123",
+		RefreshToken: "refresh123",
+		Updated:      time.Date(2019, 02, 25, 10, 30, 0, 0, time.UTC),
+		store:        store,
+	}
+	require.NoError(t, originalUser.save(context.TODO()))
+
+	user, err := store.GetUser(context.TODO(), "id123")
+	require.NoError(t, err)
+	assert.Equal(t, "halkeye", user.Username)
+	assert.Equal(t, "access123", user.AccessToken)
+	assert.Equal(t, "refresh123", user.RefreshToken)
+	assert.True(t, originalUser.Updated.Equal(user.Updated))
+
+	swapped := *user
+	swapped.AccessToken, swapped.RefreshToken, swapped.Version = "access456", "refresh456", user.Version+2
+	require.NoError(t, store.CompareAndSwapUser(context.TODO(), user.Version, swapped))
+	user, err = store.GetUser(context.TODO(), "id123")
+	require.NoError(t, err)
+	assert.Equal(t, "access456", user.AccessToken)
+
+	count, err := store.CountUsers(context.TODO())
+	require.NoError(t, err)
+	assert.Equal(t, 1, count)
+}
+
+func TestSQLiteListingAndDeletingUsers(t *testing.T) {
+	store := newTestSQLiteStore(t)
+	for _, id := range []string{"id2", "id3", "id1"} {
+		require.NoError(t, store.WriteUser(context.TODO(), User{ID: id, Username: "halkeye", Updated: time.Now()}))
+	}
+
+	users, next, err := store.ListUsers(context.TODO(), "", 2)
+	require.NoError(t, err)
+	require.Len(t, users, 2)
+	assert.Equal(t, "id1", users[0].ID)
+	assert.Equal(t, "id2", next)
+
+	users, next, err = store.ListUsers(context.TODO(), next, 2)
+	require.NoError(t, err)
+	require.Len(t, users, 1)
+	assert.Equal(t, "id3", users[0].ID)
+	assert.Equal(t, "", next)
+
+	deleted, err := store.DeleteUser(context.TODO(), "id2")
+	require.NoError(t, err)
+	assert.True(t, deleted)
+	deleted, err = store.DeleteUser(context.TODO(), "id2")
+	require.NoError(t, err)
+	assert.False(t, deleted)
+}
+
+func TestSQLiteMigrationsAreIdempotent(t *testing.T) {
+	store := newTestSQLiteStore(t)
+
+	applied, err := MigrateSQLite(context.TODO(), store.db)
+	require.NoError(t, err)
+	assert.Empty(t, applied)
+
+	var version int
+	require.NoError(t, store.db.QueryRow("SELECT max(version) FROM schema_migrations").Scan(&version))
+	assert.Equal(t, sqliteMigrations[len(sqliteMigrations)-1].version, version)
+	assert.Equal(t, len(postgresqlMigrations), len(sqliteMigrations))
+}
+
+func TestSQLiteConcurrentMigrations(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goplaxt-sqlite")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// Replicas booting against the same file
+	results := make(chan []int, 8)
+	errs := make(chan error, 8)
+	for i := 0; i < 8; i++ {
+		db, err := ConnectSQLite(filepath.Join(dir, "goplaxt.db"))
+		require.NoError(t, err)
+		defer db.Close()
+		go func() {
+			applied, err := MigrateSQLite(context.TODO(), db)
+			results <- applied
+			errs <- err
+		}()
+	}
+	var applied []int
+	for i := 0; i < 8; i++ {
+		require.NoError(t, <-errs)
+		applied = append(applied, <-results...)
+	}
+	assert.Len(t, applied, len(sqliteMigrations), "every migration should be applied exactly once")
+}
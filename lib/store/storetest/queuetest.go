@@ -0,0 +1,265 @@
+package storetest
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gravitational/trace"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/xanderstrike/goplaxt/lib/store"
+)
+
+// QueueFactory returns a new, empty queue for every call
+type QueueFactory func(t *testing.T) store.Queue
+
+// RunQueueConformance runs the whole queue contract against the queues made by factory
+func RunQueueConformance(t *testing.T, factory QueueFactory) {
+	tests := []struct {
+		name string
+		run  func(t *testing.T, q store.Queue)
+	}{
+		{"ClaimAndComplete", testClaimAndComplete},
+		{"ReceivedAtPrecision", testReceivedAtPrecision},
+		{"ClaimOrder", testClaimOrder},
+		{"LeaseExpiry", testLeaseExpiry},
+		{"ExpiredLeaseSettles", testExpiredLeaseSettles},
+		{"Release", testRelease},
+		{"DeadLetter", testDeadLetter},
+		{"PurgeDead", testPurgeDead},
+		{"ConcurrentClaims", testConcurrentClaims},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			test.run(t, factory(t))
+		})
+	}
+}
+
+var received = time.Date(2019, 02, 25, 10, 30, 15, 0, time.UTC)
+
+func newJob(id string, receivedAt time.Time) store.Job {
+	job := store.NewJob("user123", "https://plaxt.example.com", []byte(`{"event":"media.scrobble"}`), receivedAt)
+	job.ID = id
+	job.Settings = "watched=85"
+	return job
+}
+
+func assertSameJob(t *testing.T, expected store.Job, actual *store.Job) {
+	require.NotNil(t, actual)
+	assert.Equal(t, expected.ID, actual.ID)
+	assert.Equal(t, expected.UserID, actual.UserID)
+	assert.Equal(t, expected.Root, actual.Root)
+	assert.Equal(t, string(expected.Payload), string(actual.Payload))
+	assert.Equal(t, expected.Settings, actual.Settings)
+	// Sessions compare it to the time they were given, it has to read back exactly
+	assert.True(t, expected.ReceivedAt.Equal(actual.ReceivedAt), "received at %s, read back %s", expected.ReceivedAt, actual.ReceivedAt)
+	assert.Equal(t, expected.Attempts, actual.Attempts)
+	assert.Equal(t, expected.LastError, actual.LastError)
+	assert.Equal(t, expected.Dead, actual.Dead)
+}
+
+func assertNothingDue(t *testing.T, q store.Queue, now time.Time) {
+	job, err := q.Claim(context.TODO(), now, time.Minute)
+	assert.Nil(t, job)
+	assert.True(t, trace.IsNotFound(err), "expected a not found error, got %v", err)
+}
+
+func testClaimAndComplete(t *testing.T, q store.Queue) {
+	assertNothingDue(t, q, received)
+
+	job := newJob("job1", received)
+	require.NoError(t, q.Enqueue(context.TODO(), job))
+
+	claimed, err := q.Claim(context.TODO(), received.Add(time.Second), time.Minute)
+	require.NoError(t, err)
+	assertSameJob(t, job, claimed)
+	assert.WithinDuration(t, received.Add(time.Second+time.Minute), claimed.RunAt, time.Millisecond)
+
+	require.NoError(t, q.Complete(context.TODO(), *claimed))
+	assertNothingDue(t, q, received.Add(time.Hour))
+
+	err = q.Complete(context.TODO(), *claimed)
+	assert.True(t, trace.IsNotFound(err), "expected a not found error, got %v", err)
+}
+
+func testReceivedAtPrecision(t *testing.T, q store.Queue) {
+	// Half way between two microseconds, postgres would round it up
+	job := newJob("job1", received.Add(1500*time.Nanosecond+500))
+	require.NoError(t, q.Enqueue(context.TODO(), job))
+
+	claimed, err := q.Claim(context.TODO(), received.Add(time.Second), time.Minute)
+	require.NoError(t, err)
+	assertSameJob(t, job, claimed)
+}
+
+func testClaimOrder(t *testing.T, q store.Queue) {
+	require.NoError(t, q.Enqueue(context.TODO(), newJob("later", received.Add(2*time.Second))))
+	require.NoError(t, q.Enqueue(context.TODO(), newJob("future", received.Add(time.Hour))))
+	require.NoError(t, q.Enqueue(context.TODO(), newJob("earlier", received.Add(time.Second))))
+
+	now := received.Add(time.Minute)
+	for _, id := range []string{"earlier", "later"} {
+		claimed, err := q.Claim(context.TODO(), now, time.Hour)
+		require.NoError(t, err)
+		assert.Equal(t, id, claimed.ID)
+	}
+	assertNothingDue(t, q, now)
+}
+
+func testLeaseExpiry(t *testing.T, q store.Queue) {
+	require.NoError(t, q.Enqueue(context.TODO(), newJob("job1", received)))
+
+	_, err := q.Claim(context.TODO(), received, time.Minute)
+	require.NoError(t, err)
+	assertNothingDue(t, q, received.Add(30*time.Second))
+
+	// The worker holding it never came back
+	claimed, err := q.Claim(context.TODO(), received.Add(2*time.Minute), time.Minute)
+	require.NoError(t, err)
+	assert.Equal(t, "job1", claimed.ID)
+}
+
+func testExpiredLeaseSettles(t *testing.T, q store.Queue) {
+	require.NoError(t, q.Enqueue(context.TODO(), newJob("job1", received)))
+	stale, err := q.Claim(context.TODO(), received, time.Minute)
+	require.NoError(t, err)
+	// The lease ran out while the first worker was still at it
+	claimed, err := q.Claim(context.TODO(), received.Add(2*time.Minute), time.Minute)
+	require.NoError(t, err)
+	assert.NotEqual(t, stale.Claim, claimed.Claim)
+
+	stale.Attempts++
+	stale.RunAt = received.Add(time.Hour)
+	err = q.Release(context.TODO(), *stale)
+	assert.True(t, trace.IsCompareFailed(err), "expected a compare failed error, got %v", err)
+	err = q.Complete(context.TODO(), *stale)
+	assert.True(t, trace.IsCompareFailed(err), "expected a compare failed error, got %v", err)
+
+	// The job is still the second worker's
+	require.NoError(t, q.Release(context.TODO(), *claimed))
+	retried, err := q.Claim(context.TODO(), received.Add(3*time.Minute), time.Minute)
+	require.NoError(t, err)
+	assert.Equal(t, 0, retried.Attempts)
+	require.NoError(t, q.Complete(context.TODO(), *retried))
+}
+
+func testRelease(t *testing.T, q store.Queue) {
+	job := newJob("job1", received)
+	require.NoError(t, q.Enqueue(context.TODO(), job))
+	claimed, err := q.Claim(context.TODO(), received, time.Minute)
+	require.NoError(t, err)
+
+	claimed.Attempts++
+	claimed.LastError = "trakt is down"
+	claimed.RunAt = received.Add(5 * time.Second)
+	require.NoError(t, q.Release(context.TODO(), *claimed))
+	assertNothingDue(t, q, received.Add(time.Second))
+
+	retried, err := q.Claim(context.TODO(), received.Add(5*time.Second), time.Minute)
+	require.NoError(t, err)
+	assertSameJob(t, *claimed, retried)
+
+	err = q.Release(context.TODO(), newJob("unknown", received))
+	assert.True(t, trace.IsNotFound(err), "expected a not found error, got %v", err)
+}
+
+func testDeadLetter(t *testing.T, q store.Queue) {
+	dead, err := q.DeadJobs(context.TODO(), 10)
+	require.NoError(t, err)
+	assert.Empty(t, dead)
+
+	for _, id := range []string{"job2", "job1"} {
+		job := newJob(id, received)
+		if id == "job1" {
+			job.ReceivedAt = received.Add(-time.Minute)
+		}
+		require.NoError(t, q.Enqueue(context.TODO(), job))
+		claimed, err := q.Claim(context.TODO(), received, time.Minute)
+		require.NoError(t, err)
+		claimed.Attempts = 5
+		claimed.LastError = "no trakt movie"
+		claimed.Dead = true
+		require.NoError(t, q.Release(context.TODO(), *claimed))
+	}
+	assertNothingDue(t, q, received.Add(time.Hour))
+
+	dead, err = q.DeadJobs(context.TODO(), 10)
+	require.NoError(t, err)
+	require.Len(t, dead, 2)
+	assert.Equal(t, "job1", dead[0].ID)
+	assert.Equal(t, "job2", dead[1].ID)
+	assert.True(t, dead[0].Dead)
+	assert.Equal(t, "no trakt movie", dead[0].LastError)
+
+	dead, err = q.DeadJobs(context.TODO(), 1)
+	require.NoError(t, err)
+	assert.Len(t, dead, 1)
+
+	require.NoError(t, q.Complete(context.TODO(), *dead[0]))
+	dead, err = q.DeadJobs(context.TODO(), 10)
+	require.NoError(t, err)
+	assert.Len(t, dead, 1)
+
+	_, err = q.DeadJobs(context.TODO(), 0)
+	assert.Error(t, err)
+}
+
+func testPurgeDead(t *testing.T, q store.Queue) {
+	for i, id := range []string{"old", "recent"} {
+		job := newJob(id, received.Add(time.Duration(i)*time.Hour))
+		require.NoError(t, q.Enqueue(context.TODO(), job))
+		claimed, err := q.Claim(context.TODO(), received.Add(time.Hour), time.Minute)
+		require.NoError(t, err)
+		claimed.Dead = true
+		require.NoError(t, q.Release(context.TODO(), *claimed))
+	}
+	require.NoError(t, q.Enqueue(context.TODO(), newJob("pending", received)))
+
+	purged, err := q.PurgeDead(context.TODO(), received.Add(time.Hour))
+	require.NoError(t, err)
+	assert.Equal(t, 1, purged)
+	dead, err := q.DeadJobs(context.TODO(), 10)
+	require.NoError(t, err)
+	require.Len(t, dead, 1)
+	assert.Equal(t, "recent", dead[0].ID)
+
+	purged, err = q.PurgeDead(context.TODO(), received.Add(time.Hour))
+	require.NoError(t, err)
+	assert.Equal(t, 0, purged)
+
+	// Only dead jobs go, however old
+	pending, err := q.Claim(context.TODO(), received.Add(time.Hour), time.Minute)
+	require.NoError(t, err)
+	assert.Equal(t, "pending", pending.ID)
+}
+
+func testConcurrentClaims(t *testing.T, q store.Queue) {
+	require.NoError(t, q.Enqueue(context.TODO(), newJob("job1", received)))
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := q.Claim(context.TODO(), received, time.Minute)
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	claimed := 0
+	for err := range errs {
+		if err == nil {
+			claimed++
+			continue
+		}
+		assert.True(t, trace.IsNotFound(err), "expected a not found error, got %v", err)
+	}
+	assert.Equal(t, 1, claimed)
+}
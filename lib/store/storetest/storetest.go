@@ -0,0 +1,300 @@
+// Package storetest holds the contract every store.Store implementation has to honour
+package storetest
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gravitational/trace"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/xanderstrike/goplaxt/lib/store"
+)
+
+// Factory returns a new, empty store for every call
+type Factory func(t *testing.T) store.Store
+
+// RunConformance runs the whole store contract against the stores made by factory
+func RunConformance(t *testing.T, factory Factory) {
+	tests := []struct {
+		name string
+		run  func(t *testing.T, s store.Store)
+	}{
+		{"Ping", testPing},
+		{"RoundTrip", testRoundTrip},
+		{"Overwrite", testOverwrite},
+		{"UnknownUser", testUnknownUser},
+		{"Delete", testDelete},
+		{"TimestampPrecision", testTimestampPrecision},
+		{"UnknownExpiry", testUnknownExpiry},
+		{"UsernameCaseFolding", testUsernameCaseFolding},
+		{"ListAndCount", testListAndCount},
+		{"ConcurrentWrites", testConcurrentWrites},
+		{"CompareAndSwap", testCompareAndSwap},
+		{"WriteKeepsVersion", testWriteKeepsVersion},
+		{"ConcurrentCompareAndSwap", testConcurrentCompareAndSwap},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			test.run(t, factory(t))
+		})
+	}
+}
+
+func newUser(id string) store.User {
+	return store.User{
+		ID:           id,
+		Username:     "halkeye",
+		AccessToken:  "access-" + id,
+		RefreshToken: "refresh-" + id,
+		Scope:        "public",
+		ExpiresAt:    time.Date(2019, 05, 26, 10, 30, 15, 0, time.UTC),
+		Updated:      time.Date(2019, 02, 25, 10, 30, 15, 0, time.UTC),
+	}
+}
+
+func assertSameUser(t *testing.T, expected store.User, actual *store.User) {
+	require.NotNil(t, actual)
+	assert.Equal(t, expected.ID, actual.ID)
+	assert.Equal(t, expected.Username, actual.Username)
+	assert.Equal(t, expected.AccessToken, actual.AccessToken)
+	assert.Equal(t, expected.RefreshToken, actual.RefreshToken)
+	assert.Equal(t, expected.Scope, actual.Scope)
+	assert.WithinDuration(t, expected.ExpiresAt, actual.ExpiresAt, time.Millisecond)
+	assert.WithinDuration(t, expected.Updated, actual.Updated, time.Millisecond)
+}
+
+func testPing(t *testing.T, s store.Store) {
+	assert.NoError(t, s.Ping(context.TODO()))
+}
+
+func testRoundTrip(t *testing.T, s store.Store) {
+	user := newUser("id123")
+	require.NoError(t, s.WriteUser(context.TODO(), user))
+
+	actual, err := s.GetUser(context.TODO(), "id123")
+	require.NoError(t, err)
+	assertSameUser(t, user, actual)
+}
+
+func testOverwrite(t *testing.T, s store.Store) {
+	user := newUser("id123")
+	require.NoError(t, s.WriteUser(context.TODO(), user))
+
+	user.AccessToken = "access456"
+	user.RefreshToken = "refresh456"
+	user.Updated = user.Updated.Add(time.Hour)
+	require.NoError(t, s.WriteUser(context.TODO(), user))
+
+	actual, err := s.GetUser(context.TODO(), "id123")
+	require.NoError(t, err)
+	assertSameUser(t, user, actual)
+}
+
+func testUnknownUser(t *testing.T, s store.Store) {
+	user, err := s.GetUser(context.TODO(), "unknown")
+	assert.Nil(t, user)
+	assert.True(t, trace.IsNotFound(err), "expected a not found error, got %v", err)
+}
+
+func testDelete(t *testing.T, s store.Store) {
+	require.NoError(t, s.WriteUser(context.TODO(), newUser("id123")))
+	require.NoError(t, s.WriteUser(context.TODO(), newUser("id456")))
+
+	deleted, err := s.DeleteUser(context.TODO(), "id123")
+	require.NoError(t, err)
+	assert.True(t, deleted)
+
+	_, err = s.GetUser(context.TODO(), "id123")
+	assert.True(t, trace.IsNotFound(err), "expected a not found error, got %v", err)
+
+	deleted, err = s.DeleteUser(context.TODO(), "id123")
+	require.NoError(t, err)
+	assert.False(t, deleted)
+
+	_, err = s.GetUser(context.TODO(), "id456")
+	assert.NoError(t, err)
+}
+
+func testTimestampPrecision(t *testing.T, s store.Store) {
+	user := newUser("id123")
+	user.Updated = time.Date(2019, 02, 25, 23, 59, 58, 123000000, time.FixedZone("UTC-5", -5*60*60))
+	require.NoError(t, s.WriteUser(context.TODO(), user))
+
+	actual, err := s.GetUser(context.TODO(), "id123")
+	require.NoError(t, err)
+	assert.WithinDuration(t, user.Updated, actual.Updated, time.Millisecond)
+}
+
+func testUnknownExpiry(t *testing.T, s store.Store) {
+	user := newUser("id123")
+	user.ExpiresAt = time.Time{}
+	require.NoError(t, s.WriteUser(context.TODO(), user))
+
+	actual, err := s.GetUser(context.TODO(), "id123")
+	require.NoError(t, err)
+	assert.True(t, actual.ExpiresAt.IsZero(), "expected no expiry, got %s", actual.ExpiresAt)
+}
+
+func testUsernameCaseFolding(t *testing.T, s store.Store) {
+	user := newUser("id123")
+	user.Username = "HalKeye"
+	require.NoError(t, s.WriteUser(context.TODO(), user))
+
+	actual, err := s.GetUser(context.TODO(), "id123")
+	require.NoError(t, err)
+	assert.Equal(t, "halkeye", actual.Username)
+
+	users, _, err := s.ListUsers(context.TODO(), "", 10)
+	require.NoError(t, err)
+	require.Len(t, users, 1)
+	assert.Equal(t, "halkeye", users[0].Username)
+}
+
+func testListAndCount(t *testing.T, s store.Store) {
+	count, err := s.CountUsers(context.TODO())
+	require.NoError(t, err)
+	assert.Equal(t, 0, count)
+
+	expected := map[string]store.User{}
+	for i := 0; i < 7; i++ {
+		user := newUser(fmt.Sprintf("id%d", i))
+		expected[user.ID] = user
+		require.NoError(t, s.WriteUser(context.TODO(), user))
+	}
+
+	seen := map[string]bool{}
+	cursor := ""
+	for pages := 0; ; pages++ {
+		require.True(t, pages < 100, "pagination never ended")
+		users, next, err := s.ListUsers(context.TODO(), cursor, 3)
+		require.NoError(t, err)
+		for _, user := range users {
+			assert.False(t, seen[user.ID], "user %s was listed twice", user.ID)
+			seen[user.ID] = true
+			assertSameUser(t, expected[user.ID], user)
+		}
+		if next == "" {
+			break
+		}
+		cursor = next
+	}
+	assert.Len(t, seen, len(expected))
+
+	count, err = s.CountUsers(context.TODO())
+	require.NoError(t, err)
+	assert.Equal(t, len(expected), count)
+
+	_, _, err = s.ListUsers(context.TODO(), "", 0)
+	assert.Error(t, err)
+}
+
+func testConcurrentWrites(t *testing.T, s store.Store) {
+	var wg sync.WaitGroup
+	errs := make(chan error, 40)
+	for i := 0; i < 20; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			errs <- s.WriteUser(context.TODO(), newUser(fmt.Sprintf("id%d", i)))
+		}(i)
+		go func(i int) {
+			defer wg.Done()
+			user := newUser("shared")
+			user.AccessToken = fmt.Sprintf("access%d", i)
+			errs <- s.WriteUser(context.TODO(), user)
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		require.NoError(t, err)
+	}
+
+	count, err := s.CountUsers(context.TODO())
+	require.NoError(t, err)
+	assert.Equal(t, 21, count)
+
+	// Whichever write won, the record has to be a complete one
+	shared, err := s.GetUser(context.TODO(), "shared")
+	require.NoError(t, err)
+	assert.Regexp(t, `^access\d+$`, shared.AccessToken)
+	assert.Equal(t, "refresh-shared", shared.RefreshToken)
+}
+
+func testCompareAndSwap(t *testing.T, s store.Store) {
+	user := newUser("id123")
+	require.NoError(t, s.WriteUser(context.TODO(), user))
+
+	swapped := user
+	swapped.AccessToken = "access-swapped"
+	swapped.Version = 1
+	require.NoError(t, s.CompareAndSwapUser(context.TODO(), 0, swapped))
+
+	stale := user
+	stale.AccessToken = "access-stale"
+	stale.Version = 1
+	err := s.CompareAndSwapUser(context.TODO(), 0, stale)
+	assert.True(t, trace.IsCompareFailed(err), "expected a compare failed error, got %v", err)
+
+	actual, err := s.GetUser(context.TODO(), "id123")
+	require.NoError(t, err)
+	assertSameUser(t, swapped, actual)
+	assert.Equal(t, int64(1), actual.Version)
+
+	err = s.CompareAndSwapUser(context.TODO(), 0, newUser("unknown"))
+	assert.True(t, trace.IsNotFound(err), "expected a not found error, got %v", err)
+}
+
+func testWriteKeepsVersion(t *testing.T, s store.Store) {
+	user := newUser("id123")
+	user.Version = 4
+	require.NoError(t, s.WriteUser(context.TODO(), user))
+	claimed := user
+	claimed.Version = 5
+	require.NoError(t, s.CompareAndSwapUser(context.TODO(), 4, claimed))
+
+	// Someone writes the user without knowing of the claim
+	rewritten := user
+	rewritten.AccessToken = "access-rewritten"
+	rewritten.Version = 0
+	require.NoError(t, s.WriteUser(context.TODO(), rewritten))
+
+	actual, err := s.GetUser(context.TODO(), "id123")
+	require.NoError(t, err)
+	assert.Equal(t, "access-rewritten", actual.AccessToken)
+	assert.Equal(t, int64(5), actual.Version)
+}
+
+func testConcurrentCompareAndSwap(t *testing.T, s store.Store) {
+	require.NoError(t, s.WriteUser(context.TODO(), newUser("id123")))
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			user := newUser("id123")
+			user.AccessToken = fmt.Sprintf("access%d", i)
+			user.Version = 1
+			errs <- s.CompareAndSwapUser(context.TODO(), 0, user)
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+
+	swapped := 0
+	for err := range errs {
+		if err == nil {
+			swapped++
+			continue
+		}
+		assert.True(t, trace.IsCompareFailed(err), "expected a compare failed error, got %v", err)
+	}
+	assert.Equal(t, 1, swapped)
+}
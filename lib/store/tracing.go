@@ -0,0 +1,29 @@
+package store
+
+import (
+	"context"
+
+	"github.com/xanderstrike/goplaxt/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	oteltrace "go.opentelemetry.io/otel/trace"
+)
+
+// startSpan starts a child span for a call out to a storage backend
+func startSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, oteltrace.Span) {
+	return tracing.Tracer.Start(
+		ctx,
+		name,
+		oteltrace.WithSpanKind(oteltrace.SpanKindClient),
+		oteltrace.WithAttributes(attrs...),
+	)
+}
+
+// endSpan marks the span as failed when err is set and ends it
+func endSpan(span oteltrace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
@@ -1,6 +1,7 @@
 package store
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"time"
@@ -9,7 +10,19 @@ import (
 )
 
 type store interface {
-	WriteUser(user User) error
+	WriteUser(ctx context.Context, user User) error
+}
+
+// legacyTokenLifetime is how long tokens were assumed to last for users
+// stored before their real expiry was kept
+const legacyTokenLifetime = 60 * 24 * time.Hour
+
+// Token is an OAuth token as handed out by Trakt
+type Token struct {
+	AccessToken  string
+	RefreshToken string
+	Scope        string
+	ExpiresAt    time.Time
 }
 
 // User object
@@ -18,8 +31,16 @@ type User struct {
 	Username     string
 	AccessToken  string
 	RefreshToken string
-	Updated      time.Time
-	store        store
+	Scope        string
+	// ExpiresAt is when the access token stops working, zero when unknown
+	ExpiresAt time.Time
+	Updated   time.Time
+	// Version changes on every compare and swap, so writers racing each other
+	// find out. Only WriteUser of a new user sets it
+	Version int64
+	store   store
+	// keyID is the key the tokens are encrypted with, empty when stored as plaintext
+	keyID string
 }
 
 func uuid() string {
@@ -33,31 +54,39 @@ func uuid() string {
 }
 
 // NewUser creates a new user object
-func NewUser(username, accessToken, refreshToken string, store store) (*User, error) {
+func NewUser(ctx context.Context, username string, token Token, store store) (*User, error) {
 	id := uuid()
 	user := User{
 		ID:           id,
 		Username:     username,
-		AccessToken:  accessToken,
-		RefreshToken: refreshToken,
+		AccessToken:  token.AccessToken,
+		RefreshToken: token.RefreshToken,
+		Scope:        token.Scope,
+		ExpiresAt:    token.ExpiresAt,
 		Updated:      time.Now(),
 		store:        store,
 	}
-	if err := user.save(); err != nil {
+	if err := user.save(ctx); err != nil {
 		return nil, trace.Wrap(err)
 	}
 	return &user, nil
 }
 
-// UpdateUser updates an existing user object
-func (user User) UpdateUser(accessToken, refreshToken string) {
-	user.AccessToken = accessToken
-	user.RefreshToken = refreshToken
-	user.Updated = time.Now()
+// NeedsRefresh tells if the access token expires within margin of now. Users
+// without a known expiry fall back to refreshing two months after the last update.
+func (user User) NeedsRefresh(now time.Time, margin time.Duration) bool {
+	expiresAt := user.ExpiresAt
+	if expiresAt.IsZero() {
+		expiresAt = user.Updated.Add(legacyTokenLifetime + margin)
+	}
+	return !now.Add(margin).Before(expiresAt)
+}
 
-	user.save()
+// Expired tells if the access token can no longer be used at all
+func (user User) Expired(now time.Time) bool {
+	return user.NeedsRefresh(now, 0)
 }
 
-func (user User) save() error {
-	return user.store.WriteUser(user)
+func (user User) save(ctx context.Context) error {
+	return user.store.WriteUser(ctx, user)
 }
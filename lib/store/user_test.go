@@ -0,0 +1,35 @@
+package store
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNeedsRefresh(t *testing.T) {
+	now := time.Date(2019, 02, 25, 12, 0, 0, 0, time.UTC)
+
+	user := User{ExpiresAt: now.Add(48 * time.Hour)}
+	assert.False(t, user.NeedsRefresh(now, 24*time.Hour))
+	assert.True(t, user.NeedsRefresh(now, 48*time.Hour))
+	assert.True(t, user.NeedsRefresh(now.Add(72*time.Hour), 0))
+
+	// Without a known expiry tokens are refreshed two months after the last update
+	legacy := User{Updated: now.Add(-59 * 24 * time.Hour)}
+	assert.False(t, legacy.NeedsRefresh(now, 24*time.Hour))
+	legacy.Updated = now.Add(-61 * 24 * time.Hour)
+	assert.True(t, legacy.NeedsRefresh(now, 24*time.Hour))
+}
+
+func TestExpired(t *testing.T) {
+	now := time.Date(2019, 02, 25, 12, 0, 0, 0, time.UTC)
+
+	user := User{ExpiresAt: now.Add(time.Hour)}
+	assert.False(t, user.Expired(now))
+	assert.True(t, user.Expired(now.Add(time.Hour)))
+
+	legacy := User{Updated: now.Add(-59 * 24 * time.Hour)}
+	assert.False(t, legacy.Expired(now))
+	assert.True(t, legacy.Expired(now.Add(48*time.Hour)))
+}
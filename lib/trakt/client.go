@@ -0,0 +1,293 @@
+package trakt
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/gravitational/trace"
+	log "github.com/sirupsen/logrus"
+)
+
+// DefaultBaseURL is the production trakt api
+const DefaultBaseURL = "https://api.trakt.tv"
+
+// defaultTokenTimeout bounds token requests of clients without a timeout
+const defaultTokenTimeout = 30 * time.Second
+
+// refreshSlack is how much longer than a token request a refresh claimed by
+// another replica is waited for, to cover saving the new tokens
+const refreshSlack = 10 * time.Second
+
+// Client talks to the trakt api, build it with NewClient
+type Client struct {
+	baseURL      string
+	httpClient   *http.Client
+	clientID     string
+	clientSecret string
+	userAgent    string
+	timeout      time.Duration
+	// limiter is nil when requests aren't rate limited
+	limiter *tokenBucket
+	// maxRetries is how often a failed request is sent again, waiting
+	// retryBackoff doubled on every attempt but never more than maxRetryWait
+	maxRetries   int
+	retryBackoff time.Duration
+	maxRetryWait time.Duration
+	// lateAfter is how old a webhook gets before it goes to the history
+	// instead of being scrobbled, zero scrobbles everything
+	lateAfter time.Duration
+	// settings are used for webhooks whose link doesn't set its own
+	settings ScrobbleSettings
+}
+
+// APIError is trakt answering with an unexpected status
+type APIError struct {
+	Method     string
+	Path       string
+	StatusCode int
+}
+
+// Error implements error
+func (e *APIError) Error() string {
+	return fmt.Sprintf("trakt %s %s failed with status %d", e.Method, e.Path, e.StatusCode)
+}
+
+// Option configures a Client
+type Option func(*Client)
+
+// WithBaseURL points the client at another trakt, like a test server
+func WithBaseURL(baseURL string) Option {
+	return func(c *Client) {
+		c.baseURL = baseURL
+	}
+}
+
+// WithHTTPClient sends requests through httpClient
+func WithHTTPClient(httpClient *http.Client) Option {
+	return func(c *Client) {
+		c.httpClient = httpClient
+	}
+}
+
+// WithCredentials sets the id and secret of the trakt application
+func WithCredentials(clientID, clientSecret string) Option {
+	return func(c *Client) {
+		c.clientID = clientID
+		c.clientSecret = clientSecret
+	}
+}
+
+// WithUserAgent sets the user agent sent along every request
+func WithUserAgent(userAgent string) Option {
+	return func(c *Client) {
+		c.userAgent = userAgent
+	}
+}
+
+// WithTimeout bounds how long a single request may take
+func WithTimeout(timeout time.Duration) Option {
+	return func(c *Client) {
+		c.timeout = timeout
+	}
+}
+
+// WithRateLimit lets at most perSecond requests a second through, in bursts of
+// up to burst, zero disables the limit
+func WithRateLimit(perSecond float64, burst int) Option {
+	return func(c *Client) {
+		c.limiter = nil
+		if perSecond > 0 {
+			c.limiter = newTokenBucket(perSecond, burst)
+		}
+	}
+}
+
+// WithRetries sends failed requests up to maxRetries more times, waiting
+// backoff before the first retry and twice as long before each following one
+func WithRetries(maxRetries int, backoff time.Duration) Option {
+	return func(c *Client) {
+		c.maxRetries = maxRetries
+		c.retryBackoff = backoff
+	}
+}
+
+// WithLateAfter adds completed watches older than lateAfter to the history at
+// the time they happened rather than scrobbling them, which trakt would record
+// as watched right now. Zero scrobbles every webhook however old it is
+func WithLateAfter(lateAfter time.Duration) Option {
+	return func(c *Client) {
+		c.lateAfter = lateAfter
+	}
+}
+
+// WithScrobbleSettings changes the scrobble settings of webhook links that
+// don't set their own
+func WithScrobbleSettings(settings ScrobbleSettings) Option {
+	return func(c *Client) {
+		c.settings = settings
+	}
+}
+
+// NewClient creates a trakt client, by default talking to DefaultBaseURL with a
+// 30 seconds timeout, 3 retries, staying under the trakt limit of 1000 calls
+// every 5 minutes, adding webhooks older than 10 minutes to the history and
+// using DefaultScrobbleSettings
+func NewClient(opts ...Option) *Client {
+	c := &Client{
+		baseURL:      DefaultBaseURL,
+		httpClient:   http.DefaultClient,
+		userAgent:    "goplaxt",
+		timeout:      30 * time.Second,
+		limiter:      newTokenBucket(3, 10),
+		maxRetries:   3,
+		retryBackoff: 500 * time.Millisecond,
+		maxRetryWait: time.Minute,
+		lateAfter:    10 * time.Minute,
+		settings:     DefaultScrobbleSettings,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	if c.timeout > 0 {
+		// Copied so the timeout doesn't leak into a shared client
+		httpClient := *c.httpClient
+		httpClient.Timeout = c.timeout
+		c.httpClient = &httpClient
+	}
+	return c
+}
+
+// tokenTimeout is the longest a token request takes
+func (c *Client) tokenTimeout() time.Duration {
+	if c.timeout > 0 {
+		return c.timeout
+	}
+	return defaultTokenTimeout
+}
+
+// refreshWait is how long a refresh claimed by another replica using the same
+// settings is waited for before it is taken over, so a claim is only taken
+// over once its token request can't succeed anymore
+func (c *Client) refreshWait() time.Duration {
+	return c.tokenTimeout() + refreshSlack
+}
+
+// newRequest prepares a request to the trakt api, path is relative to the base url
+func (c *Client) newRequest(ctx context.Context, method, path string, body []byte) (*http.Request, error) {
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.baseURL+path, reader)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	req.Header.Add("Content-Type", "application/json")
+	req.Header.Add("User-Agent", c.userAgent)
+	req.Header.Add("trakt-api-version", "2")
+	req.Header.Add("trakt-api-key", c.clientID)
+	return req, nil
+}
+
+// do sends req through the rate limit, retrying when it makes sense, and reads the whole response
+func (c *Client) do(req *http.Request) (*http.Response, []byte, error) {
+	ctx := req.Context()
+	for attempt := 0; ; attempt++ {
+		if attempt > 0 && req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, nil, trace.Wrap(err)
+			}
+			req.Body = body
+		}
+		if c.limiter != nil {
+			if err := c.limiter.wait(ctx); err != nil {
+				return nil, nil, trace.Wrap(err)
+			}
+		}
+
+		resp, respBody, err := c.send(req)
+		if resp != nil {
+			c.observeRateLimit(resp)
+		}
+		wait, retry := c.retryDelay(req, resp, err, attempt)
+		if !retry {
+			return resp, respBody, trace.Wrap(err)
+		}
+		logger := log.WithContext(ctx).WithFields(log.Fields{
+			"path":    req.URL.Path,
+			"attempt": attempt + 1,
+			"wait":    wait,
+		})
+		if err != nil {
+			logger.Warnf("trakt request failed, retrying: %v", err)
+		} else {
+			logger.WithField("status", resp.StatusCode).Warn("trakt request failed, retrying")
+		}
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return nil, nil, trace.Wrap(ctx.Err())
+		}
+	}
+}
+
+// send does a single round trip
+func (c *Client) send(req *http.Request) (*http.Response, []byte, error) {
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, nil, trace.Wrap(err)
+	}
+	defer resp.Body.Close()
+
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, trace.Wrap(err)
+	}
+	return resp, respBody, nil
+}
+
+// get fetches path from the trakt api
+func (c *Client) get(ctx context.Context, path string) ([]byte, error) {
+	req, err := c.newRequest(ctx, "GET", path, nil)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	resp, respBody, err := c.do(req)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	return respBody, trace.Wrap(checkStatus(req, resp))
+}
+
+// scrobble sends a scrobble action on behalf of the owner of accessToken
+func (c *Client) scrobble(ctx context.Context, action string, body []byte, accessToken string) ([]byte, error) {
+	return c.post(ctx, fmt.Sprintf("/scrobble/%s", action), body, accessToken)
+}
+
+// post sends body to path on behalf of the owner of accessToken
+func (c *Client) post(ctx context.Context, path string, body []byte, accessToken string) ([]byte, error) {
+	req, err := c.newRequest(ctx, "POST", path, body)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", accessToken))
+	resp, respBody, err := c.do(req)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	return respBody, trace.Wrap(checkStatus(req, resp))
+}
+
+// checkStatus turns anything but a 2xx answer into an APIError
+func checkStatus(req *http.Request, resp *http.Response) error {
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return &APIError{Method: req.Method, Path: req.URL.Path, StatusCode: resp.StatusCode}
+	}
+	return nil
+}
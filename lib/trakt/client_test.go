@@ -0,0 +1,47 @@
+package trakt
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClientSendsHeaders(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/search/movie", r.URL.Path)
+		assert.Equal(t, "Heat", r.URL.Query().Get("query"))
+		assert.Equal(t, "2", r.Header.Get("trakt-api-version"))
+		assert.Equal(t, "id123", r.Header.Get("trakt-api-key"))
+		assert.Equal(t, "goplaxt-test", r.Header.Get("User-Agent"))
+		w.Write([]byte(`[]`))
+	}))
+	defer server.Close()
+
+	client := NewClient(
+		WithBaseURL(server.URL),
+		WithCredentials("id123", "secret123"),
+		WithUserAgent("goplaxt-test"),
+	)
+	body, err := client.get(context.TODO(), "/search/movie?query=Heat")
+	require.NoError(t, err)
+	assert.Equal(t, "[]", string(body))
+}
+
+func TestClientTimeout(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+	}))
+	defer server.Close()
+
+	shared := &http.Client{}
+	client := NewClient(WithBaseURL(server.URL), WithHTTPClient(shared), WithTimeout(20*time.Millisecond), WithRetries(0, 0))
+	_, err := client.get(context.TODO(), "/")
+	assert.Error(t, err)
+	// The timeout only applies to the trakt client
+	assert.Zero(t, shared.Timeout)
+}
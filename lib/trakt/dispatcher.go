@@ -0,0 +1,384 @@
+package trakt
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/gravitational/trace"
+	log "github.com/sirupsen/logrus"
+	"github.com/xanderstrike/goplaxt/lib/store"
+	"github.com/xanderstrike/goplaxt/tracing"
+	"github.com/xanderstrike/plexhooks"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// settleTimeout bounds writing the outcome of a delivery to the queue
+const settleTimeout = 5 * time.Second
+
+// purgeInterval is how often dead jobs past DeadRetention are removed
+const purgeInterval = time.Hour
+
+var scrobbleDeliveries = tracing.Int64Counter(
+	"goplaxt.scrobble.deliveries",
+	"Queued scrobble deliveries, by outcome",
+)
+
+// Dispatcher delivers the scrobbles waiting in a queue to trakt, retrying the
+// ones that fail with backoff until they run out of attempts
+type Dispatcher struct {
+	queue   store.Queue
+	storage store.Store
+	client  *Client
+	// Workers is how many jobs are delivered at a time
+	Workers int
+	// MaxAttempts is how many deliveries a job gets before it is dead lettered
+	MaxAttempts int
+	// RetryBackoff is the delay after the first failed delivery, doubled on every further one
+	RetryBackoff time.Duration
+	// MaxBackoff caps the delay between two deliveries of a job
+	MaxBackoff time.Duration
+	// Poll is how often idle workers look for jobs enqueued by other replicas
+	Poll time.Duration
+	// Lease is how long a job stays hidden from other workers while it is delivered
+	Lease time.Duration
+	// DrainTimeout is how long deliveries in flight get to finish on shutdown
+	// before they are put back in the queue
+	DrainTimeout time.Duration
+	// Sessions drops webhooks that don't change the playback, nil sends every one
+	Sessions *SessionTracker
+	// DeadRetention is how long dead jobs are kept after they came in, zero keeps them forever
+	DeadRetention time.Duration
+	// IdleAfter is how long a playing session goes without a webhook before it
+	// is paused on trakt, zero never pauses. Plex sends nothing while an item
+	// plays on, so items playing for longer are paused too. It needs Sessions
+	IdleAfter time.Duration
+
+	now  func() time.Time
+	wake chan struct{}
+}
+
+// NewDispatcher creates a dispatcher with sensible defaults, taking jobs from
+// queue and delivering them through client for the users in storage
+func NewDispatcher(client *Client, storage store.Store, queue store.Queue) *Dispatcher {
+	return &Dispatcher{
+		queue:         queue,
+		storage:       storage,
+		client:        client,
+		Workers:       2,
+		MaxAttempts:   8,
+		RetryBackoff:  30 * time.Second,
+		MaxBackoff:    time.Hour,
+		Poll:          5 * time.Second,
+		Lease:         5 * time.Minute,
+		DrainTimeout:  10 * time.Second,
+		DeadRetention: 7 * 24 * time.Hour,
+		Sessions:      NewSessionTracker(store.NewMemorySessions()),
+		now:           time.Now,
+		wake:          make(chan struct{}, 1),
+	}
+}
+
+// Enqueue stores job and wakes a worker up to deliver it. Plays and resumes
+// get another job checking the session for a follow-up after IdleAfter.
+func (d *Dispatcher) Enqueue(ctx context.Context, job store.Job) error {
+	var pr plexhooks.PlexResponse
+	var idle *store.Job
+	if d.Sessions != nil {
+		var err error
+		if pr, err = plexhooks.ParseWebhook(job.Payload); err != nil {
+			return trace.BadParameter("unreadable webhook: %v", err)
+		}
+		job.RunAt = job.ReceivedAt.Add(d.Sessions.Delay(pr))
+		if d.IdleAfter > 0 && (pr.Event == "media.play" || pr.Event == "media.resume") {
+			payload, err := idlePayload(job.Payload)
+			if err != nil {
+				return trace.Wrap(err)
+			}
+			check := store.NewJob(job.UserID, job.Root, payload, job.ReceivedAt)
+			check.Settings = job.Settings
+			check.RunAt = job.ReceivedAt.Add(d.IdleAfter)
+			idle = &check
+		}
+	}
+	if err := d.queue.Enqueue(ctx, job); err != nil {
+		return trace.Wrap(err)
+	}
+	if d.Sessions != nil {
+		// Only a webhook that made it to the queue supersedes the ones held back before it
+		if err := d.Sessions.Observe(ctx, job.UserID, pr, job.ReceivedAt); err != nil {
+			log.WithContext(ctx).WithField("job", job.ID).Warnf("failed to observe webhook: %v", err)
+		}
+	}
+	if idle != nil {
+		// Losing the check only leaves trakt waiting for the runtime to run out
+		if err := d.queue.Enqueue(ctx, *idle); err != nil {
+			log.WithContext(ctx).WithField("job", job.ID).Warnf("failed to queue idle check: %v", err)
+		}
+	}
+	select {
+	case d.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Run delivers jobs until ctx is done, then waits for the deliveries in flight
+func (d *Dispatcher) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+	for i := 0; i < d.Workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			d.work(ctx)
+		}()
+	}
+	if d.DeadRetention > 0 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			d.purge(ctx)
+		}()
+	}
+	wg.Wait()
+}
+
+// purge removes the dead jobs past DeadRetention every purgeInterval until ctx is done
+func (d *Dispatcher) purge(ctx context.Context) {
+	ticker := time.NewTicker(purgeInterval)
+	defer ticker.Stop()
+	for {
+		purged, err := d.PurgeDead(ctx)
+		if err != nil && ctx.Err() == nil {
+			log.WithContext(ctx).Errorf("failed to purge dead scrobbles: %v", err)
+		} else if purged > 0 {
+			log.WithContext(ctx).WithField("purged", purged).Print("Purged dead scrobbles")
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// PurgeDead removes the dead jobs that came in more than DeadRetention ago,
+// returning how many
+func (d *Dispatcher) PurgeDead(ctx context.Context) (int, error) {
+	purged, err := d.queue.PurgeDead(ctx, d.now().Add(-d.DeadRetention))
+	return purged, trace.Wrap(err)
+}
+
+func (d *Dispatcher) work(ctx context.Context) {
+	for {
+		for ctx.Err() == nil {
+			found, err := d.RunOnce(ctx)
+			if err != nil && ctx.Err() == nil {
+				log.WithContext(ctx).Errorf("scrobble queue failed: %v", err)
+			}
+			if !found || err != nil {
+				break
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-d.wake:
+		case <-time.After(d.Poll):
+		}
+	}
+}
+
+// RunOnce delivers the job that has been due the longest, telling if there was one
+func (d *Dispatcher) RunOnce(ctx context.Context) (bool, error) {
+	job, err := d.queue.Claim(ctx, d.now(), d.Lease)
+	if trace.IsNotFound(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, trace.Wrap(err)
+	}
+
+	// Deliveries outlive ctx by up to DrainTimeout, so a shutdown doesn't cut them off halfway
+	deliverCtx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-done:
+			return
+		}
+		select {
+		case <-time.After(d.DrainTimeout):
+			cancel()
+		case <-done:
+		}
+	}()
+
+	deliverCtx, span := tracing.Tracer.Start(deliverCtx, "scrobble")
+	defer span.End()
+	logger := log.WithContext(deliverCtx).WithFields(log.Fields{
+		"job":      job.ID,
+		"user":     job.UserID,
+		"attempts": job.Attempts,
+	})
+	sent, err := d.deliver(deliverCtx, *job, logger)
+	return true, trace.Wrap(d.settle(deliverCtx, *job, sent, err, logger))
+}
+
+// deliver sends the webhook of job to trakt, unless the session tracker tells
+// it changes nothing
+func (d *Dispatcher) deliver(ctx context.Context, job store.Job, logger *log.Entry) (bool, error) {
+	pr, err := plexhooks.ParseWebhook(job.Payload)
+	if err != nil {
+		return false, trace.BadParameter("unreadable webhook: %v", err)
+	}
+	if d.Sessions != nil {
+		send, err := d.Sessions.Track(ctx, job.UserID, pr, job.ReceivedAt)
+		if err != nil || !send {
+			return false, trace.Wrap(err)
+		}
+	}
+	user, err := d.storage.GetUser(ctx, job.UserID)
+	if err != nil {
+		return false, trace.Wrap(err)
+	}
+	query, err := url.ParseQuery(job.Settings)
+	if err != nil {
+		return false, trace.BadParameter("unreadable settings: %v", err)
+	}
+	settings, err := d.client.settings.Override(query)
+	if err != nil {
+		return false, trace.Wrap(err)
+	}
+	receivedAt := job.ReceivedAt
+	if pr.Event == idleEvent {
+		// The pause happens now, the play it carries the progress of is long gone
+		receivedAt = d.now()
+	}
+	// The webhook handler refreshed the token already, only refresh again once it expired
+	tokens := NewTokenManager(d.client, d.storage, job.Root, 0)
+	if d.Sessions != nil && (pr.Event == "media.play" || pr.Event == "media.resume") {
+		left, err := d.Sessions.Play(ctx, job.UserID, pr, job.Payload, job.ReceivedAt)
+		if err != nil {
+			return false, trace.Wrap(err)
+		}
+		if left != nil {
+			// Trakt keeps showing the item the player moved on from until it is paused
+			d.pauseLeft(ctx, job.UserID, left, settings, *user, tokens, logger)
+		}
+	}
+	event, err := d.client.Handle(ctx, pr, receivedAt, settings, *user, tokens, logger)
+	if err != nil {
+		return true, trace.Wrap(err)
+	}
+	if d.Sessions != nil && pr.Event == "media.scrobble" && event == "pause" {
+		if err := d.Sessions.Unfinished(ctx, job.UserID, pr, job.ReceivedAt); err != nil {
+			// Only the stop to come gets dropped, trakt keeps the item paused
+			logger.Warnf("failed to record unfinished scrobble: %v", err)
+		}
+	}
+	return true, nil
+}
+
+// pauseLeft pauses the item a player moved on from at the progress of the
+// webhook that started it, unless it was paused or stopped since
+func (d *Dispatcher) pauseLeft(ctx context.Context, userID string, payload []byte, settings ScrobbleSettings, user store.User, tokens *TokenManager, logger *log.Entry) {
+	pr, err := plexhooks.ParseWebhook(payload)
+	if err != nil {
+		logger.Warnf("unreadable webhook of the item the player left: %v", err)
+		return
+	}
+	pr.Event = idleEvent
+	now := d.now()
+	send, err := d.Sessions.Track(ctx, userID, pr, now)
+	if err != nil {
+		logger.Warnf("failed to track the item the player left: %v", err)
+		return
+	}
+	if !send {
+		return
+	}
+	// Failing only leaves trakt showing the item until the new one starts or its runtime is over
+	if _, err := d.client.Handle(ctx, pr, now, settings, user, tokens, logger); err != nil {
+		logger.Warnf("failed to pause the item the player left: %v", err)
+	}
+}
+
+// settle records the outcome of a delivery made with ctx in the queue. The
+// queue is written with a context of its own, ctx is cancelled once a shutdown
+// ran out of DrainTimeout, even after a delivery that made it.
+func (d *Dispatcher) settle(ctx context.Context, job store.Job, sent bool, err error, logger *log.Entry) error {
+	outcome := "delivered"
+	defer func() { scrobbleDeliveries.Add(ctx, 1, attribute.String("outcome", outcome)) }()
+	queueCtx, cancel := context.WithTimeout(context.Background(), settleTimeout)
+	defer cancel()
+
+	switch {
+	case err == nil && !sent:
+		outcome = "suppressed"
+		logger.Debug("webhook changes nothing, not sending it")
+		return trace.Wrap(d.queue.Complete(queueCtx, job))
+	case err == nil || isConflict(err):
+		return trace.Wrap(d.queue.Complete(queueCtx, job))
+	case trace.IsNotFound(err):
+		outcome = "dropped"
+		logger.Warnf("user is gone, dropping scrobble: %v", err)
+		return trace.Wrap(d.queue.Complete(queueCtx, job))
+	case ctx.Err() != nil:
+		// Shutting down, the attempt doesn't count
+		outcome = "requeued"
+		logger.Warnf("scrobble interrupted, requeueing: %v", err)
+		job.RunAt = d.now()
+		return trace.Wrap(d.queue.Release(queueCtx, job))
+	}
+
+	job.Attempts++
+	job.LastError = err.Error()
+	if permanent(err) || job.Attempts >= d.MaxAttempts {
+		outcome = "dead"
+		job.Dead = true
+		logger.WithField("attempts", job.Attempts).Errorf("giving up on scrobble: %v", err)
+		return trace.Wrap(d.queue.Release(queueCtx, job))
+	}
+	outcome = "retry"
+	job.RunAt = d.now().Add(d.backoff(job.Attempts))
+	logger.WithField("attempts", job.Attempts).WithField("retryAt", job.RunAt).Warnf("scrobble failed, will retry: %v", err)
+	return trace.Wrap(d.queue.Release(queueCtx, job))
+}
+
+// backoff is the delay before the next delivery of a job that failed attempts times
+func (d *Dispatcher) backoff(attempts int) time.Duration {
+	backoff := d.RetryBackoff << uint(attempts-1)
+	if backoff > d.MaxBackoff || backoff <= 0 {
+		backoff = d.MaxBackoff
+	}
+	return backoff
+}
+
+// permanent tells if retrying a delivery that failed with err can't help
+func permanent(err error) bool {
+	if IsUnmatched(err) || IsInvalidGrant(err) || trace.IsBadParameter(err) {
+		return true
+	}
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		switch apiErr.StatusCode {
+		case http.StatusUnauthorized, http.StatusRequestTimeout, http.StatusTooManyRequests:
+			return false
+		}
+		return apiErr.StatusCode >= 400 && apiErr.StatusCode < 500
+	}
+	return false
+}
+
+// isConflict tells if trakt turned the scrobble down because it already has it
+func isConflict(err error) bool {
+	var apiErr *APIError
+	return errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusConflict
+}
@@ -0,0 +1,449 @@
+package trakt
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gravitational/trace"
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/xanderstrike/goplaxt/lib/store"
+)
+
+// queuedTrakt finds Heat and answers scrobbles with status, holding them
+// until release is closed when it is set
+type queuedTrakt struct {
+	mu        sync.Mutex
+	status    int
+	scrobbles int
+	pauses    int
+	stops     int
+	held      chan struct{}
+	release   chan struct{}
+}
+
+func (f *queuedTrakt) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/search/movie":
+		json.NewEncoder(w).Encode([]MovieSearchResult{{Movie: Movie{Title: "Heat", Year: 1995, Ids: Ids{Trakt: 1}}}})
+	case "/search/imdb/tt0000000":
+		json.NewEncoder(w).Encode([]MovieSearchResult{})
+	case "/scrobble/start":
+		if f.release != nil {
+			f.held <- struct{}{}
+			select {
+			case <-f.release:
+			case <-r.Context().Done():
+				return
+			}
+		}
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		f.scrobbles++
+		w.WriteHeader(f.status)
+	case "/scrobble/pause":
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		f.pauses++
+		w.WriteHeader(f.status)
+	case "/scrobble/stop":
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		f.stops++
+		w.WriteHeader(f.status)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+const heatPlay = `{"event":"media.play","Account":{"title":"halkeye"},"Metadata":{"librarySectionType":"movie","title":"Heat","year":1995,"duration":10000}}`
+
+func newTestDispatcher(t *testing.T, status int) (*Dispatcher, *queuedTrakt, *store.DiskStore, *time.Time) {
+	fake := &queuedTrakt{status: status}
+	server := serveTokens(t, fake.ServeHTTP)
+	client := NewClient(WithBaseURL(server.baseURL), WithRetries(0, 0))
+	storage, _ := newTokenTestUser(t, time.Now().Add(24*time.Hour))
+	disk := storage.(*store.DiskStore)
+
+	now := time.Now()
+	dispatcher := NewDispatcher(client, disk, disk)
+	dispatcher.now = func() time.Time { return now }
+	return dispatcher, fake, disk, &now
+}
+
+func enqueue(t *testing.T, d *Dispatcher, payload string) store.Job {
+	job := store.NewJob("id123", "https://plaxt.example.com", []byte(payload), d.now())
+	require.NoError(t, d.Enqueue(context.TODO(), job))
+	return job
+}
+
+func TestDispatcherDelivers(t *testing.T) {
+	dispatcher, fake, queue, _ := newTestDispatcher(t, http.StatusCreated)
+	enqueue(t, dispatcher, heatPlay)
+
+	found, err := dispatcher.RunOnce(context.TODO())
+	require.NoError(t, err)
+	assert.True(t, found)
+	assert.Equal(t, 1, fake.scrobbles)
+
+	_, err = queue.Claim(context.TODO(), time.Now().Add(time.Hour), time.Minute)
+	assert.True(t, trace.IsNotFound(err), "expected the job to be gone, got %v", err)
+
+	found, err = dispatcher.RunOnce(context.TODO())
+	require.NoError(t, err)
+	assert.False(t, found)
+}
+
+func TestDispatcherRetriesThenDeadLetters(t *testing.T) {
+	dispatcher, fake, queue, now := newTestDispatcher(t, http.StatusServiceUnavailable)
+	dispatcher.MaxAttempts = 2
+	enqueue(t, dispatcher, heatPlay)
+
+	found, err := dispatcher.RunOnce(context.TODO())
+	require.NoError(t, err)
+	assert.True(t, found)
+
+	// Backing off
+	found, err = dispatcher.RunOnce(context.TODO())
+	require.NoError(t, err)
+	assert.False(t, found)
+
+	*now = now.Add(dispatcher.RetryBackoff)
+	found, err = dispatcher.RunOnce(context.TODO())
+	require.NoError(t, err)
+	assert.True(t, found)
+	assert.Equal(t, 2, fake.scrobbles)
+
+	dead, err := queue.DeadJobs(context.TODO(), 10)
+	require.NoError(t, err)
+	require.Len(t, dead, 1)
+	assert.Equal(t, 2, dead[0].Attempts)
+	assert.Contains(t, dead[0].LastError, "503")
+}
+
+func TestDispatcherDeadLettersUnmatched(t *testing.T) {
+	dispatcher, fake, queue, _ := newTestDispatcher(t, http.StatusCreated)
+	enqueue(t, dispatcher, `{"event":"media.play","Metadata":{"librarySectionType":"movie","title":"Nope","Guid":[{"id":"imdb://tt0000000"}]}}`)
+
+	_, err := dispatcher.RunOnce(context.TODO())
+	require.NoError(t, err)
+	assert.Equal(t, 0, fake.scrobbles)
+
+	dead, err := queue.DeadJobs(context.TODO(), 10)
+	require.NoError(t, err)
+	require.Len(t, dead, 1)
+	assert.Equal(t, 1, dead[0].Attempts)
+}
+
+func TestDispatcherPurgesDeadJobs(t *testing.T) {
+	dispatcher, _, queue, now := newTestDispatcher(t, http.StatusCreated)
+	enqueue(t, dispatcher, `{"event":"media.play","Metadata":{"librarySectionType":"movie","title":"Nope","Guid":[{"id":"imdb://tt0000000"}]}}`)
+	_, err := dispatcher.RunOnce(context.TODO())
+	require.NoError(t, err)
+
+	purged, err := dispatcher.PurgeDead(context.TODO())
+	require.NoError(t, err)
+	assert.Equal(t, 0, purged)
+
+	*now = now.Add(dispatcher.DeadRetention + time.Second)
+	purged, err = dispatcher.PurgeDead(context.TODO())
+	require.NoError(t, err)
+	assert.Equal(t, 1, purged)
+	dead, err := queue.DeadJobs(context.TODO(), 10)
+	require.NoError(t, err)
+	assert.Empty(t, dead)
+}
+
+func TestDispatcherDropsDeletedUsers(t *testing.T) {
+	dispatcher, fake, queue, _ := newTestDispatcher(t, http.StatusCreated)
+	enqueue(t, dispatcher, heatPlay)
+	_, err := queue.DeleteUser(context.TODO(), "id123")
+	require.NoError(t, err)
+
+	_, err = dispatcher.RunOnce(context.TODO())
+	require.NoError(t, err)
+	assert.Equal(t, 0, fake.scrobbles)
+
+	dead, err := queue.DeadJobs(context.TODO(), 10)
+	require.NoError(t, err)
+	assert.Empty(t, dead)
+}
+
+func TestDispatcherRequeuesOnShutdown(t *testing.T) {
+	dispatcher, fake, queue, now := newTestDispatcher(t, http.StatusCreated)
+	fake.held = make(chan struct{}, 1)
+	fake.release = make(chan struct{})
+	t.Cleanup(func() { close(fake.release) })
+	dispatcher.DrainTimeout = 50 * time.Millisecond
+	job := enqueue(t, dispatcher, heatPlay)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		dispatcher.Run(ctx)
+		close(stopped)
+	}()
+	// Shut down while the scrobble is stuck on trakt
+	<-fake.held
+	cancel()
+
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("dispatcher did not stop")
+	}
+	requeued, err := queue.Claim(context.TODO(), *now, time.Minute)
+	require.NoError(t, err)
+	assert.Equal(t, job.ID, requeued.ID)
+	assert.Equal(t, 0, requeued.Attempts)
+}
+
+func TestDispatcherDebouncesPauses(t *testing.T) {
+	dispatcher, fake, _, now := newTestDispatcher(t, http.StatusCreated)
+	enqueue(t, dispatcher, heatPlay)
+	*now = now.Add(time.Second)
+	enqueue(t, dispatcher, heatPlay)
+
+	for i := 0; i < 2; i++ {
+		found, err := dispatcher.RunOnce(context.TODO())
+		require.NoError(t, err)
+		assert.True(t, found)
+	}
+	assert.Equal(t, 1, fake.scrobbles, "the repeated play should have been dropped")
+
+	*now = now.Add(time.Second)
+	enqueue(t, dispatcher, strings.Replace(heatPlay, "media.play", "media.pause", 1))
+	found, err := dispatcher.RunOnce(context.TODO())
+	require.NoError(t, err)
+	assert.False(t, found, "the pause should be held back")
+
+	*now = now.Add(dispatcher.Sessions.Debounce)
+	found, err = dispatcher.RunOnce(context.TODO())
+	require.NoError(t, err)
+	assert.True(t, found)
+}
+
+func TestDispatcherPausesIdleSessions(t *testing.T) {
+	dispatcher, fake, _, now := newTestDispatcher(t, http.StatusCreated)
+	dispatcher.IdleAfter = time.Hour
+	enqueue(t, dispatcher, heatPlay)
+
+	found, err := dispatcher.RunOnce(context.TODO())
+	require.NoError(t, err)
+	assert.True(t, found)
+	found, err = dispatcher.RunOnce(context.TODO())
+	require.NoError(t, err)
+	assert.False(t, found, "the idle check should wait for IdleAfter")
+
+	*now = now.Add(dispatcher.IdleAfter)
+	found, err = dispatcher.RunOnce(context.TODO())
+	require.NoError(t, err)
+	assert.True(t, found)
+	assert.Equal(t, 1, fake.scrobbles)
+	assert.Equal(t, 1, fake.pauses)
+}
+
+func TestDispatcherKeepsActiveSessions(t *testing.T) {
+	dispatcher, fake, _, now := newTestDispatcher(t, http.StatusCreated)
+	dispatcher.IdleAfter = time.Hour
+	enqueue(t, dispatcher, heatPlay)
+	*now = now.Add(time.Minute)
+	heatStop := strings.Replace(heatPlay, `"media.play"`, `"media.stop"`, 1)
+	enqueue(t, dispatcher, strings.Replace(heatStop, `"duration"`, `"viewOffset":9500,"duration"`, 1))
+
+	*now = now.Add(dispatcher.IdleAfter)
+	for i := 0; i < 3; i++ {
+		found, err := dispatcher.RunOnce(context.TODO())
+		require.NoError(t, err)
+		assert.True(t, found)
+	}
+	assert.Equal(t, 1, fake.stops)
+	assert.Equal(t, 0, fake.pauses)
+}
+
+func TestDispatcherPausesTheItemAPlayerLeft(t *testing.T) {
+	dispatcher, fake, _, now := newTestDispatcher(t, http.StatusCreated)
+	heatOnPlayer := strings.Replace(heatPlay, `"Metadata":{`, `"Player":{"uuid":"player123"},"Metadata":{"ratingKey":"59852",`, 1)
+	enqueue(t, dispatcher, heatOnPlayer)
+	_, err := dispatcher.RunOnce(context.TODO())
+	require.NoError(t, err)
+
+	// The player crashed and started Heat again as another item, like another version of it
+	*now = now.Add(time.Minute)
+	enqueue(t, dispatcher, strings.Replace(heatOnPlayer, `"59852"`, `"60123"`, 1))
+	_, err = dispatcher.RunOnce(context.TODO())
+	require.NoError(t, err)
+	assert.Equal(t, 2, fake.scrobbles)
+	assert.Equal(t, 1, fake.pauses, "the item the player left should be paused")
+
+	// Another player is left alone
+	*now = now.Add(time.Minute)
+	enqueue(t, dispatcher, strings.Replace(heatOnPlayer, `"player123"`, `"player456"`, 1))
+	_, err = dispatcher.RunOnce(context.TODO())
+	require.NoError(t, err)
+	assert.Equal(t, 3, fake.scrobbles)
+	assert.Equal(t, 1, fake.pauses)
+}
+
+func TestDispatcherUsesWebhookSettings(t *testing.T) {
+	dispatcher, fake, _, _ := newTestDispatcher(t, http.StatusCreated)
+	heatStop := strings.Replace(heatPlay, `"media.play"`, `"media.stop"`, 1)
+	job := store.NewJob("id123", "https://plaxt.example.com", []byte(strings.Replace(heatStop, `"duration"`, `"viewOffset":9500,"duration"`, 1)), dispatcher.now())
+	job.Settings = "watched=99"
+	require.NoError(t, dispatcher.Enqueue(context.TODO(), job))
+
+	found, err := dispatcher.RunOnce(context.TODO())
+	require.NoError(t, err)
+	assert.True(t, found)
+	assert.Equal(t, 0, fake.stops)
+	assert.Equal(t, 1, fake.pauses, "95% is short of the watched threshold of the link")
+}
+
+// failingQueue refuses new jobs while failing is set
+type failingQueue struct {
+	*store.DiskStore
+	failing bool
+}
+
+func (q *failingQueue) Enqueue(ctx context.Context, job store.Job) error {
+	if q.failing {
+		return trace.ConnectionProblem(nil, "queue is down")
+	}
+	return q.DiskStore.Enqueue(ctx, job)
+}
+
+func TestDispatcherKeepsPauseWhenNextWebhookIsLost(t *testing.T) {
+	dispatcher, fake, disk, now := newTestDispatcher(t, http.StatusCreated)
+	queue := &failingQueue{DiskStore: disk}
+	dispatcher.queue = queue
+	enqueue(t, dispatcher, heatPlay)
+	_, err := dispatcher.RunOnce(context.TODO())
+	require.NoError(t, err)
+
+	*now = now.Add(time.Minute)
+	enqueue(t, dispatcher, strings.Replace(heatPlay, `"media.play"`, `"media.pause"`, 1))
+	*now = now.Add(time.Second)
+	queue.failing = true
+	job := store.NewJob("id123", "https://plaxt.example.com", []byte(strings.Replace(heatPlay, `"media.play"`, `"media.resume"`, 1)), dispatcher.now())
+	assert.Error(t, dispatcher.Enqueue(context.TODO(), job))
+
+	// Plex gets an error for the resume, so the pause it didn't queue is still sent
+	*now = now.Add(dispatcher.Sessions.Debounce)
+	found, err := dispatcher.RunOnce(context.TODO())
+	require.NoError(t, err)
+	assert.True(t, found)
+	assert.Equal(t, 1, fake.pauses)
+}
+
+// postgresQueue keeps jobs in sqlite, rounding their times to microseconds the
+// way postgres timestamps do
+type postgresQueue struct {
+	store.SQLiteStore
+}
+
+func (q postgresQueue) Enqueue(ctx context.Context, job store.Job) error {
+	job.ReceivedAt = job.ReceivedAt.Round(time.Microsecond)
+	job.RunAt = job.RunAt.Round(time.Microsecond)
+	return q.SQLiteStore.Enqueue(ctx, job)
+}
+
+func TestDispatcherStopsAfterScrobble(t *testing.T) {
+	tests := []struct {
+		name     string
+		settings string
+		pauses   int
+		stops    int
+	}{
+		{"Watched", "", 0, 1},
+		{"Short of the threshold", "watched=95", 1, 1},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			dispatcher, fake, _, now := newTestDispatcher(t, http.StatusCreated)
+			heatScrobble := strings.Replace(heatPlay, `"media.play"`, `"media.scrobble"`, 1)
+			heatStop := strings.Replace(heatPlay, `"media.play"`, `"media.stop"`, 1)
+			// Plex scrobbles at 90%, the stop comes at the credits
+			for _, payload := range []string{
+				strings.Replace(heatScrobble, `"duration"`, `"viewOffset":9000,"duration"`, 1),
+				strings.Replace(heatStop, `"duration"`, `"viewOffset":9600,"duration"`, 1),
+			} {
+				job := store.NewJob("id123", "https://plaxt.example.com", []byte(payload), dispatcher.now())
+				job.Settings = test.settings
+				require.NoError(t, dispatcher.Enqueue(context.TODO(), job))
+				found, err := dispatcher.RunOnce(context.TODO())
+				require.NoError(t, err)
+				assert.True(t, found)
+				*now = now.Add(time.Minute)
+			}
+			assert.Equal(t, test.pauses, fake.pauses)
+			assert.Equal(t, test.stops, fake.stops)
+		})
+	}
+}
+
+// newSQLDispatcher is a test dispatcher queueing its jobs the way postgres
+// does, its clock between two microseconds
+func newSQLDispatcher(t *testing.T) (*Dispatcher, *queuedTrakt, *time.Time) {
+	dispatcher, fake, _, now := newTestDispatcher(t, http.StatusCreated)
+	db, err := store.OpenSQLite(context.TODO(), filepath.Join(t.TempDir(), "goplaxt.db"))
+	require.NoError(t, err)
+	t.Cleanup(func() { db.Close() })
+	dispatcher.queue = postgresQueue{store.NewSQLiteStore(db)}
+	// The sessions keep the time as the webhook handler saw it, which the database rounds down
+	*now = now.Truncate(time.Microsecond).Add(200 * time.Nanosecond)
+	return dispatcher, fake, now
+}
+
+func TestDispatcherSessionsThroughSQL(t *testing.T) {
+	dispatcher, fake, now := newSQLDispatcher(t)
+	enqueue(t, dispatcher, heatPlay)
+	*now = now.Add(time.Second)
+	enqueue(t, dispatcher, strings.Replace(heatPlay, "media.play", "media.pause", 1))
+
+	*now = now.Add(dispatcher.Sessions.Debounce)
+	for i := 0; i < 2; i++ {
+		found, err := dispatcher.RunOnce(context.TODO())
+		require.NoError(t, err)
+		assert.True(t, found)
+	}
+	assert.Equal(t, 1, fake.scrobbles)
+	assert.Equal(t, 1, fake.pauses, "the pause must not be superseded by its own webhook")
+}
+
+func TestDispatcherPausesIdleSessionsThroughSQL(t *testing.T) {
+	dispatcher, fake, now := newSQLDispatcher(t)
+	dispatcher.IdleAfter = time.Hour
+	enqueue(t, dispatcher, heatPlay)
+
+	*now = now.Add(dispatcher.IdleAfter)
+	for i := 0; i < 2; i++ {
+		found, err := dispatcher.RunOnce(context.TODO())
+		require.NoError(t, err)
+		assert.True(t, found)
+	}
+	assert.Equal(t, 1, fake.scrobbles)
+	assert.Equal(t, 1, fake.pauses, "the idle check must not be superseded by the play it checks")
+}
+
+func TestDispatcherSettlesAfterDrainTimeout(t *testing.T) {
+	dispatcher, _, queue, now := newTestDispatcher(t, http.StatusCreated)
+	enqueue(t, dispatcher, heatPlay)
+	job, err := queue.Claim(context.TODO(), *now, dispatcher.Lease)
+	require.NoError(t, err)
+
+	// The scrobble made it to trakt just as the shutdown cut the delivery off
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	require.NoError(t, dispatcher.settle(ctx, *job, true, nil, log.NewEntry(log.New())))
+
+	_, err = queue.Claim(context.TODO(), now.Add(time.Hour), time.Minute)
+	assert.True(t, trace.IsNotFound(err), "expected the job to be gone, got %v", err)
+}
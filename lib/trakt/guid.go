@@ -0,0 +1,171 @@
+package trakt
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/xanderstrike/plexhooks"
+)
+
+// movieGuidPriority is the order providers are asked for a movie, imdb ids
+// are the least ambiguous and every trakt movie has one
+var movieGuidPriority = []string{"imdb", "tmdb", "tvdb"}
+
+// episodeGuidPriority is the order providers are asked for an episode, tvdb
+// knows the most episodes while imdb often only has the show
+var episodeGuidPriority = []string{"tvdb", "tmdb", "imdb"}
+
+// legacyAgents maps the providers of the old com.plexapp.agents.* agents to the
+// trakt names. thetvdbdvdorder numbers the episodes the way the dvds do, which
+// trakt doesn't know, so it keeps a provider of its own that is never looked up.
+var legacyAgents = map[string]string{
+	"imdb":            "imdb",
+	"themoviedb":      "tmdb",
+	"thetvdb":         "tvdb",
+	"thetvdbdvdorder": "tvdbdvd",
+}
+
+// Guid is a metadata provider and the id it knows an item by, like imdb and tt0113277
+type Guid struct {
+	Provider string
+	ID       string
+	// Season and Episode are set when a legacy agent points at an episode of
+	// the show ID instead of at the episode itself
+	Season  int
+	Episode int
+	episode bool
+}
+
+// IsEpisode tells if the guid is a show's with the position of one of its episodes
+func (g Guid) IsEpisode() bool {
+	return g.episode
+}
+
+// String formats the guid the way the new plex agents send it
+func (g Guid) String() string {
+	if g.episode {
+		return fmt.Sprintf("%s://%s/%d/%d", g.Provider, g.ID, g.Season, g.Episode)
+	}
+	return g.Provider + "://" + g.ID
+}
+
+// parseGuid reads the guids plex sends, both the provider://id ones of the new
+// agents and the com.plexapp.agents.<agent>://id/season/episode?lang=en ones of
+// the legacy agents, including hama's tvdb-12345 style ids
+func parseGuid(uri string) (Guid, bool) {
+	parts := strings.SplitN(uri, "://", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return Guid{}, false
+	}
+	scheme, rest := strings.ToLower(parts[0]), parts[1]
+	if i := strings.IndexAny(rest, "?#"); i >= 0 {
+		rest = rest[:i]
+	}
+	if !strings.HasPrefix(scheme, "com.plexapp.agents.") {
+		if rest == "" {
+			return Guid{}, false
+		}
+		return Guid{Provider: scheme, ID: rest}, true
+	}
+
+	agent := strings.TrimPrefix(scheme, "com.plexapp.agents.")
+	segments := strings.Split(rest, "/")
+	guid := Guid{Provider: agent, ID: segments[0]}
+	if provider, ok := legacyAgents[agent]; ok {
+		guid.Provider = provider
+	}
+	if agent == "hama" {
+		guid.Provider, guid.ID = parseHamaID(segments[0])
+	}
+	if guid.ID == "" {
+		return Guid{}, false
+	}
+	if len(segments) >= 3 {
+		season, seasonErr := strconv.Atoi(segments[1])
+		episode, episodeErr := strconv.Atoi(segments[2])
+		if seasonErr != nil || episodeErr != nil {
+			return Guid{}, false
+		}
+		guid.Season, guid.Episode, guid.episode = season, episode, true
+	}
+	return guid, true
+}
+
+// parseHamaID splits the ids of the hama anime agent, like anidb-123 or
+// tvdb-81797, into the provider and its id
+func parseHamaID(id string) (string, string) {
+	parts := strings.SplitN(id, "-", 2)
+	if len(parts) != 2 {
+		return "hama", id
+	}
+	// tvdb2 to tvdb5 are tvdb ids with the episodes numbered differently, like
+	// absolutely, so they keep their own provider that trakt doesn't look up
+	return strings.ToLower(parts[0]), parts[1]
+}
+
+// externalGuids returns the guids of an item trakt knows the providers of, in
+// the order of priority. The guid of a legacy agent counts as well as long as
+// it points at the item itself.
+func externalGuids(metadata plexhooks.Metadata, priority []string) []Guid {
+	byProvider := make(map[string]Guid)
+	add := func(uri string) {
+		guid, ok := parseGuid(uri)
+		if _, seen := byProvider[guid.Provider]; ok && !seen && !guid.IsEpisode() {
+			byProvider[guid.Provider] = guid
+		}
+	}
+	for _, external := range metadata.ExternalGuid {
+		add(external.Id)
+	}
+	add(metadata.Guid)
+
+	var guids []Guid
+	for _, provider := range priority {
+		if guid, ok := byProvider[provider]; ok {
+			guids = append(guids, guid)
+		}
+	}
+	return guids
+}
+
+// legacyEpisodeGuid returns the show and episode position a legacy tv agent
+// sends, only the providers trakt can look shows up by are of any use
+func legacyEpisodeGuid(metadata plexhooks.Metadata) (Guid, bool) {
+	guid, ok := parseGuid(metadata.Guid)
+	if !ok || !guid.IsEpisode() {
+		return Guid{}, false
+	}
+	for _, provider := range episodeGuidPriority {
+		if guid.Provider == provider {
+			return guid, true
+		}
+	}
+	return Guid{}, false
+}
+
+// UnmatchedError is returned when trakt knows none of the guids plex sent for an item
+type UnmatchedError struct {
+	// Type is movie or episode
+	Type  string
+	Title string
+	Guids []Guid
+}
+
+func (e *UnmatchedError) Error() string {
+	if len(e.Guids) == 0 {
+		return fmt.Sprintf("no trakt %s for %s, plex sent no usable guid", e.Type, e.Title)
+	}
+	guids := make([]string, len(e.Guids))
+	for i, guid := range e.Guids {
+		guids[i] = guid.String()
+	}
+	return fmt.Sprintf("no trakt %s for %s with guids %s", e.Type, e.Title, strings.Join(guids, ", "))
+}
+
+// IsUnmatched tells if err is trakt not knowing the item played
+func IsUnmatched(err error) bool {
+	var unmatched *UnmatchedError
+	return errors.As(err, &unmatched)
+}
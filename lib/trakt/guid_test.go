@@ -0,0 +1,72 @@
+package trakt
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/xanderstrike/plexhooks"
+)
+
+func TestParseGuid(t *testing.T) {
+	tests := []struct {
+		uri      string
+		expected Guid
+		ok       bool
+	}{
+		{"imdb://tt0113277", Guid{Provider: "imdb", ID: "tt0113277"}, true},
+		{"tmdb://949", Guid{Provider: "tmdb", ID: "949"}, true},
+		{"tvdb://3254641", Guid{Provider: "tvdb", ID: "3254641"}, true},
+		{"plex://movie/5d776825880197001ec967c6", Guid{Provider: "plex", ID: "movie/5d776825880197001ec967c6"}, true},
+		{"com.plexapp.agents.imdb://tt0113277?lang=en", Guid{Provider: "imdb", ID: "tt0113277"}, true},
+		{"com.plexapp.agents.themoviedb://949?lang=en", Guid{Provider: "tmdb", ID: "949"}, true},
+		{"com.plexapp.agents.thetvdb://12345/2/5?lang=en", Guid{Provider: "tvdb", ID: "12345", Season: 2, Episode: 5, episode: true}, true},
+		{"com.plexapp.agents.thetvdbdvdorder://12345/2/5?lang=en", Guid{Provider: "tvdbdvd", ID: "12345", Season: 2, Episode: 5, episode: true}, true},
+		{"com.plexapp.agents.hama://tvdb-81797/1/5?lang=en", Guid{Provider: "tvdb", ID: "81797", Season: 1, Episode: 5, episode: true}, true},
+		{"com.plexapp.agents.hama://tvdb3-81797/1/5?lang=en", Guid{Provider: "tvdb3", ID: "81797", Season: 1, Episode: 5, episode: true}, true},
+		{"com.plexapp.agents.hama://anidb-1234?lang=en", Guid{Provider: "anidb", ID: "1234"}, true},
+		{"com.plexapp.agents.none://35f4?lang=xn", Guid{Provider: "none", ID: "35f4"}, true},
+		{"com.plexapp.agents.thetvdb://12345/two/5", Guid{}, false},
+		{"tt0113277", Guid{}, false},
+		{"imdb://", Guid{}, false},
+		{"", Guid{}, false},
+	}
+	for _, test := range tests {
+		guid, ok := parseGuid(test.uri)
+		assert.Equal(t, test.ok, ok, test.uri)
+		assert.Equal(t, test.expected, guid, test.uri)
+	}
+}
+
+func TestExternalGuids(t *testing.T) {
+	metadata := plexhooks.Metadata{
+		Guid: "plex://movie/5d776825880197001ec967c6",
+		ExternalGuid: []plexhooks.ExternalGuid{
+			{Id: "tmdb://949"},
+			{Id: "garbage"},
+			{Id: "imdb://tt0113277"},
+			{Id: "imdb://tt9999999"},
+		},
+	}
+	assert.Equal(t, []Guid{{Provider: "imdb", ID: "tt0113277"}, {Provider: "tmdb", ID: "949"}}, externalGuids(metadata, movieGuidPriority))
+
+	legacyMovie := plexhooks.Metadata{Guid: "com.plexapp.agents.imdb://tt0113277?lang=en"}
+	assert.Equal(t, []Guid{{Provider: "imdb", ID: "tt0113277"}}, externalGuids(legacyMovie, movieGuidPriority))
+
+	// The guid of a legacy tv agent is the show's, it can't be looked up as an episode
+	legacyEpisode := plexhooks.Metadata{Guid: "com.plexapp.agents.thetvdb://12345/2/5?lang=en"}
+	assert.Empty(t, externalGuids(legacyEpisode, episodeGuidPriority))
+}
+
+func TestDVDOrderEpisodesAreNotScrobbled(t *testing.T) {
+	pr := episodePlayback()
+	pr.Metadata.Guid = "com.plexapp.agents.thetvdbdvdorder://12345/2/5?lang=en"
+	fake := &fakeShows{}
+	client := serveTokens(t, fake.ServeHTTP)
+
+	_, err := client.HandleShow(context.TODO(), pr, time.Now(), DefaultScrobbleSettings, "access123", log.NewEntry(log.New()))
+	assert.True(t, IsUnmatched(err), "expected an unmatched error, got %v", err)
+	assert.Empty(t, fake.paths, "dvd season 2 episode 5 is another episode in the aired order")
+}
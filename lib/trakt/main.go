@@ -1,14 +1,12 @@
 package trakt
 
 import (
-	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
-	"io/ioutil"
 	"math"
-	"net/http"
 	"net/url"
-	"os"
+	"time"
 
 	"github.com/gravitational/trace"
 	"github.com/sirupsen/logrus"
@@ -17,64 +15,50 @@ import (
 	"github.com/xanderstrike/plexhooks"
 )
 
-const (
-	traktApiBasePath = "https://api.trakt.tv"
-)
-
-// AuthRequest authorize the connection with Trakt
-func AuthRequest(root, username, code, refreshToken, grantType string) (map[string]interface{}, error) {
-	values := map[string]string{
-		"code":          code,
-		"refresh_token": refreshToken,
-		"client_id":     os.Getenv("TRAKT_ID"),
-		"client_secret": os.Getenv("TRAKT_SECRET"),
-		"redirect_uri":  fmt.Sprintf("%s/authorize?username=%s", root, url.PathEscape(username)),
-		"grant_type":    grantType,
+// Handle determine if an item is a show or a movie, scrobbling it with a token
+// from tokens. receivedAt is when plex sent the webhook. It returns the
+// scrobble action trakt got, empty when nothing was sent.
+func (c *Client) Handle(ctx context.Context, pr plexhooks.PlexResponse, receivedAt time.Time, settings ScrobbleSettings, user store.User, tokens *TokenManager, log *log.Entry) (string, error) {
+	if pr.Metadata.LibrarySectionType != "show" && pr.Metadata.LibrarySectionType != "movie" {
+		log.Errorf("Unsupported media type: %s", pr.Metadata.LibrarySectionType)
+		return "", nil
 	}
-	jsonValue, _ := json.Marshal(values)
-
-	resp, err := http.Post(fmt.Sprintf("%s/oauth/token", traktApiBasePath), "application/json", bytes.NewBuffer(jsonValue))
+	accessToken, err := tokens.AccessToken(ctx, user)
 	if err != nil {
-		return nil, trace.Wrap(err)
+		log.Errorf("No usable trakt token: %v", err)
+		return "", trace.Wrap(err)
 	}
-
-	var result map[string]interface{}
-	err = json.NewDecoder(resp.Body).Decode(&result)
-	if err != nil {
-		return nil, trace.Wrap(err)
-	}
-
-	return result, nil
-}
-
-// Handle determine if an item is a show or a movie
-func Handle(pr plexhooks.PlexResponse, user store.User, log *log.Entry) error {
-	var err error
+	var event string
 	if pr.Metadata.LibrarySectionType == "show" {
-		err = HandleShow(pr, user.AccessToken, log)
-	} else if pr.Metadata.LibrarySectionType == "movie" {
-		err = HandleMovie(pr, user.AccessToken, log)
+		event, err = c.HandleShow(ctx, pr, receivedAt, settings, accessToken, log)
 	} else {
-		log.Errorf("Unsupported media type: %s", pr.Metadata.LibrarySectionType)
-		return nil
+		event, err = c.HandleMovie(ctx, pr, receivedAt, settings, accessToken, log)
 	}
 	if err != nil {
 		log.Errorf("Error sending to trakt: %#v", err)
 	}
-	return err
+	return event, err
 }
 
-// HandleShow start the scrobbling for a show
-func HandleShow(pr plexhooks.PlexResponse, accessToken string, log *log.Entry) error {
-	showInfo, err := findShowInfo(pr, log)
+// HandleShow start the scrobbling for a show, returning the scrobble action sent
+func (c *Client) HandleShow(ctx context.Context, pr plexhooks.PlexResponse, receivedAt time.Time, settings ScrobbleSettings, accessToken string, log *log.Entry) (string, error) {
+	showInfo, err := c.findShowInfo(ctx, pr, log)
 	if err != nil {
-		return trace.Wrap(err)
+		return "", trace.Wrap(err)
 	}
-	episode, err := getExtendedEpisodeInfo(showInfo, log)
+	episode, err := c.getExtendedEpisodeInfo(ctx, showInfo, log)
 	if err != nil {
-		return trace.Wrap(err)
+		return "", trace.Wrap(err)
+	}
+	event, progress := getAction(pr, episode.Runtime, settings)
+	if c.late(receivedAt) {
+		history := HistoryBody{Episodes: []EpisodeHistory{{Episode: *episode, WatchedAt: receivedAt}}}
+		return c.addLate(ctx, pr, event, history, episodeTitle(pr.Metadata), accessToken, log)
+	}
+	if event == "" {
+		log.WithField("event", pr.Event).Debugf("Nothing to send for %s", episodeTitle(pr.Metadata))
+		return "", nil
 	}
-	event, progress := getAction(pr, episode.Runtime*60*1000)
 
 	scrobbleObject := ShowScrobbleBody{
 		Progress: progress,
@@ -83,20 +67,29 @@ func HandleShow(pr plexhooks.PlexResponse, accessToken string, log *log.Entry) e
 
 	scrobbleJSON, err := json.Marshal(scrobbleObject)
 	if err != nil {
-		return trace.Wrap(err)
+		return "", trace.Wrap(err)
 	}
 
-	_, err = scrobbleRequest(event, scrobbleJSON, accessToken)
-	return trace.Wrap(err)
+	if _, err := c.scrobble(ctx, event, scrobbleJSON, accessToken); err != nil {
+		return "", trace.Wrap(err)
+	}
+	return event, nil
 }
 
-// HandleMovie start the scrobbling for a movie
-func HandleMovie(pr plexhooks.PlexResponse, accessToken string, log *log.Entry) error {
-	event, progress := getAction(pr, 0)
-
-	movie, err := findMovie(pr, log)
+// HandleMovie start the scrobbling for a movie, returning the scrobble action sent
+func (c *Client) HandleMovie(ctx context.Context, pr plexhooks.PlexResponse, receivedAt time.Time, settings ScrobbleSettings, accessToken string, log *log.Entry) (string, error) {
+	movie, err := c.findMovie(ctx, pr, log)
 	if err != nil {
-		return trace.Wrap(err)
+		return "", trace.Wrap(err)
+	}
+	event, progress := getAction(pr, movie.Runtime, settings)
+	if c.late(receivedAt) {
+		history := HistoryBody{Movies: []MovieHistory{{Movie: *movie, WatchedAt: receivedAt}}}
+		return c.addLate(ctx, pr, event, history, movieTitle(pr.Metadata), accessToken, log)
+	}
+	if event == "" {
+		log.WithField("event", pr.Event).Debugf("Nothing to send for %s", movieTitle(pr.Metadata))
+		return "", nil
 	}
 	scrobbleObject := MovieScrobbleBody{
 		Progress: progress,
@@ -105,41 +98,133 @@ func HandleMovie(pr plexhooks.PlexResponse, accessToken string, log *log.Entry)
 
 	scrobbleJSON, err := json.Marshal(scrobbleObject)
 	if err != nil {
-		return trace.Wrap(err)
+		return "", trace.Wrap(err)
 	}
 
-	_, err = scrobbleRequest(event, scrobbleJSON, accessToken)
-	return trace.Wrap(err)
+	if _, err := c.scrobble(ctx, event, scrobbleJSON, accessToken); err != nil {
+		return "", trace.Wrap(err)
+	}
+	return event, nil
 }
 
-func findShowInfo(pr plexhooks.PlexResponse, log *log.Entry) (*ShowInfo, error) {
-	var showInfo []ShowInfo
-	var episodeID string
-
-	log.Println("Finding episode with new Plex TV agent")
+// late tells if a webhook received at receivedAt is too old to be scrobbled
+func (c *Client) late(receivedAt time.Time) bool {
+	return c.lateAfter > 0 && time.Since(receivedAt) > c.lateAfter
+}
 
-	traktService := pr.Metadata.ExternalGuid[0].Id[:4]
-	episodeID = pr.Metadata.ExternalGuid[0].Id[7:]
+// addLate adds a late webhook to the history at the time plex sent it when
+// its scrobble action, event, records a watch, which it returns like a stop.
+// Anything else that old says nothing about what is being watched now, so it
+// is dropped.
+func (c *Client) addLate(ctx context.Context, pr plexhooks.PlexResponse, event string, history HistoryBody, title, accessToken string, log *log.Entry) (string, error) {
+	if event != "stop" {
+		log.WithField("event", pr.Event).Printf("Dropping outdated event for %s", title)
+		return "", nil
+	}
+	body, err := json.Marshal(history)
+	if err != nil {
+		return "", trace.Wrap(err)
+	}
+	respBody, err := c.post(ctx, "/sync/history", body, accessToken)
+	if err != nil {
+		return "", trace.Wrap(err)
+	}
+	var result HistoryResult
+	if err := json.Unmarshal(respBody, &result); err != nil {
+		return "", trace.Wrap(err)
+	}
+	if result.Added.Movies+result.Added.Episodes == 0 {
+		itemType := "movie"
+		if len(history.Episodes) > 0 {
+			itemType = "episode"
+		}
+		return "", trace.Wrap(&UnmatchedError{Type: itemType, Title: title})
+	}
+	log.Printf("Added %s to the history", title)
+	return event, nil
+}
 
-	// The new Plex TV agent use episode ID instead of show ID,
-	// so we need to do things a bit differently
-	URL := fmt.Sprintf("%s/search/%s/%s?type=episode", traktApiBasePath, traktService, episodeID)
+// findShowInfo resolves the episode through its external guids, trying every
+// provider in turn. The new plex tv agent sends the ids of the episode rather
+// than of the show, the legacy agents only send the show and the episode's
+// position in it.
+func (c *Client) findShowInfo(ctx context.Context, pr plexhooks.PlexResponse, log *log.Entry) (*ShowInfo, error) {
+	guids := externalGuids(pr.Metadata, episodeGuidPriority)
+	var lookupErr error
+	for _, guid := range guids {
+		showInfo, err := c.lookupEpisode(ctx, guid)
+		if err != nil {
+			log.WithField("guid", guid.String()).Warnf("Failed to look up episode: %v", err)
+			lookupErr = err
+			continue
+		}
+		if showInfo != nil {
+			log.Printf("Tracking %s - S%02dE%02d using %s", showInfo.Show.Title, showInfo.Episode.Season, showInfo.Episode.Number, guid.Provider)
+			return showInfo, nil
+		}
+	}
+	if legacy, ok := legacyEpisodeGuid(pr.Metadata); ok {
+		log.WithField("guid", legacy.String()).Println("Finding episode with legacy Plex TV agent")
+		show, err := c.lookupShow(ctx, legacy)
+		if err != nil {
+			return nil, trace.Wrap(err)
+		}
+		if show != nil {
+			log.Printf("Tracking %s - S%02dE%02d using %s", show.Title, legacy.Season, legacy.Episode, legacy.Provider)
+			return &ShowInfo{Show: *show, Episode: Episode{Season: legacy.Season, Number: legacy.Episode}}, nil
+		}
+		guids = append(guids, legacy)
+	} else if guid, ok := parseGuid(pr.Metadata.Guid); ok && guid.IsEpisode() {
+		// Numbered in a way trakt doesn't know, like the absolute order of hama
+		guids = append(guids, guid)
+	}
+	// Trakt failing to answer says nothing about whether it knows the episode
+	if lookupErr != nil {
+		return nil, trace.Wrap(lookupErr)
+	}
+	return nil, trace.Wrap(&UnmatchedError{Type: "episode", Title: episodeTitle(pr.Metadata), Guids: guids})
+}
 
-	respBody, err := makeRequest(URL)
+// lookupShow finds a show by one of its ids, returning nil when trakt doesn't know it
+func (c *Client) lookupShow(ctx context.Context, guid Guid) (*Show, error) {
+	path := fmt.Sprintf("/search/%s/%s?type=show", url.PathEscape(guid.Provider), url.PathEscape(guid.ID))
+	respBody, err := c.get(ctx, path)
 	if err != nil {
 		return nil, trace.Wrap(err)
 	}
-	err = json.Unmarshal(respBody, &showInfo)
-	if err != nil {
+	var results []ShowSearchResult
+	if err := json.Unmarshal(respBody, &results); err != nil {
 		return nil, trace.Wrap(err)
 	}
+	if len(results) == 0 {
+		return nil, nil
+	}
+	return &results[0].Show, nil
+}
 
-	log.Print(fmt.Sprintf("Tracking %s - S%02dE%02d using %s", showInfo[0].Show.Title, showInfo[0].Episode.Season, showInfo[0].Episode.Number, traktService))
+// lookupEpisode finds an episode by one of its ids, returning nil when trakt doesn't know it
+func (c *Client) lookupEpisode(ctx context.Context, guid Guid) (*ShowInfo, error) {
+	path := fmt.Sprintf("/search/%s/%s?type=episode", url.PathEscape(guid.Provider), url.PathEscape(guid.ID))
+	respBody, err := c.get(ctx, path)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	var results []ShowInfo
+	if err := json.Unmarshal(respBody, &results); err != nil {
+		return nil, trace.Wrap(err)
+	}
+	if len(results) == 0 {
+		return nil, nil
+	}
+	return &results[0], nil
+}
 
-	return &showInfo[0], nil
+// episodeTitle names an episode the way it shows up in the logs
+func episodeTitle(metadata plexhooks.Metadata) string {
+	return fmt.Sprintf("%s - S%02dE%02d", metadata.GrandparentTitle, metadata.ParentIndex, metadata.Index)
 }
 
-func getExtendedEpisodeInfo(showInfo *ShowInfo, log *log.Entry) (*Episode, error) {
+func (c *Client) getExtendedEpisodeInfo(ctx context.Context, showInfo *ShowInfo, log *log.Entry) (*Episode, error) {
 	log = log.WithFields(logrus.Fields{
 		"show":    showInfo.Show.Title,
 		"season":  showInfo.Episode.Season,
@@ -147,15 +232,14 @@ func getExtendedEpisodeInfo(showInfo *ShowInfo, log *log.Entry) (*Episode, error
 	})
 
 	log.Print("Getting extended episode info")
-	url := fmt.Sprintf(
-		"%s/shows/%d/seasons/%d/episodes/%d?extended=full",
-		traktApiBasePath,
+	path := fmt.Sprintf(
+		"/shows/%d/seasons/%d/episodes/%d?extended=full",
 		showInfo.Show.Ids.Trakt,
 		showInfo.Episode.Season,
 		showInfo.Episode.Number,
 	)
 
-	responseBody, err := makeRequest(url)
+	responseBody, err := c.get(ctx, path)
 	if err != nil {
 		return nil, trace.Wrap(err)
 	}
@@ -169,19 +253,62 @@ func getExtendedEpisodeInfo(showInfo *ShowInfo, log *log.Entry) (*Episode, error
 
 }
 
-func findMovie(pr plexhooks.PlexResponse, log *log.Entry) (*Movie, error) {
+// findMovie resolves the movie through its external guids, searching by title
+// only when plex didn't send any
+func (c *Client) findMovie(ctx context.Context, pr plexhooks.PlexResponse, log *log.Entry) (*Movie, error) {
+	guids := externalGuids(pr.Metadata, movieGuidPriority)
+	if len(guids) == 0 {
+		return c.searchMovie(ctx, pr, log)
+	}
+	var lookupErr error
+	for _, guid := range guids {
+		movie, err := c.lookupMovie(ctx, guid)
+		if err != nil {
+			log.WithField("guid", guid.String()).Warnf("Failed to look up movie: %v", err)
+			lookupErr = err
+			continue
+		}
+		if movie != nil {
+			log.WithField("guid", guid.String()).Printf("Tracking %s (%d)", movie.Title, movie.Year)
+			return movie, nil
+		}
+	}
+	if lookupErr != nil {
+		return nil, trace.Wrap(lookupErr)
+	}
+	return nil, trace.Wrap(&UnmatchedError{Type: "movie", Title: movieTitle(pr.Metadata), Guids: guids})
+}
+
+// lookupMovie finds a movie by one of its ids, returning nil when trakt doesn't know it
+func (c *Client) lookupMovie(ctx context.Context, guid Guid) (*Movie, error) {
+	path := fmt.Sprintf("/search/%s/%s?type=movie&extended=full", url.PathEscape(guid.Provider), url.PathEscape(guid.ID))
+	respBody, err := c.get(ctx, path)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	var results []MovieSearchResult
+	if err := json.Unmarshal(respBody, &results); err != nil {
+		return nil, trace.Wrap(err)
+	}
+	if len(results) == 0 {
+		return nil, nil
+	}
+	return &results[0].Movie, nil
+}
+
+// searchMovie looks for a movie with the same title and year
+func (c *Client) searchMovie(ctx context.Context, pr plexhooks.PlexResponse, log *log.Entry) (*Movie, error) {
 	log = log.WithFields(logrus.Fields{
 		"title": pr.Metadata.Title,
 		"year":  pr.Metadata.Year,
 	})
 	log.Print("Finding movie")
-	url := fmt.Sprintf(
-		"%s/search/movie?query=%s",
-		traktApiBasePath,
+	path := fmt.Sprintf(
+		"/search/movie?extended=full&query=%s",
 		url.PathEscape(pr.Metadata.Title),
 	)
 
-	respBody, err := makeRequest(url)
+	respBody, err := c.get(ctx, path)
 	if err != nil {
 		return nil, trace.Wrap(err)
 	}
@@ -198,85 +325,53 @@ func findMovie(pr plexhooks.PlexResponse, log *log.Entry) (*Movie, error) {
 			return &result.Movie, nil
 		}
 	}
-	return nil, trace.Errorf("Could not find movie!")
-}
-
-func makeRequest(url string) ([]byte, error) {
-	client := &http.Client{}
-
-	req, err := http.NewRequest("GET", url, nil)
-	if err != nil {
-		return nil, trace.Wrap(err)
-	}
-
-	req.Header.Add("Content-Type", "application/json")
-	req.Header.Add("trakt-api-version", "2")
-	req.Header.Add("trakt-api-key", os.Getenv("TRAKT_ID"))
-
-	resp, err := client.Do(req)
-	if err != nil {
-		return nil, trace.Wrap(err)
-	}
-	defer resp.Body.Close()
-
-	respBody, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return nil, trace.Wrap(err)
-	}
-
-	return respBody, nil
+	return nil, trace.Wrap(&UnmatchedError{Type: "movie", Title: movieTitle(pr.Metadata)})
 }
 
-func scrobbleRequest(action string, body []byte, accessToken string) ([]byte, error) {
-	client := &http.Client{}
-
-	url := fmt.Sprintf("%s/scrobble/%s", traktApiBasePath, action)
-
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(body))
-	if err != nil {
-		return nil, trace.Wrap(err)
-	}
-
-	req.Header.Add("Content-Type", "application/json")
-	req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", accessToken))
-	req.Header.Add("trakt-api-version", "2")
-	req.Header.Add("trakt-api-key", os.Getenv("TRAKT_ID"))
-
-	resp, err := client.Do(req)
-	if err != nil {
-		return nil, trace.Wrap(err)
-	}
-	defer resp.Body.Close()
-
-	respBody, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return nil, trace.Wrap(err)
-	}
-
-	return respBody, nil
+// movieTitle names a movie the way it shows up in the logs
+func movieTitle(metadata plexhooks.Metadata) string {
+	return fmt.Sprintf("%s (%d)", metadata.Title, metadata.Year)
 }
 
-func getAction(pr plexhooks.PlexResponse, runtime int) (string, int) {
+// getAction tells which scrobble action a webhook sends and at what progress,
+// runtime being the one trakt has for the item in minutes. An empty action
+// sends nothing.
+func getAction(pr plexhooks.PlexResponse, runtime int, settings ScrobbleSettings) (string, int) {
 	percentage := calculatePercentage(pr, runtime)
 	switch pr.Event {
-	case "media.play":
+	case "media.play", "media.resume":
 		return "start", percentage
 	case "media.pause":
-		return "stop", percentage
-	case "media.resume":
-		return "start", percentage
+		switch settings.PauseAction {
+		case PauseActionStop:
+			return settings.finish(pr.Event, percentage)
+		case PauseActionIgnore:
+			return "", percentage
+		}
+		return "pause", percentage
 	case "media.stop":
-		return "stop", percentage
+		return settings.finish(pr.Event, percentage)
 	case "media.scrobble":
-		return "stop", 90
+		if pr.Metadata.ViewOffset == 0 {
+			// Without an offset all there is to go by is plex sending it at 90%
+			percentage = 90
+		}
+		return settings.finish(pr.Event, percentage)
+	case idleEvent:
+		return "pause", percentage
 	}
 	return "", percentage
 }
 
+// calculatePercentage is how far into the item the webhook is, out of the
+// longest of the plex duration and the trakt runtime in minutes
 func calculatePercentage(pr plexhooks.PlexResponse, runtime int) int {
-	duration := math.Max(float64(pr.Metadata.Duration), float64(runtime))
+	duration := math.Max(float64(pr.Metadata.Duration), float64(runtime)*60*1000)
 	offset := float64(pr.Metadata.ViewOffset)
-	percentage := int(offset / duration * 100)
+	if duration <= 0 {
+		return 0
+	}
+	percentage := int(math.Min(offset/duration*100, 100))
 	log.WithFields(log.Fields{
 		"duration": duration,
 		"offset":   offset,
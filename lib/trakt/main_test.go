@@ -0,0 +1,381 @@
+package trakt
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/xanderstrike/plexhooks"
+)
+
+// serveMovies answers id lookups from movies keyed by path, recording every path asked for
+func serveMovies(t *testing.T, movies map[string]Movie) (*Client, func() []string) {
+	var mu sync.Mutex
+	var paths []string
+	client := serveTokens(t, func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		paths = append(paths, r.URL.RequestURI())
+		mu.Unlock()
+		results := []MovieSearchResult{}
+		if movie, ok := movies[r.URL.Path]; ok {
+			results = append(results, MovieSearchResult{Movie: movie})
+		}
+		json.NewEncoder(w).Encode(results)
+	})
+	return client, func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string(nil), paths...)
+	}
+}
+
+func moviePlayback(guids ...string) plexhooks.PlexResponse {
+	pr := plexhooks.PlexResponse{Event: "media.play"}
+	pr.Metadata.LibrarySectionType = "movie"
+	pr.Metadata.Title = "Heat"
+	pr.Metadata.Year = 1995
+	for _, guid := range guids {
+		pr.Metadata.ExternalGuid = append(pr.Metadata.ExternalGuid, plexhooks.ExternalGuid{Id: guid})
+	}
+	return pr
+}
+
+func TestFindMoviePrefersImdb(t *testing.T) {
+	client, paths := serveMovies(t, map[string]Movie{
+		"/search/imdb/tt0113277": {Title: "Heat", Year: 1995, Ids: Ids{Trakt: 1}},
+		"/search/tmdb/949":       {Title: "Wrong", Year: 1995, Ids: Ids{Trakt: 2}},
+	})
+
+	movie, err := client.findMovie(context.TODO(), moviePlayback("tmdb://949", "imdb://tt0113277"), log.NewEntry(log.New()))
+	require.NoError(t, err)
+	assert.Equal(t, 1, movie.Ids.Trakt)
+	assert.Equal(t, []string{"/search/imdb/tt0113277?type=movie&extended=full"}, paths())
+}
+
+func TestFindMovieFallsBackToNextProvider(t *testing.T) {
+	client, paths := serveMovies(t, map[string]Movie{
+		"/search/tmdb/949": {Title: "Heat", Year: 1995, Ids: Ids{Trakt: 1}},
+	})
+
+	movie, err := client.findMovie(context.TODO(), moviePlayback("imdb://tt0113277", "tmdb://949"), log.NewEntry(log.New()))
+	require.NoError(t, err)
+	assert.Equal(t, 1, movie.Ids.Trakt)
+	assert.Equal(t, []string{"/search/imdb/tt0113277?type=movie&extended=full", "/search/tmdb/949?type=movie&extended=full"}, paths())
+}
+
+func TestFindMovieUnknownGuids(t *testing.T) {
+	client, paths := serveMovies(t, map[string]Movie{
+		"/search/movie": {Title: "Heat", Year: 1995, Ids: Ids{Trakt: 1}},
+	})
+
+	_, err := client.findMovie(context.TODO(), moviePlayback("imdb://tt0113277"), log.NewEntry(log.New()))
+	assert.True(t, IsUnmatched(err), "expected an unmatched error, got %v", err)
+	assert.Equal(t, []string{"/search/imdb/tt0113277?type=movie&extended=full"}, paths())
+}
+
+func TestFindMovieWithoutGuids(t *testing.T) {
+	client, paths := serveMovies(t, map[string]Movie{
+		"/search/movie": {Title: "Heat", Year: 1995, Ids: Ids{Trakt: 1}},
+	})
+
+	movie, err := client.findMovie(context.TODO(), moviePlayback(), log.NewEntry(log.New()))
+	require.NoError(t, err)
+	assert.Equal(t, 1, movie.Ids.Trakt)
+	assert.Equal(t, []string{"/search/movie?extended=full&query=Heat"}, paths())
+}
+
+// serveEpisodes answers episode lookups from episodes keyed by path, recording every path asked for
+func serveEpisodes(t *testing.T, episodes map[string]ShowInfo, failing string) (*Client, func() []string) {
+	var mu sync.Mutex
+	var paths []string
+	client := serveTokens(t, func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		paths = append(paths, r.URL.RequestURI())
+		mu.Unlock()
+		if r.URL.Path == failing {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		results := []ShowInfo{}
+		if episode, ok := episodes[r.URL.Path]; ok {
+			results = append(results, episode)
+		}
+		json.NewEncoder(w).Encode(results)
+	})
+	return client, func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string(nil), paths...)
+	}
+}
+
+func episodePlayback(guids ...string) plexhooks.PlexResponse {
+	pr := plexhooks.PlexResponse{Event: "media.play"}
+	pr.Metadata.LibrarySectionType = "show"
+	pr.Metadata.GrandparentTitle = "Chernobyl"
+	pr.Metadata.ParentIndex = 1
+	pr.Metadata.Index = 2
+	for _, guid := range guids {
+		pr.Metadata.ExternalGuid = append(pr.Metadata.ExternalGuid, plexhooks.ExternalGuid{Id: guid})
+	}
+	return pr
+}
+
+func TestFindShowInfoTriesEveryProvider(t *testing.T) {
+	chernobyl := ShowInfo{Show: Show{Title: "Chernobyl", Ids: Ids{Trakt: 1}}, Episode: Episode{Season: 1, Number: 2}}
+	client, paths := serveEpisodes(t, map[string]ShowInfo{"/search/imdb/tt8162428": chernobyl}, "/search/tvdb/7145617")
+
+	showInfo, err := client.findShowInfo(context.TODO(), episodePlayback("imdb://tt8162428", "tmdb://1756443", "tvdb://7145617"), log.NewEntry(log.New()))
+	require.NoError(t, err)
+	assert.Equal(t, chernobyl, *showInfo)
+	assert.Equal(t, []string{
+		"/search/tvdb/7145617?type=episode",
+		"/search/tmdb/1756443?type=episode",
+		"/search/imdb/tt8162428?type=episode",
+	}, paths())
+}
+
+func TestFindShowInfoUnmatched(t *testing.T) {
+	client, paths := serveEpisodes(t, nil, "")
+
+	_, err := client.findShowInfo(context.TODO(), episodePlayback("tvdb://7145617"), log.NewEntry(log.New()))
+	assert.True(t, IsUnmatched(err), "expected an unmatched error, got %v", err)
+	assert.Len(t, paths(), 1)
+
+	// Nothing to look up used to panic
+	_, err = client.findShowInfo(context.TODO(), episodePlayback(), log.NewEntry(log.New()))
+	assert.True(t, IsUnmatched(err), "expected an unmatched error, got %v", err)
+	assert.Len(t, paths(), 1)
+}
+
+// fakeShows answers the show, episode and scrobble endpoints for the recorded tv payloads in testdata
+type fakeShows struct {
+	mu        sync.Mutex
+	paths     []string
+	scrobbles []ShowScrobbleBody
+}
+
+func (f *fakeShows) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.paths = append(f.paths, r.URL.RequestURI())
+	futurama := Show{Title: "Futurama", Year: 1999, Ids: Ids{Trakt: 614, Tvdb: 73871, Tmdb: 615}}
+	naruto := Show{Title: "Naruto Shippuden", Year: 2007, Ids: Ids{Trakt: 31896, Tvdb: 79824}}
+	switch r.URL.RequestURI() {
+	case "/search/tvdb/73871?type=show", "/search/tmdb/615?type=show":
+		json.NewEncoder(w).Encode([]ShowSearchResult{{Show: futurama}})
+	case "/search/tvdb/79824?type=show":
+		json.NewEncoder(w).Encode([]ShowSearchResult{{Show: naruto}})
+	case "/search/tvdb/127094?type=episode":
+		json.NewEncoder(w).Encode([]ShowInfo{{Show: futurama, Episode: Episode{Season: 2, Number: 15}}})
+	case "/shows/614/seasons/2/episodes/15?extended=full":
+		json.NewEncoder(w).Encode(Episode{Season: 2, Number: 15, Title: "A Clone of My Own", Ids: Ids{Trakt: 1001}, Runtime: 22})
+	case "/shows/31896/seasons/1/episodes/52?extended=full":
+		json.NewEncoder(w).Encode(Episode{Season: 1, Number: 52, Title: "The Two Kazekage", Ids: Ids{Trakt: 2002}, Runtime: 24})
+	case "/scrobble/pause", "/scrobble/stop":
+		var body ShowScrobbleBody
+		json.NewDecoder(r.Body).Decode(&body)
+		f.scrobbles = append(f.scrobbles, body)
+		w.WriteHeader(http.StatusCreated)
+	default:
+		json.NewEncoder(w).Encode([]interface{}{})
+	}
+}
+
+func TestHandleShowAgents(t *testing.T) {
+	tests := []struct {
+		payload string
+		episode int
+		paths   []string
+	}{
+		{"thetvdb.json", 1001, []string{"/search/tvdb/73871?type=show", "/shows/614/seasons/2/episodes/15?extended=full"}},
+		{"themoviedb.json", 1001, []string{"/search/tmdb/615?type=show", "/shows/614/seasons/2/episodes/15?extended=full"}},
+		{"hama.json", 2002, []string{"/search/tvdb/79824?type=show", "/shows/31896/seasons/1/episodes/52?extended=full"}},
+		{"plex.json", 1001, []string{"/search/tvdb/127094?type=episode", "/shows/614/seasons/2/episodes/15?extended=full"}},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.payload, func(t *testing.T) {
+			raw, err := ioutil.ReadFile(filepath.Join("testdata", test.payload))
+			require.NoError(t, err)
+			pr, err := plexhooks.ParseWebhook(raw)
+			require.NoError(t, err)
+
+			fake := &fakeShows{}
+			client := serveTokens(t, fake.ServeHTTP)
+			_, err = client.HandleShow(context.TODO(), pr, time.Now(), DefaultScrobbleSettings, "access123", log.NewEntry(log.New()))
+			require.NoError(t, err)
+
+			assert.Equal(t, append(test.paths, "/scrobble/pause"), fake.paths)
+			require.Len(t, fake.scrobbles, 1)
+			assert.Equal(t, test.episode, fake.scrobbles[0].Episode.Ids.Trakt)
+		})
+	}
+}
+
+func TestHandleShowUnknownLegacyShow(t *testing.T) {
+	pr := episodePlayback()
+	pr.Metadata.Guid = "com.plexapp.agents.thetvdb://1/2/3?lang=en"
+	client := serveTokens(t, (&fakeShows{}).ServeHTTP)
+
+	_, err := client.HandleShow(context.TODO(), pr, time.Now(), DefaultScrobbleSettings, "access123", log.NewEntry(log.New()))
+	assert.True(t, IsUnmatched(err), "expected an unmatched error, got %v", err)
+}
+
+func TestHandleShowHamaAbsoluteNumbering(t *testing.T) {
+	pr := episodePlayback()
+	pr.Metadata.Guid = "com.plexapp.agents.hama://tvdb3-79824/1/52?lang=en"
+	fake := &fakeShows{}
+	client := serveTokens(t, fake.ServeHTTP)
+
+	_, err := client.HandleShow(context.TODO(), pr, time.Now(), DefaultScrobbleSettings, "access123", log.NewEntry(log.New()))
+	assert.True(t, IsUnmatched(err), "expected an unmatched error, got %v", err)
+	assert.Contains(t, err.Error(), "tvdb3")
+	assert.Empty(t, fake.paths, "season 1 episode 52 is another episode on tvdb")
+}
+
+// serveHistory finds Heat and records what is scrobbled or added to the history, answering history with added movies
+func serveHistory(t *testing.T, added int) (*Client, *[]string, *HistoryBody) {
+	var paths []string
+	var history HistoryBody
+	client := serveTokens(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/search/movie":
+			json.NewEncoder(w).Encode([]MovieSearchResult{{Movie: Movie{Title: "Heat", Year: 1995, Ids: Ids{Trakt: 1}}}})
+			return
+		case "/sync/history":
+			require.NoError(t, json.NewDecoder(r.Body).Decode(&history))
+			w.WriteHeader(http.StatusCreated)
+			json.NewEncoder(w).Encode(map[string]interface{}{"added": map[string]int{"movies": added, "episodes": 0}})
+		default:
+			w.WriteHeader(http.StatusCreated)
+		}
+		paths = append(paths, r.URL.Path)
+	})
+	return client, &paths, &history
+}
+
+func TestHandleMovieLateScrobble(t *testing.T) {
+	client, paths, history := serveHistory(t, 1)
+	pr := moviePlayback()
+	pr.Event = "media.scrobble"
+	receivedAt := time.Now().Add(-time.Hour).Truncate(time.Second)
+
+	_, err := client.HandleMovie(context.TODO(), pr, receivedAt, DefaultScrobbleSettings, "access123", log.NewEntry(log.New()))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"/sync/history"}, *paths)
+	require.Len(t, history.Movies, 1)
+	assert.Equal(t, 1, history.Movies[0].Ids.Trakt)
+	assert.True(t, receivedAt.Equal(history.Movies[0].WatchedAt), "watched at %s", history.Movies[0].WatchedAt)
+}
+
+func TestHandleMovieDropsLatePlay(t *testing.T) {
+	client, paths, _ := serveHistory(t, 1)
+
+	_, err := client.HandleMovie(context.TODO(), moviePlayback(), time.Now().Add(-time.Hour), DefaultScrobbleSettings, "access123", log.NewEntry(log.New()))
+	require.NoError(t, err)
+	assert.Empty(t, *paths)
+}
+
+func TestHandleMovieLateScrobbleNotAdded(t *testing.T) {
+	client, _, _ := serveHistory(t, 0)
+	pr := moviePlayback()
+	pr.Event = "media.scrobble"
+
+	_, err := client.HandleMovie(context.TODO(), pr, time.Now().Add(-time.Hour), DefaultScrobbleSettings, "access123", log.NewEntry(log.New()))
+	assert.True(t, IsUnmatched(err), "expected an unmatched error, got %v", err)
+}
+
+func TestHandleMovieLateScrobbleUnderThreshold(t *testing.T) {
+	client, paths, _ := serveHistory(t, 1)
+	pr := moviePlayback()
+	pr.Event = "media.scrobble"
+	pr.Metadata.Duration = 10000
+	pr.Metadata.ViewOffset = 9000
+
+	settings := DefaultScrobbleSettings
+	settings.WatchedThreshold = 95
+	_, err := client.HandleMovie(context.TODO(), pr, time.Now().Add(-time.Hour), settings, "access123", log.NewEntry(log.New()))
+	require.NoError(t, err)
+	assert.Empty(t, *paths, "90% is short of the watched threshold")
+}
+
+func TestHandleMovieLateStopOverThreshold(t *testing.T) {
+	client, paths, history := serveHistory(t, 1)
+	pr := moviePlayback()
+	pr.Event = "media.stop"
+	pr.Metadata.Duration = 10000
+	pr.Metadata.ViewOffset = 9500
+
+	_, err := client.HandleMovie(context.TODO(), pr, time.Now().Add(-time.Hour), DefaultScrobbleSettings, "access123", log.NewEntry(log.New()))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"/sync/history"}, *paths)
+	assert.Len(t, history.Movies, 1)
+}
+
+func TestHandleMovieScrobblesInTime(t *testing.T) {
+	client, paths, _ := serveHistory(t, 1)
+	pr := moviePlayback()
+	pr.Event = "media.scrobble"
+
+	_, err := client.HandleMovie(context.TODO(), pr, time.Now().Add(-time.Minute), DefaultScrobbleSettings, "access123", log.NewEntry(log.New()))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"/scrobble/stop"}, *paths)
+}
+
+func TestGetAction(t *testing.T) {
+	stop := ScrobbleSettings{PauseAction: PauseActionStop}
+	tests := []struct {
+		name     string
+		event    string
+		offset   int
+		runtime  int
+		settings ScrobbleSettings
+		action   string
+		progress int
+	}{
+		{"Play", "media.play", 30 * 60 * 1000, 0, DefaultScrobbleSettings, "start", 30},
+		{"Resume", "media.resume", 30 * 60 * 1000, 0, DefaultScrobbleSettings, "start", 30},
+		{"Pause", "media.pause", 90 * 60 * 1000, 0, DefaultScrobbleSettings, "pause", 90},
+		{"Pause as stop", "media.pause", 90 * 60 * 1000, 0, stop, "stop", 90},
+		{"Pause as stop early", "media.pause", 30 * 60 * 1000, 0, stop, "pause", 30},
+		{"Pause ignored", "media.pause", 30 * 60 * 1000, 0, ScrobbleSettings{PauseAction: PauseActionIgnore}, "", 30},
+		{"Stop early", "media.stop", 30 * 60 * 1000, 0, DefaultScrobbleSettings, "pause", 30},
+		{"Stop watched", "media.stop", 85 * 60 * 1000, 0, DefaultScrobbleSettings, "stop", 85},
+		{"Stop under threshold", "media.stop", 85 * 60 * 1000, 0, ScrobbleSettings{WatchedThreshold: 95}, "pause", 85},
+		{"Stop over lower threshold", "media.stop", 82 * 60 * 1000, 0, ScrobbleSettings{WatchedThreshold: 81}, "stop", 82},
+		{"Scrobble", "media.scrobble", 92 * 60 * 1000, 0, DefaultScrobbleSettings, "stop", 92},
+		{"Scrobble against longer runtime", "media.scrobble", 90 * 60 * 1000, 120, DefaultScrobbleSettings, "stop", 80},
+		{"Scrobble under threshold", "media.scrobble", 90 * 60 * 1000, 0, ScrobbleSettings{WatchedThreshold: 95}, "pause", 90},
+		{"Scrobble without offset", "media.scrobble", 0, 0, DefaultScrobbleSettings, "stop", 90},
+		{"Idle", idleEvent, 30 * 60 * 1000, 0, DefaultScrobbleSettings, "pause", 30},
+		{"Rating", "media.rate", 30 * 60 * 1000, 0, DefaultScrobbleSettings, "", 30},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			pr := moviePlayback()
+			pr.Event = test.event
+			pr.Metadata.Duration = 100 * 60 * 1000
+			pr.Metadata.ViewOffset = test.offset
+			action, progress := getAction(pr, test.runtime, test.settings)
+			assert.Equal(t, test.action, action)
+			assert.Equal(t, test.progress, progress)
+		})
+	}
+}
+
+func TestCalculatePercentageWithoutDuration(t *testing.T) {
+	pr := moviePlayback()
+	pr.Metadata.ViewOffset = 1000
+	assert.Equal(t, 0, calculatePercentage(pr, 0))
+	assert.Equal(t, 1, calculatePercentage(pr, 1))
+}
@@ -0,0 +1,127 @@
+package trakt
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/gravitational/trace"
+	"github.com/xanderstrike/goplaxt/lib/store"
+)
+
+// TokenResponse is what trakt answers when handing out a token
+type TokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	RefreshToken string `json:"refresh_token"`
+	Scope        string `json:"scope"`
+	// ExpiresIn and CreatedAt are in seconds
+	ExpiresIn int64 `json:"expires_in"`
+	CreatedAt int64 `json:"created_at"`
+}
+
+// Token converts the response into what gets stored with a user
+func (r TokenResponse) Token() store.Token {
+	token := store.Token{
+		AccessToken:  r.AccessToken,
+		RefreshToken: r.RefreshToken,
+		Scope:        r.Scope,
+	}
+	if r.CreatedAt > 0 && r.ExpiresIn > 0 {
+		token.ExpiresAt = time.Unix(r.CreatedAt+r.ExpiresIn, 0)
+	}
+	return token
+}
+
+// OAuthError is trakt turning down a token request
+type OAuthError struct {
+	// StatusCode is the http status trakt answered with
+	StatusCode int
+	// Code is the oauth error code such as invalid_grant, empty when trakt didn't send one
+	Code        string `json:"error"`
+	Description string `json:"error_description"`
+}
+
+// Error implements error
+func (e *OAuthError) Error() string {
+	switch {
+	case e.Code == "":
+		return fmt.Sprintf("trakt token request failed with status %d", e.StatusCode)
+	case e.Description == "":
+		return fmt.Sprintf("trakt token request failed: %s", e.Code)
+	}
+	return fmt.Sprintf("trakt token request failed: %s: %s", e.Code, e.Description)
+}
+
+// IsInvalidGrant tells if trakt refused the code or refresh token for good,
+// asking again with the same one never works
+func IsInvalidGrant(err error) bool {
+	var oauthErr *OAuthError
+	return errors.As(err, &oauthErr) && oauthErr.Code == "invalid_grant"
+}
+
+// ExchangeCode trades the code trakt sent back to /authorize for a token,
+// root is the url of this instance as it was given to trakt
+func (c *Client) ExchangeCode(ctx context.Context, root, username, code string) (*TokenResponse, error) {
+	return c.tokenRequest(ctx, map[string]string{
+		"code":         code,
+		"redirect_uri": redirectURI(root, username),
+		"grant_type":   "authorization_code",
+	})
+}
+
+// RefreshToken trades a refresh token for a new token, trakt revokes the old one on the way
+func (c *Client) RefreshToken(ctx context.Context, root, username, refreshToken string) (*TokenResponse, error) {
+	return c.tokenRequest(ctx, map[string]string{
+		"refresh_token": refreshToken,
+		"redirect_uri":  redirectURI(root, username),
+		"grant_type":    "refresh_token",
+	})
+}
+
+func redirectURI(root, username string) string {
+	return fmt.Sprintf("%s/authorize?username=%s", root, url.PathEscape(username))
+}
+
+func (c *Client) tokenRequest(ctx context.Context, values map[string]string) (*TokenResponse, error) {
+	values["client_id"] = c.clientID
+	values["client_secret"] = c.clientSecret
+	body, err := json.Marshal(values)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+
+	// Codes and refresh tokens only work once, so token requests are sent a
+	// single time, within tokenTimeout, without queueing behind the rate limit.
+	// Retrying one trakt already took fails with invalid_grant, and taking
+	// longer lets another replica take the refresh over.
+	ctx, cancel := context.WithTimeout(ctx, c.tokenTimeout())
+	defer cancel()
+	req, err := c.newRequest(ctx, "POST", "/oauth/token", body)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	resp, respBody, err := c.send(req)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	c.observeRateLimit(resp)
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		oauthErr := &OAuthError{StatusCode: resp.StatusCode}
+		// Errors from in front of trakt, like cloudflare, aren't json
+		json.Unmarshal(respBody, oauthErr)
+		return nil, trace.Wrap(oauthErr)
+	}
+	var token TokenResponse
+	if err := json.Unmarshal(respBody, &token); err != nil {
+		return nil, trace.Errorf("invalid token response: %v", err)
+	}
+	if token.AccessToken == "" || token.RefreshToken == "" {
+		return nil, trace.BadParameter("trakt answered without a token")
+	}
+	return &token, nil
+}
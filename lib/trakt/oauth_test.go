@@ -0,0 +1,102 @@
+package trakt
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// serveTokens returns a client sending its requests to handler
+func serveTokens(t *testing.T, handler http.HandlerFunc) *Client {
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	return NewClient(WithBaseURL(server.URL), WithCredentials("id123", "secret123"))
+}
+
+func TestExchangeCode(t *testing.T) {
+	client := serveTokens(t, func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]string
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+		assert.Equal(t, "/oauth/token", r.URL.Path)
+		assert.Equal(t, "authorization_code", body["grant_type"])
+		assert.Equal(t, "code123", body["code"])
+		assert.Equal(t, "id123", body["client_id"])
+		assert.Equal(t, "secret123", body["client_secret"])
+		assert.Equal(t, "https://plaxt.example.com/authorize?username=halkeye", body["redirect_uri"])
+		w.Write([]byte(`{
+			"access_token": "access123",
+			"token_type": "bearer",
+			"expires_in": 7776000,
+			"refresh_token": "refresh123",
+			"scope": "public",
+			"created_at": 1550000000
+		}`))
+	})
+
+	resp, err := client.ExchangeCode(context.TODO(), "https://plaxt.example.com", "halkeye", "code123")
+	require.NoError(t, err)
+	token := resp.Token()
+	assert.Equal(t, "access123", token.AccessToken)
+	assert.Equal(t, "refresh123", token.RefreshToken)
+	assert.Equal(t, "public", token.Scope)
+	assert.True(t, time.Unix(1550000000+7776000, 0).Equal(token.ExpiresAt))
+}
+
+func TestRefreshTokenInvalidGrant(t *testing.T) {
+	client := serveTokens(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte(`{"error": "invalid_grant", "error_description": "The provided authorization grant is invalid"}`))
+	})
+
+	_, err := client.RefreshToken(context.TODO(), "https://plaxt.example.com", "halkeye", "refresh123")
+	require.Error(t, err)
+	assert.True(t, IsInvalidGrant(err))
+	assert.Contains(t, err.Error(), "The provided authorization grant is invalid")
+}
+
+func TestRefreshTokenServerError(t *testing.T) {
+	client := serveTokens(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+		w.Write([]byte(`<html>bad gateway</html>`))
+	})
+
+	_, err := client.RefreshToken(context.TODO(), "https://plaxt.example.com", "halkeye", "refresh123")
+	require.Error(t, err)
+	assert.False(t, IsInvalidGrant(err))
+	assert.Contains(t, err.Error(), "502")
+}
+
+func TestRefreshTokenIsSentOnce(t *testing.T) {
+	var calls int32
+	client := serveTokens(t, func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.Header().Set("Retry-After", "1")
+		w.WriteHeader(http.StatusTooManyRequests)
+	})
+
+	_, err := client.RefreshToken(context.TODO(), "https://plaxt.example.com", "halkeye", "refresh123")
+	require.Error(t, err)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls), "a refresh token must not be sent twice")
+}
+
+func TestRefreshWaitOutlastsTokenRequests(t *testing.T) {
+	client := NewClient(WithTimeout(45 * time.Second))
+	assert.True(t, client.refreshWait() > 45*time.Second)
+	assert.True(t, NewClient(WithTimeout(0)).refreshWait() > defaultTokenTimeout)
+}
+
+func TestRefreshTokenWithoutToken(t *testing.T) {
+	client := serveTokens(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{}`))
+	})
+
+	_, err := client.RefreshToken(context.TODO(), "https://plaxt.example.com", "halkeye", "refresh123")
+	assert.Error(t, err)
+}
@@ -0,0 +1,156 @@
+package trakt
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gravitational/trace"
+)
+
+// tokenBucket lets rate requests a second through, with bursts of up to burst,
+// so one busy plex server can't use up the quota of the shared api key
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+	// pausedUntil holds every request back once trakt says the quota is used up
+	pausedUntil time.Time
+	now         func() time.Time
+}
+
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	return &tokenBucket{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+		now:    time.Now,
+	}
+}
+
+// wait blocks until a request may go out
+func (b *tokenBucket) wait(ctx context.Context) error {
+	for {
+		b.mu.Lock()
+		delay := b.reserve()
+		b.mu.Unlock()
+		if delay <= 0 {
+			return nil
+		}
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return trace.Wrap(ctx.Err())
+		}
+	}
+}
+
+// reserve takes a token or tells how long until there is one, it expects b.mu to be held
+func (b *tokenBucket) reserve() time.Duration {
+	now := b.now()
+	if now.Before(b.pausedUntil) {
+		return b.pausedUntil.Sub(now)
+	}
+	b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return 0
+	}
+	return time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+}
+
+// pause holds every request back until until
+func (b *tokenBucket) pause(until time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if until.After(b.pausedUntil) {
+		b.pausedUntil = until
+	}
+}
+
+// rateLimit is the X-Ratelimit header trakt sends along its answers
+type rateLimit struct {
+	Name      string    `json:"name"`
+	Period    int       `json:"period"`
+	Limit     int       `json:"limit"`
+	Remaining int       `json:"remaining"`
+	Until     time.Time `json:"until"`
+}
+
+// rateLimitWait tells how long trakt asks to wait before sending anything else,
+// from Retry-After or else from an exhausted X-Ratelimit
+func rateLimitWait(resp *http.Response, now time.Time) (time.Duration, bool) {
+	if retryAfter := resp.Header.Get("Retry-After"); retryAfter != "" {
+		if seconds, err := strconv.Atoi(retryAfter); err == nil {
+			return time.Duration(seconds) * time.Second, true
+		}
+		if at, err := http.ParseTime(retryAfter); err == nil {
+			return at.Sub(now), true
+		}
+	}
+	var limit rateLimit
+	if header := resp.Header.Get("X-Ratelimit"); header != "" && json.Unmarshal([]byte(header), &limit) == nil {
+		if limit.Remaining <= 0 && limit.Until.After(now) {
+			return limit.Until.Sub(now), true
+		}
+	}
+	return 0, false
+}
+
+// backoff is the exponential delay before retry number attempt, with jitter
+// so clients failing together don't retry together
+func (c *Client) backoff(attempt int) time.Duration {
+	delay := c.retryBackoff << uint(attempt)
+	if delay > c.maxRetryWait || delay <= 0 {
+		delay = c.maxRetryWait
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// retryDelay tells whether and after how long a request deserves another try.
+// Rate limited requests never reached trakt so they are always safe to send
+// again, other failures only for requests that can be repeated.
+func (c *Client) retryDelay(req *http.Request, resp *http.Response, err error, attempt int) (time.Duration, bool) {
+	if attempt >= c.maxRetries || req.Context().Err() != nil {
+		return 0, false
+	}
+	idempotent := req.Method == "GET" || req.Method == "HEAD"
+	switch {
+	case err != nil:
+		return c.backoff(attempt), idempotent
+	case resp.StatusCode == http.StatusTooManyRequests:
+		wait, ok := rateLimitWait(resp, time.Now())
+		if !ok {
+			wait = c.backoff(attempt)
+		}
+		return wait, wait <= c.maxRetryWait
+	case resp.StatusCode == http.StatusInternalServerError,
+		resp.StatusCode == http.StatusBadGateway,
+		resp.StatusCode == http.StatusServiceUnavailable,
+		resp.StatusCode == http.StatusGatewayTimeout,
+		// Cloudflare, which trakt sits behind, answers 52x when trakt itself is unreachable
+		resp.StatusCode >= 520 && resp.StatusCode <= 524:
+		return c.backoff(attempt), idempotent
+	}
+	return 0, false
+}
+
+// observeRateLimit pauses the bucket when trakt says the quota is used up
+func (c *Client) observeRateLimit(resp *http.Response) {
+	if c.limiter == nil {
+		return
+	}
+	now := time.Now()
+	if wait, ok := rateLimitWait(resp, now); ok {
+		c.limiter.pause(now.Add(wait))
+	}
+}
@@ -0,0 +1,137 @@
+package trakt
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// flakyTrakt answers with statuses in turn, then with 200
+func flakyTrakt(t *testing.T, calls *int32, respond func(w http.ResponseWriter, call int32)) *Client {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		respond(w, atomic.AddInt32(calls, 1))
+	}))
+	t.Cleanup(server.Close)
+	return NewClient(WithBaseURL(server.URL), WithRetries(3, time.Millisecond))
+}
+
+func TestClientRetriesRateLimited(t *testing.T) {
+	var calls int32
+	client := flakyTrakt(t, &calls, func(w http.ResponseWriter, call int32) {
+		if call == 1 {
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		w.Write([]byte(`[]`))
+	})
+
+	// Rate limited requests never reached trakt, so even scrobbles are sent again
+	_, err := client.scrobble(context.TODO(), "start", []byte(`{}`), "access123")
+	require.NoError(t, err)
+	assert.Equal(t, int32(2), calls)
+}
+
+func TestClientHonoursRateLimitHeader(t *testing.T) {
+	var calls int32
+	until := time.Now().Add(100 * time.Millisecond)
+	client := flakyTrakt(t, &calls, func(w http.ResponseWriter, call int32) {
+		if call == 1 {
+			header, _ := json.Marshal(rateLimit{Name: "AUTHED_API_GET_LIMIT", Period: 300, Limit: 1000, Until: until})
+			w.Header().Set("X-Ratelimit", string(header))
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		w.Write([]byte(`[]`))
+	})
+
+	_, err := client.get(context.TODO(), "/search/movie?query=Heat")
+	require.NoError(t, err)
+	assert.Equal(t, int32(2), calls)
+	assert.False(t, time.Now().Before(until), "retried before the rate limit was over")
+}
+
+func TestClientGivesUpOnLongRateLimit(t *testing.T) {
+	var calls int32
+	client := flakyTrakt(t, &calls, func(w http.ResponseWriter, call int32) {
+		w.Header().Set("Retry-After", "3600")
+		w.WriteHeader(http.StatusTooManyRequests)
+	})
+	client.limiter = nil
+
+	_, err := client.get(context.TODO(), "/search/movie?query=Heat")
+	var apiErr *APIError
+	require.True(t, errors.As(err, &apiErr), "expected an api error, got %v", err)
+	assert.Equal(t, http.StatusTooManyRequests, apiErr.StatusCode)
+	assert.Equal(t, int32(1), calls)
+}
+
+func TestClientRetriesServerErrors(t *testing.T) {
+	var calls int32
+	client := flakyTrakt(t, &calls, func(w http.ResponseWriter, call int32) {
+		if call < 3 {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		w.Write([]byte(`[]`))
+	})
+
+	body, err := client.get(context.TODO(), "/search/movie?query=Heat")
+	require.NoError(t, err)
+	assert.Equal(t, "[]", string(body))
+	assert.Equal(t, int32(3), calls)
+}
+
+func TestClientDoesNotRepeatPostsOnServerErrors(t *testing.T) {
+	var calls int32
+	client := flakyTrakt(t, &calls, func(w http.ResponseWriter, call int32) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	})
+
+	_, err := client.scrobble(context.TODO(), "start", []byte(`{}`), "access123")
+	var apiErr *APIError
+	require.True(t, errors.As(err, &apiErr), "expected an api error, got %v", err)
+	assert.Equal(t, http.StatusServiceUnavailable, apiErr.StatusCode)
+	assert.Equal(t, int32(1), calls)
+}
+
+func TestClientStopsRetrying(t *testing.T) {
+	var calls int32
+	client := flakyTrakt(t, &calls, func(w http.ResponseWriter, call int32) {
+		w.WriteHeader(http.StatusInternalServerError)
+	})
+
+	_, err := client.get(context.TODO(), "/search/movie?query=Heat")
+	assert.Error(t, err)
+	assert.Equal(t, int32(4), calls)
+}
+
+func TestTokenBucket(t *testing.T) {
+	now := time.Date(2019, 02, 25, 12, 0, 0, 0, time.UTC)
+	bucket := newTokenBucket(2, 3)
+	bucket.last = now
+	bucket.now = func() time.Time { return now }
+
+	// The burst goes through at once, then one request every half second
+	for i := 0; i < 3; i++ {
+		assert.Zero(t, bucket.reserve())
+	}
+	assert.Equal(t, 500*time.Millisecond, bucket.reserve())
+	now = now.Add(500 * time.Millisecond)
+	assert.Zero(t, bucket.reserve())
+
+	// Being told the quota is gone holds everything back regardless of tokens
+	now = now.Add(time.Hour)
+	bucket.pause(now.Add(time.Minute))
+	assert.Equal(t, time.Minute, bucket.reserve())
+	now = now.Add(time.Minute)
+	assert.Zero(t, bucket.reserve())
+}
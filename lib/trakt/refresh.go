@@ -0,0 +1,195 @@
+package trakt
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/gravitational/trace"
+	log "github.com/sirupsen/logrus"
+	"github.com/xanderstrike/goplaxt/lib/store"
+)
+
+// Trakt rotates refresh tokens, so only one refresh per user may be in flight.
+// Within a process concurrent callers share the refresh through refreshFlights.
+// Across replicas the user version doubles as a lock: an odd version means a
+// refresh was claimed, whoever swaps it back to even with new tokens releases
+// it. A claim that doesn't move for longer than the token request of the
+// replica holding it can take is taken over.
+var (
+	refreshFlights = &flightGroup{calls: make(map[string]*flight)}
+	// refreshPoll is how often the user is read again while waiting
+	refreshPoll = 200 * time.Millisecond
+)
+
+// maxClaimAttempts bounds how often a refresh is claimed again after losing a race
+const maxClaimAttempts = 3
+
+// exchangeFunc trades the refresh token of a user for a new token
+type exchangeFunc func(ctx context.Context, user store.User) (store.Token, error)
+
+// authExchange refreshes tokens through the trakt oauth endpoint, root is the redirect_uri trakt expects
+func authExchange(client *Client, root string) exchangeFunc {
+	return func(ctx context.Context, user store.User) (store.Token, error) {
+		resp, err := client.RefreshToken(ctx, root, user.Username, user.RefreshToken)
+		if err != nil {
+			return store.Token{}, trace.Wrap(err)
+		}
+		return resp.Token(), nil
+	}
+}
+
+// refreshUser refreshes the tokens of user exactly once, however many callers in
+// however many replicas ask at the same time, and returns the user holding the
+// new tokens. wait is how long a refresh claimed elsewhere is waited for.
+func refreshUser(ctx context.Context, storage store.Store, user store.User, exchange exchangeFunc, wait time.Duration) (*store.User, error) {
+	refreshed, err := refreshFlights.do(ctx, user.ID, func() (*store.User, error) {
+		// The callers sharing the refresh may outlast the one that started it,
+		// and a claimed refresh must not be abandoned half way
+		ctx, cancel := context.WithTimeout(context.Background(), refreshTimeout(wait))
+		defer cancel()
+		return claimAndRefresh(ctx, storage, user, exchange, wait)
+	})
+	if refreshed == nil {
+		return nil, trace.Wrap(err)
+	}
+	// Callers sharing a flight must not share the user
+	copied := *refreshed
+	return &copied, trace.Wrap(err)
+}
+
+// refreshTimeout bounds a refresh, which waits up to wait for a refresh
+// claimed elsewhere before every claim attempt and then makes one of its own
+func refreshTimeout(wait time.Duration) time.Duration {
+	return time.Duration(maxClaimAttempts+1) * wait
+}
+
+func claimAndRefresh(ctx context.Context, storage store.Store, user store.User, exchange exchangeFunc, wait time.Duration) (*store.User, error) {
+	latest, err := storage.GetUser(ctx, user.ID)
+	if err != nil {
+		return nil, trace.Wrap(err)
+	}
+	for attempt := 0; attempt < maxClaimAttempts; attempt++ {
+		if latest.RefreshToken != user.RefreshToken {
+			// Someone else refreshed since user was read
+			return latest, nil
+		}
+		if refreshClaimed(*latest) {
+			waited, err := waitForRefresh(ctx, storage, *latest, wait)
+			if err != nil {
+				return nil, trace.Wrap(err)
+			}
+			if waited.Version != latest.Version {
+				latest = waited
+				continue
+			}
+			log.WithContext(ctx).WithField("user", user.ID).Warn("Taking over an abandoned token refresh")
+		}
+
+		claimed := *latest
+		claimed.Version += 1 + claimed.Version%2
+		err = storage.CompareAndSwapUser(ctx, latest.Version, claimed)
+		if trace.IsCompareFailed(err) {
+			if latest, err = storage.GetUser(ctx, user.ID); err != nil {
+				return nil, trace.Wrap(err)
+			}
+			continue
+		}
+		if err != nil {
+			return nil, trace.Wrap(err)
+		}
+		return refreshClaimedUser(ctx, storage, claimed, exchange)
+	}
+	return nil, trace.CompareFailed("user %s kept changing while claiming its refresh", user.ID)
+}
+
+// refreshClaimedUser exchanges the tokens of a user claimed by this process and releases the claim
+func refreshClaimedUser(ctx context.Context, storage store.Store, claimed store.User, exchange exchangeFunc) (*store.User, error) {
+	token, err := exchange(ctx, claimed)
+	if err != nil {
+		released := claimed
+		released.Version++
+		if err := storage.CompareAndSwapUser(ctx, claimed.Version, released); err != nil {
+			log.WithContext(ctx).WithField("user", claimed.ID).Warnf("failed to release token refresh: %v", err)
+		}
+		return nil, trace.Wrap(err)
+	}
+	refreshed := claimed
+	refreshed.AccessToken = token.AccessToken
+	refreshed.RefreshToken = token.RefreshToken
+	refreshed.Scope = token.Scope
+	refreshed.ExpiresAt = token.ExpiresAt
+	refreshed.Updated = time.Now()
+	refreshed.Version++
+	if err := storage.CompareAndSwapUser(ctx, claimed.Version, refreshed); err != nil {
+		// Trakt already revoked the old tokens, the new ones are all there is
+		return &refreshed, trace.Errorf("failed to save refreshed tokens: %w", err)
+	}
+	return &refreshed, nil
+}
+
+// refreshClaimed tells if some process is refreshing the tokens of user
+func refreshClaimed(user store.User) bool {
+	return user.Version%2 == 1
+}
+
+// waitForRefresh polls until the claimed user changes, returning it unchanged after wait
+func waitForRefresh(ctx context.Context, storage store.Store, claimed store.User, wait time.Duration) (*store.User, error) {
+	log.WithContext(ctx).WithField("user", claimed.ID).Debug("Token refresh claimed elsewhere, waiting")
+	deadline := time.Now().Add(wait)
+	latest := &claimed
+	for time.Now().Before(deadline) {
+		select {
+		case <-time.After(refreshPoll):
+		case <-ctx.Done():
+			return nil, trace.Wrap(ctx.Err())
+		}
+		var err error
+		if latest, err = storage.GetUser(ctx, claimed.ID); err != nil {
+			return nil, trace.Wrap(err)
+		}
+		if latest.Version != claimed.Version {
+			break
+		}
+	}
+	return latest, nil
+}
+
+// flight is a call in progress or done within a flightGroup
+type flight struct {
+	done chan struct{}
+	user *store.User
+	err  error
+}
+
+// flightGroup runs a single call per key at a time, callers arriving while it
+// is in flight get the same result. Callers stop waiting when their context is
+// done, the call carries on for the others.
+type flightGroup struct {
+	mu    sync.Mutex
+	calls map[string]*flight
+}
+
+func (g *flightGroup) do(ctx context.Context, key string, fn func() (*store.User, error)) (*store.User, error) {
+	g.mu.Lock()
+	call, ok := g.calls[key]
+	if !ok {
+		call = &flight{done: make(chan struct{})}
+		g.calls[key] = call
+		go func() {
+			call.user, call.err = fn()
+			g.mu.Lock()
+			delete(g.calls, key)
+			g.mu.Unlock()
+			close(call.done)
+		}()
+	}
+	g.mu.Unlock()
+
+	select {
+	case <-call.done:
+		return call.user, call.err
+	case <-ctx.Done():
+		return nil, trace.Wrap(ctx.Err())
+	}
+}
@@ -0,0 +1,196 @@
+package trakt
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/xanderstrike/goplaxt/lib/store"
+)
+
+// testRefreshWait is how long the tests wait for refreshes claimed elsewhere
+const testRefreshWait = 10 * time.Second
+
+func newRefreshTestUser(t *testing.T) (store.Store, store.User) {
+	storage := store.NewDiskStore(t.TempDir())
+	user := store.User{
+		ID:           "id123",
+		Username:     "halkeye",
+		AccessToken:  "access123",
+		RefreshToken: "refresh123",
+		ExpiresAt:    time.Now().Add(time.Hour),
+		Updated:      time.Now(),
+	}
+	require.NoError(t, storage.WriteUser(context.TODO(), user))
+	return storage, user
+}
+
+// countingExchange hands out new tokens, blocking until release is closed
+func countingExchange(calls *int32, release chan struct{}) exchangeFunc {
+	return func(ctx context.Context, user store.User) (store.Token, error) {
+		atomic.AddInt32(calls, 1)
+		<-release
+		return store.Token{
+			AccessToken:  "access456",
+			RefreshToken: "refresh456",
+			ExpiresAt:    time.Now().Add(90 * 24 * time.Hour),
+		}, nil
+	}
+}
+
+func TestRefreshUserIsSingleFlight(t *testing.T) {
+	storage, user := newRefreshTestUser(t)
+	var calls int32
+	release := make(chan struct{})
+	exchange := countingExchange(&calls, release)
+
+	var wg sync.WaitGroup
+	results := make(chan *store.User, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			refreshed, err := refreshUser(context.TODO(), storage, user, exchange, testRefreshWait)
+			assert.NoError(t, err)
+			results <- refreshed
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	close(results)
+
+	assert.Equal(t, int32(1), calls)
+	for refreshed := range results {
+		require.NotNil(t, refreshed)
+		assert.Equal(t, "access456", refreshed.AccessToken)
+		assert.Equal(t, "refresh456", refreshed.RefreshToken)
+	}
+	stored, err := storage.GetUser(context.TODO(), user.ID)
+	require.NoError(t, err)
+	assert.Equal(t, "refresh456", stored.RefreshToken)
+	assert.Equal(t, user.Version+2, stored.Version)
+}
+
+func TestRefreshUserOutlivesItsCaller(t *testing.T) {
+	storage, user := newRefreshTestUser(t)
+	var calls int32
+	release := make(chan struct{})
+	counting := countingExchange(&calls, release)
+	exchange := func(ctx context.Context, user store.User) (store.Token, error) {
+		token, err := counting(ctx, user)
+		if ctx.Err() != nil {
+			return store.Token{}, ctx.Err()
+		}
+		return token, err
+	}
+
+	// The webhook that started the refresh gives up
+	ctx, cancel := context.WithCancel(context.Background())
+	first := make(chan error)
+	go func() {
+		_, err := refreshUser(ctx, storage, user, exchange, testRefreshWait)
+		first <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	second := make(chan *store.User)
+	go func() {
+		refreshed, err := refreshUser(context.TODO(), storage, user, exchange, testRefreshWait)
+		assert.NoError(t, err)
+		second <- refreshed
+	}()
+	cancel()
+	assert.Error(t, <-first)
+
+	close(release)
+	refreshed := <-second
+	require.NotNil(t, refreshed)
+	assert.Equal(t, "refresh456", refreshed.RefreshToken)
+	assert.Equal(t, int32(1), calls)
+}
+
+func TestRefreshUserAcrossReplicas(t *testing.T) {
+	defer func(poll time.Duration) { refreshPoll = poll }(refreshPoll)
+	refreshPoll = 10 * time.Millisecond
+
+	storage, user := newRefreshTestUser(t)
+	var calls int32
+	release := make(chan struct{})
+	exchange := countingExchange(&calls, release)
+
+	// Replicas don't share flights, so call past them
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			refreshed, err := claimAndRefresh(context.TODO(), storage, user, exchange, testRefreshWait)
+			require.NoError(t, err)
+			assert.Equal(t, "refresh456", refreshed.RefreshToken)
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	assert.Equal(t, int32(1), calls)
+}
+
+func TestRefreshUserAlreadyRefreshed(t *testing.T) {
+	storage, user := newRefreshTestUser(t)
+	rotated := user
+	rotated.RefreshToken = "refresh789"
+	require.NoError(t, storage.WriteUser(context.TODO(), rotated))
+
+	refreshed, err := refreshUser(context.TODO(), storage, user, func(ctx context.Context, user store.User) (store.Token, error) {
+		t.Fatal("tokens refreshed twice")
+		return store.Token{}, nil
+	}, testRefreshWait)
+	require.NoError(t, err)
+	assert.Equal(t, "refresh789", refreshed.RefreshToken)
+}
+
+func TestRefreshUserFailureKeepsTokens(t *testing.T) {
+	storage, user := newRefreshTestUser(t)
+
+	_, err := refreshUser(context.TODO(), storage, user, func(ctx context.Context, user store.User) (store.Token, error) {
+		return store.Token{}, errors.New("trakt is down")
+	}, testRefreshWait)
+	assert.Error(t, err)
+
+	stored, err := storage.GetUser(context.TODO(), user.ID)
+	require.NoError(t, err)
+	assert.Equal(t, "refresh123", stored.RefreshToken)
+
+	// The abandoned claim doesn't stand in the way of the next attempt
+	var calls int32
+	release := make(chan struct{})
+	close(release)
+	refreshed, err := refreshUser(context.TODO(), storage, *stored, countingExchange(&calls, release), testRefreshWait)
+	require.NoError(t, err)
+	assert.Equal(t, "refresh456", refreshed.RefreshToken)
+}
+
+func TestRefreshUserTakesOverAbandonedClaim(t *testing.T) {
+	defer func(poll time.Duration) { refreshPoll = poll }(refreshPoll)
+	refreshPoll = 10 * time.Millisecond
+
+	storage, user := newRefreshTestUser(t)
+	// A replica claimed the refresh and died
+	user.Version = 1
+	require.NoError(t, storage.CompareAndSwapUser(context.TODO(), 0, user))
+
+	var calls int32
+	release := make(chan struct{})
+	close(release)
+	refreshed, err := refreshUser(context.TODO(), storage, user, countingExchange(&calls, release), 50*time.Millisecond)
+	require.NoError(t, err)
+	assert.Equal(t, "refresh456", refreshed.RefreshToken)
+	assert.Equal(t, int64(4), refreshed.Version)
+	assert.Equal(t, int32(1), calls)
+}
@@ -0,0 +1,214 @@
+package trakt
+
+import (
+	"context"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/gravitational/trace"
+	log "github.com/sirupsen/logrus"
+	"github.com/xanderstrike/goplaxt/lib/store"
+	"github.com/xanderstrike/goplaxt/tracing"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+var refreshAttempts = tracing.Int64Counter(
+	"goplaxt.token.refreshes",
+	"Background token refresh attempts, by outcome",
+)
+
+// refreshFailure tracks a user whose refresh keeps failing so it is retried with backoff
+type refreshFailure struct {
+	attempts int
+	next     time.Time
+}
+
+// Refresher periodically scans the store for tokens close to expiring and
+// refreshes them, so users who don't watch anything for a while keep working
+type Refresher struct {
+	storage store.Store
+	// Interval between scans of the whole store
+	Interval time.Duration
+	// Margin is how long before expiring a token gets refreshed
+	Margin time.Duration
+	// Concurrency bounds how many refreshes run at once
+	Concurrency int
+	// Jitter is the longest random delay added before each refresh
+	Jitter time.Duration
+	// RetryBackoff is the delay before retrying a failed refresh, doubled on every failure
+	RetryBackoff time.Duration
+
+	tokens *TokenManager
+	now    func() time.Time
+
+	mu       sync.Mutex
+	failures map[string]*refreshFailure
+}
+
+// RefreshSummary is the outcome of one scan
+type RefreshSummary struct {
+	Scanned   int
+	Refreshed int
+	Failed    int
+	// Deferred users needed a refresh but are waiting to retry an earlier failure
+	Deferred int
+}
+
+// NewRefresher creates a refresher with sensible defaults, walking storage and refreshing through tokens
+func NewRefresher(storage store.Store, tokens *TokenManager) *Refresher {
+	return &Refresher{
+		storage:      storage,
+		Interval:     time.Hour,
+		Margin:       72 * time.Hour,
+		Concurrency:  4,
+		Jitter:       30 * time.Second,
+		RetryBackoff: 5 * time.Minute,
+		tokens:       tokens,
+		now:          time.Now,
+		failures:     make(map[string]*refreshFailure),
+	}
+}
+
+// Run scans the store every Interval until ctx is done
+func (r *Refresher) Run(ctx context.Context) {
+	ticker := time.NewTicker(r.Interval)
+	defer ticker.Stop()
+	for {
+		summary, err := r.RunOnce(ctx)
+		logger := log.WithContext(ctx).WithFields(log.Fields{
+			"scanned":   summary.Scanned,
+			"refreshed": summary.Refreshed,
+			"failed":    summary.Failed,
+			"deferred":  summary.Deferred,
+		})
+		if err != nil {
+			logger.Errorf("token refresh scan failed: %v", err)
+		} else {
+			logger.Print("Token refresh scan done")
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// RunOnce scans the whole store once, refreshing every token about to expire
+func (r *Refresher) RunOnce(ctx context.Context) (RefreshSummary, error) {
+	ctx, span := tracing.Tracer.Start(ctx, "refresher")
+	defer span.End()
+
+	var summary RefreshSummary
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	slots := make(chan struct{}, r.Concurrency)
+	count := func(outcome *int) {
+		mu.Lock()
+		defer mu.Unlock()
+		*outcome++
+	}
+
+	err := r.scan(ctx, func(user store.User) error {
+		count(&summary.Scanned)
+		if !user.NeedsRefresh(r.now(), r.Margin) {
+			return nil
+		}
+		if r.deferred(user.ID) {
+			count(&summary.Deferred)
+			refreshAttempts.Add(ctx, 1, attribute.String("outcome", "deferred"))
+			return nil
+		}
+
+		select {
+		case slots <- struct{}{}:
+		case <-ctx.Done():
+			return trace.Wrap(ctx.Err())
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-slots }()
+			if err := r.refreshUser(ctx, user); err != nil {
+				count(&summary.Failed)
+			} else {
+				count(&summary.Refreshed)
+			}
+		}()
+		return nil
+	})
+	wg.Wait()
+	return summary, err
+}
+
+// scan calls fn for every user in the store, stopping at the first error
+func (r *Refresher) scan(ctx context.Context, fn func(store.User) error) error {
+	cursor := ""
+	for {
+		users, next, err := r.storage.ListUsers(ctx, cursor, 100)
+		if err != nil {
+			return trace.Wrap(err)
+		}
+		for _, user := range users {
+			if err := fn(*user); err != nil {
+				return err
+			}
+		}
+		if next == "" {
+			return nil
+		}
+		cursor = next
+	}
+}
+
+func (r *Refresher) refreshUser(ctx context.Context, user store.User) error {
+	logger := log.WithContext(ctx).WithField("user", user.ID)
+	if r.Jitter > 0 {
+		select {
+		case <-time.After(time.Duration(rand.Int63n(int64(r.Jitter)))):
+		case <-ctx.Done():
+			return trace.Wrap(ctx.Err())
+		}
+	}
+
+	refreshed, err := r.tokens.Refresh(ctx, user)
+	if err != nil {
+		attempts := r.recordFailure(user.ID)
+		refreshAttempts.Add(ctx, 1, attribute.String("outcome", "failure"))
+		logger.WithField("attempts", attempts).Errorf("background token refresh failed, will retry: %v", err)
+		return trace.Wrap(err)
+	}
+
+	r.mu.Lock()
+	delete(r.failures, user.ID)
+	r.mu.Unlock()
+	refreshAttempts.Add(ctx, 1, attribute.String("outcome", "success"))
+	logger.WithField("expiresAt", refreshed.ExpiresAt).Print("Refreshed token in the background")
+	return nil
+}
+
+// deferred tells if a user is still backing off from an earlier failure
+func (r *Refresher) deferred(id string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	failure, ok := r.failures[id]
+	return ok && r.now().Before(failure.next)
+}
+
+func (r *Refresher) recordFailure(id string) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	failure, ok := r.failures[id]
+	if !ok {
+		failure = &refreshFailure{}
+		r.failures[id] = failure
+	}
+	failure.attempts++
+	backoff := r.RetryBackoff << uint(failure.attempts-1)
+	if backoff > 24*time.Hour || backoff <= 0 {
+		backoff = 24 * time.Hour
+	}
+	failure.next = r.now().Add(backoff)
+	return failure.attempts
+}
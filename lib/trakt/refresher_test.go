@@ -0,0 +1,111 @@
+package trakt
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/xanderstrike/goplaxt/lib/store"
+)
+
+func TestRefresherRefreshesExpiringTokens(t *testing.T) {
+	ctx := context.TODO()
+	now := time.Date(2019, 02, 25, 12, 0, 0, 0, time.UTC)
+	storage := store.NewDiskStore(t.TempDir())
+	for id, expiresAt := range map[string]time.Time{
+		"expiring": now.Add(time.Hour),
+		"fresh":    now.Add(30 * 24 * time.Hour),
+		"broken":   now.Add(time.Hour),
+	} {
+		require.NoError(t, storage.WriteUser(ctx, store.User{
+			ID:           id,
+			Username:     id,
+			AccessToken:  "access-" + id,
+			RefreshToken: "refresh-" + id,
+			ExpiresAt:    expiresAt,
+			Updated:      now,
+		}))
+	}
+
+	var mu sync.Mutex
+	calls := map[string]int{}
+	refresher := NewRefresher(storage, NewTokenManager(NewClient(), storage, "https://plaxt.example.com", time.Hour))
+	refresher.Jitter = 0
+	refresher.now = func() time.Time { return now }
+	refresher.tokens.exchange = func(ctx context.Context, user store.User) (store.Token, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		calls[user.ID]++
+		if user.ID == "broken" {
+			return store.Token{}, errors.New("trakt is down")
+		}
+		return store.Token{
+			AccessToken:  "new-access",
+			RefreshToken: "new-refresh",
+			Scope:        "public",
+			ExpiresAt:    now.Add(90 * 24 * time.Hour),
+		}, nil
+	}
+
+	summary, err := refresher.RunOnce(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, RefreshSummary{Scanned: 3, Refreshed: 1, Failed: 1}, summary)
+	assert.Equal(t, map[string]int{"expiring": 1, "broken": 1}, calls)
+
+	user, err := storage.GetUser(ctx, "expiring")
+	require.NoError(t, err)
+	assert.Equal(t, "new-access", user.AccessToken)
+	assert.Equal(t, "new-refresh", user.RefreshToken)
+
+	// Failures are kept, not deleted, and retried once the backoff is over
+	user, err = storage.GetUser(ctx, "broken")
+	require.NoError(t, err)
+	assert.Equal(t, "access-broken", user.AccessToken)
+
+	summary, err = refresher.RunOnce(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, RefreshSummary{Scanned: 3, Deferred: 1}, summary)
+
+	now = now.Add(refresher.RetryBackoff)
+	summary, err = refresher.RunOnce(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, RefreshSummary{Scanned: 3, Failed: 1}, summary)
+	assert.Equal(t, 2, calls["broken"])
+}
+
+func TestRefresherBoundsConcurrency(t *testing.T) {
+	ctx := context.TODO()
+	now := time.Now()
+	storage := store.NewDiskStore(t.TempDir())
+	for _, id := range []string{"a", "b", "c", "d", "e", "f"} {
+		require.NoError(t, storage.WriteUser(ctx, store.User{ID: id, Username: id, ExpiresAt: now, Updated: now}))
+	}
+
+	var mu sync.Mutex
+	running, peak := 0, 0
+	refresher := NewRefresher(storage, NewTokenManager(NewClient(), storage, "https://plaxt.example.com", time.Hour))
+	refresher.Concurrency = 2
+	refresher.Jitter = 0
+	refresher.tokens.exchange = func(ctx context.Context, user store.User) (store.Token, error) {
+		mu.Lock()
+		running++
+		if running > peak {
+			peak = running
+		}
+		mu.Unlock()
+		time.Sleep(10 * time.Millisecond)
+		mu.Lock()
+		running--
+		mu.Unlock()
+		return store.Token{AccessToken: "new", ExpiresAt: now.Add(90 * 24 * time.Hour)}, nil
+	}
+
+	summary, err := refresher.RunOnce(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 6, summary.Refreshed)
+	assert.Equal(t, 2, peak)
+}
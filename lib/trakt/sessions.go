@@ -0,0 +1,177 @@
+package trakt
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/gravitational/trace"
+	"github.com/xanderstrike/goplaxt/lib/store"
+	"github.com/xanderstrike/plexhooks"
+)
+
+// Playback states of a session
+const (
+	statePlaying   = "playing"
+	statePaused    = "paused"
+	stateStopped   = "stopped"
+	stateScrobbled = "scrobbled"
+	// stateUnfinished is a scrobble short of the watched threshold, which went
+	// to trakt as a pause
+	stateUnfinished = "unfinished"
+)
+
+// idleEvent marks the webhook of a play checked for a follow-up, it pauses the
+// session when plex didn't send anything since
+const idleEvent = "goplaxt.idle"
+
+// SessionTracker follows the playback of every item on every player, so only
+// webhooks that change something are sent to trakt
+type SessionTracker struct {
+	sessions store.SessionStore
+	// Debounce is how long pauses and resumes are held back, so a burst of them
+	// only sends the last one
+	Debounce time.Duration
+	// TTL is how long a session is remembered after its last webhook
+	TTL time.Duration
+}
+
+// NewSessionTracker creates a tracker keeping its sessions in sessions
+func NewSessionTracker(sessions store.SessionStore) *SessionTracker {
+	return &SessionTracker{
+		sessions: sessions,
+		Debounce: 5 * time.Second,
+		TTL:      12 * time.Hour,
+	}
+}
+
+// sessionKey tells sessions apart by user, player and item
+func sessionKey(userID string, pr plexhooks.PlexResponse) string {
+	return userID + ":" + pr.Player.Uuid + ":" + pr.Metadata.RatingKey
+}
+
+// playerKey is the session of a whole player of a user
+func playerKey(userID string, pr plexhooks.PlexResponse) string {
+	return userID + ":" + pr.Player.Uuid
+}
+
+// Delay is how long a webhook is held back before it is tracked, so a burst
+// of pauses and resumes only sends the last one
+func (t *SessionTracker) Delay(pr plexhooks.PlexResponse) time.Duration {
+	if pr.Event == "media.pause" || pr.Event == "media.resume" {
+		return t.Debounce
+	}
+	return 0
+}
+
+// Observe records a webhook once it is queued, so the pauses and resumes held
+// back before it are dropped
+func (t *SessionTracker) Observe(ctx context.Context, userID string, pr plexhooks.PlexResponse, receivedAt time.Time) error {
+	return trace.Wrap(t.sessions.UpdateSession(ctx, sessionKey(userID, pr), t.TTL, func(session *store.Session) {
+		if receivedAt.After(session.ReceivedAt) {
+			session.ReceivedAt = receivedAt
+		}
+	}))
+}
+
+// Track applies a webhook received at receivedAt to its session, telling if
+// it should be sent to trakt. Webhooks older than the last one applied,
+// pauses and resumes superseded by a newer webhook, and events that don't
+// change the state are dropped. The same webhook is sent again when its
+// delivery is retried.
+func (t *SessionTracker) Track(ctx context.Context, userID string, pr plexhooks.PlexResponse, receivedAt time.Time) (bool, error) {
+	var send bool
+	err := t.sessions.UpdateSession(ctx, sessionKey(userID, pr), t.TTL, func(session *store.Session) {
+		send = false
+		switch {
+		case session.Event == pr.Event && session.EventAt.Equal(receivedAt):
+			send = true
+			return
+		case session.EventAt.After(receivedAt):
+			return
+		case superseded(pr.Event) && session.ReceivedAt.After(receivedAt):
+			return
+		}
+		state, changed := transition(session.State, pr.Event)
+		if !changed {
+			return
+		}
+		send = true
+		session.State = state
+		session.Event = pr.Event
+		session.EventAt = receivedAt
+		if receivedAt.After(session.ReceivedAt) {
+			session.ReceivedAt = receivedAt
+		}
+	})
+	return send, trace.Wrap(err)
+}
+
+// Play records that the player of pr started its item with the webhook
+// payload, received at receivedAt. It returns the webhook that started the
+// item the player moved on from, nil when the player didn't play anything else
+// before.
+func (t *SessionTracker) Play(ctx context.Context, userID string, pr plexhooks.PlexResponse, payload []byte, receivedAt time.Time) ([]byte, error) {
+	var left []byte
+	err := t.sessions.UpdateSession(ctx, playerKey(userID, pr), t.TTL, func(session *store.Session) {
+		left = nil
+		if !receivedAt.After(session.EventAt) {
+			return
+		}
+		if session.Item != "" && session.Item != pr.Metadata.RatingKey {
+			left = session.Payload
+		}
+		session.Item = pr.Metadata.RatingKey
+		session.Payload = payload
+		session.EventAt = receivedAt
+	})
+	return left, trace.Wrap(err)
+}
+
+// Unfinished records that the scrobble received at receivedAt fell short of
+// the watched threshold, so the stop following it is still sent
+func (t *SessionTracker) Unfinished(ctx context.Context, userID string, pr plexhooks.PlexResponse, receivedAt time.Time) error {
+	return trace.Wrap(t.sessions.UpdateSession(ctx, sessionKey(userID, pr), t.TTL, func(session *store.Session) {
+		if session.State == stateScrobbled && session.EventAt.Equal(receivedAt) {
+			session.State = stateUnfinished
+		}
+	}))
+}
+
+// superseded tells if event is dropped once a newer webhook came in for its session
+func superseded(event string) bool {
+	return event == "media.pause" || event == "media.resume" || event == idleEvent
+}
+
+// idlePayload turns the webhook of a play into the one checking it for a follow-up
+func idlePayload(payload []byte) ([]byte, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(payload, &fields); err != nil {
+		return nil, trace.BadParameter("unreadable webhook: %v", err)
+	}
+	fields["event"] = json.RawMessage(`"` + idleEvent + `"`)
+	data, err := json.Marshal(fields)
+	return data, trace.Wrap(err)
+}
+
+// transition returns the state event leads to from state, and whether that
+// changes anything. Sessions of unknown state, like the ones started before a
+// restart, take every playback event.
+func transition(state, event string) (string, bool) {
+	switch event {
+	case "media.play", "media.resume":
+		return statePlaying, state != statePlaying
+	case "media.pause":
+		return statePaused, state == "" || state == statePlaying
+	case "media.stop":
+		// Trakt turns the stop after a scrobble down, unless the scrobble only paused
+		return stateStopped, state != stateStopped && state != stateScrobbled
+	case "media.scrobble":
+		return stateScrobbled, state != stateScrobbled && state != stateUnfinished
+	case idleEvent:
+		// The player went away without a word, trakt would show it watching until the runtime is over
+		return statePaused, state == statePlaying
+	}
+	// Nothing trakt cares about
+	return state, false
+}
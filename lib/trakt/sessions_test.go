@@ -0,0 +1,183 @@
+package trakt
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/xanderstrike/goplaxt/lib/store"
+	"github.com/xanderstrike/plexhooks"
+)
+
+func playerEvent(event string) plexhooks.PlexResponse {
+	pr := plexhooks.PlexResponse{Event: event}
+	pr.Player.Uuid = "player123"
+	pr.Metadata.RatingKey = "59852"
+	return pr
+}
+
+func TestSessionTransitions(t *testing.T) {
+	start := time.Date(2019, 02, 25, 10, 30, 15, 0, time.UTC)
+	tests := []struct {
+		name     string
+		events   []string
+		expected []bool
+	}{
+		{"Repeated plays", []string{"media.play", "media.play", "media.resume"}, []bool{true, false, false}},
+		{"Pause and resume", []string{"media.play", "media.pause", "media.pause", "media.resume"}, []bool{true, true, false, true}},
+		{"Stop after scrobble", []string{"media.play", "media.scrobble", "media.stop", "media.stop"}, []bool{true, true, false, false}},
+		{"Pause after stop", []string{"media.play", "media.stop", "media.pause", "media.play"}, []bool{true, true, false, true}},
+		{"Unknown session", []string{"media.pause"}, []bool{true}},
+		{"Not playback", []string{"media.rate", "library.new"}, []bool{false, false}},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			tracker := NewSessionTracker(store.NewMemorySessions())
+			for i, event := range test.events {
+				send, err := tracker.Track(context.TODO(), "id123", playerEvent(event), start.Add(time.Duration(i)*time.Minute))
+				require.NoError(t, err)
+				assert.Equal(t, test.expected[i], send, "%s #%d", event, i)
+			}
+		})
+	}
+}
+
+func TestSessionUnfinishedScrobble(t *testing.T) {
+	tracker := NewSessionTracker(store.NewMemorySessions())
+	now := time.Now()
+
+	send, err := tracker.Track(context.TODO(), "id123", playerEvent("media.scrobble"), now)
+	require.NoError(t, err)
+	assert.True(t, send)
+	// A scrobble applied before this one doesn't change it
+	require.NoError(t, tracker.Unfinished(context.TODO(), "id123", playerEvent("media.scrobble"), now.Add(-time.Minute)))
+	require.NoError(t, tracker.Unfinished(context.TODO(), "id123", playerEvent("media.scrobble"), now))
+
+	send, err = tracker.Track(context.TODO(), "id123", playerEvent("media.scrobble"), now.Add(time.Minute))
+	require.NoError(t, err)
+	assert.False(t, send, "the scrobble was sent already")
+	send, err = tracker.Track(context.TODO(), "id123", playerEvent("media.stop"), now.Add(2*time.Minute))
+	require.NoError(t, err)
+	assert.True(t, send, "trakt only has the item paused")
+}
+
+func TestSessionOutOfOrder(t *testing.T) {
+	tracker := NewSessionTracker(store.NewMemorySessions())
+	now := time.Now()
+
+	send, err := tracker.Track(context.TODO(), "id123", playerEvent("media.stop"), now)
+	require.NoError(t, err)
+	assert.True(t, send)
+	// A play that was stuck retrying comes in after the stop that ended it
+	send, err = tracker.Track(context.TODO(), "id123", playerEvent("media.play"), now.Add(-time.Minute))
+	require.NoError(t, err)
+	assert.False(t, send)
+
+	// Other players and items have sessions of their own
+	other := playerEvent("media.play")
+	other.Player.Uuid = "player456"
+	send, err = tracker.Track(context.TODO(), "id123", other, now.Add(-time.Minute))
+	require.NoError(t, err)
+	assert.True(t, send)
+}
+
+func TestSessionRetries(t *testing.T) {
+	tracker := NewSessionTracker(store.NewMemorySessions())
+	now := time.Now()
+
+	for i := 0; i < 2; i++ {
+		send, err := tracker.Track(context.TODO(), "id123", playerEvent("media.play"), now)
+		require.NoError(t, err)
+		assert.True(t, send, "attempt %d", i)
+	}
+}
+
+func TestSessionDebounce(t *testing.T) {
+	tracker := NewSessionTracker(store.NewMemorySessions())
+	now := time.Now()
+
+	assert.Zero(t, tracker.Delay(playerEvent("media.play")))
+	require.NoError(t, tracker.Observe(context.TODO(), "id123", playerEvent("media.play"), now))
+	send, err := tracker.Track(context.TODO(), "id123", playerEvent("media.play"), now)
+	require.NoError(t, err)
+	assert.True(t, send)
+
+	// A quick pause and resume are held back, and both dropped once they turn out to cancel out
+	for i, event := range []string{"media.pause", "media.resume"} {
+		assert.Equal(t, tracker.Debounce, tracker.Delay(playerEvent(event)))
+		require.NoError(t, tracker.Observe(context.TODO(), "id123", playerEvent(event), now.Add(time.Duration(i+1)*time.Second)))
+	}
+	for i, event := range []string{"media.pause", "media.resume"} {
+		send, err := tracker.Track(context.TODO(), "id123", playerEvent(event), now.Add(time.Duration(i+1)*time.Second))
+		require.NoError(t, err)
+		assert.False(t, send, event)
+	}
+}
+
+func TestSessionIdle(t *testing.T) {
+	tracker := NewSessionTracker(store.NewMemorySessions())
+	now := time.Now()
+
+	send, err := tracker.Track(context.TODO(), "id123", playerEvent("media.play"), now)
+	require.NoError(t, err)
+	assert.True(t, send)
+	for i := 0; i < 2; i++ {
+		// The check is sent again when its delivery is retried
+		send, err = tracker.Track(context.TODO(), "id123", playerEvent(idleEvent), now)
+		require.NoError(t, err)
+		assert.True(t, send, "attempt %d", i)
+	}
+
+	// A session that heard from plex since is left alone
+	now = now.Add(time.Minute)
+	require.NoError(t, tracker.Observe(context.TODO(), "id123", playerEvent("media.resume"), now))
+	require.NoError(t, tracker.Observe(context.TODO(), "id123", playerEvent("media.stop"), now.Add(time.Minute)))
+	send, err = tracker.Track(context.TODO(), "id123", playerEvent(idleEvent), now)
+	require.NoError(t, err)
+	assert.False(t, send)
+}
+
+func TestIdlePayload(t *testing.T) {
+	payload, err := idlePayload([]byte(heatPlay))
+	require.NoError(t, err)
+	pr, err := plexhooks.ParseWebhook(payload)
+	require.NoError(t, err)
+	assert.Equal(t, idleEvent, pr.Event)
+	assert.Equal(t, "Heat", pr.Metadata.Title)
+}
+
+func TestSessionPlay(t *testing.T) {
+	tracker := NewSessionTracker(store.NewMemorySessions())
+	now := time.Now()
+
+	heat := playerEvent("media.play")
+	left, err := tracker.Play(context.TODO(), "id123", heat, []byte("heat"), now)
+	require.NoError(t, err)
+	assert.Nil(t, left)
+	left, err = tracker.Play(context.TODO(), "id123", playerEvent("media.resume"), []byte("heat resumed"), now.Add(time.Minute))
+	require.NoError(t, err)
+	assert.Nil(t, left, "the player is still on the same item")
+
+	ronin := playerEvent("media.play")
+	ronin.Metadata.RatingKey = "60123"
+	left, err = tracker.Play(context.TODO(), "id123", ronin, []byte("ronin"), now.Add(2*time.Minute))
+	require.NoError(t, err)
+	assert.Equal(t, []byte("heat resumed"), left)
+
+	// Retries and webhooks coming in late don't move the player back
+	left, err = tracker.Play(context.TODO(), "id123", ronin, []byte("ronin"), now.Add(2*time.Minute))
+	require.NoError(t, err)
+	assert.Nil(t, left)
+	left, err = tracker.Play(context.TODO(), "id123", heat, []byte("heat"), now)
+	require.NoError(t, err)
+	assert.Nil(t, left)
+
+	other := playerEvent("media.play")
+	other.Player.Uuid = "player456"
+	left, err = tracker.Play(context.TODO(), "id123", other, []byte("heat elsewhere"), now.Add(3*time.Minute))
+	require.NoError(t, err)
+	assert.Nil(t, left, "other players keep their own items")
+}
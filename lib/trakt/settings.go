@@ -0,0 +1,101 @@
+package trakt
+
+import (
+	"net/url"
+	"strconv"
+
+	"github.com/gravitational/trace"
+)
+
+// Pause actions, what a pause in plex sends to trakt
+const (
+	// PauseActionPause pauses the playback on trakt, so it can be resumed later
+	PauseActionPause = "pause"
+	// PauseActionStop treats a pause like a stop, so pausing past the watched
+	// threshold counts as watched
+	PauseActionStop = "stop"
+	// PauseActionIgnore sends nothing, trakt keeps showing the item as watching
+	PauseActionIgnore = "ignore"
+)
+
+// traktWatched is the progress from which trakt records a stopped playback as
+// watched rather than paused
+const traktWatched = 80
+
+// ScrobbleSettings tune how webhooks turn into scrobbles
+type ScrobbleSettings struct {
+	// WatchedThreshold is the progress in percent from which a playback that
+	// ends counts as watched. Zero follows plex, which sends media.scrobble at
+	// 90%, and trakt for stops. Trakt only records watches from 80% on, so
+	// lower thresholds are refused
+	WatchedThreshold int
+	// PauseAction is one of the PauseAction constants
+	PauseAction string
+}
+
+// DefaultScrobbleSettings follow plex and trakt, pausing on pauses
+var DefaultScrobbleSettings = ScrobbleSettings{PauseAction: PauseActionPause}
+
+// Check tells if the settings make sense
+func (s ScrobbleSettings) Check() error {
+	if s.WatchedThreshold < 0 || s.WatchedThreshold > 100 {
+		return trace.BadParameter("watched threshold %d is not a percentage", s.WatchedThreshold)
+	}
+	if s.WatchedThreshold > 0 && s.WatchedThreshold < traktWatched {
+		return trace.BadParameter("watched threshold %d is below the %d%% trakt records watches from", s.WatchedThreshold, traktWatched)
+	}
+	switch s.PauseAction {
+	case PauseActionPause, PauseActionStop, PauseActionIgnore:
+		return nil
+	}
+	return trace.BadParameter("unknown pause action %q", s.PauseAction)
+}
+
+// Override returns s with the settings of a webhook link applied, "watched"
+// is the watched threshold and "pause" the pause action
+func (s ScrobbleSettings) Override(query url.Values) (ScrobbleSettings, error) {
+	if watched := query.Get("watched"); watched != "" {
+		threshold, err := strconv.Atoi(watched)
+		if err != nil {
+			return s, trace.BadParameter("watched threshold %q is not a number", watched)
+		}
+		s.WatchedThreshold = threshold
+	}
+	if pause := query.Get("pause"); pause != "" {
+		s.PauseAction = pause
+	}
+	return s, trace.Wrap(s.Check())
+}
+
+// WebhookSettings picks the scrobble settings out of the query of a webhook
+// link, failing when they don't make sense
+func WebhookSettings(query url.Values) (url.Values, error) {
+	if _, err := DefaultScrobbleSettings.Override(query); err != nil {
+		return nil, trace.Wrap(err)
+	}
+	settings := url.Values{}
+	for _, key := range []string{"watched", "pause"} {
+		if value := query.Get(key); value != "" {
+			settings.Set(key, value)
+		}
+	}
+	return settings, nil
+}
+
+// finish decides what a playback ending at progress sends to trakt, a
+// media.scrobble being plex telling it was watched
+func (s ScrobbleSettings) finish(event string, progress int) (string, int) {
+	watched := progress >= traktWatched || event == "media.scrobble"
+	if s.WatchedThreshold > 0 {
+		watched = progress >= s.WatchedThreshold
+	}
+	if !watched {
+		return "pause", progress
+	}
+	// Plex can scrobble short of trakt's threshold when trakt has a longer
+	// runtime, trakt only records stops from there on
+	if progress < traktWatched {
+		progress = traktWatched
+	}
+	return "stop", progress
+}
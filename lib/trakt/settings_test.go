@@ -0,0 +1,34 @@
+package trakt
+
+import (
+	"net/url"
+	"testing"
+
+	"github.com/gravitational/trace"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestScrobbleSettingsOverride(t *testing.T) {
+	settings, err := DefaultScrobbleSettings.Override(url.Values{"watched": {"95"}, "pause": {"ignore"}})
+	require.NoError(t, err)
+	assert.Equal(t, ScrobbleSettings{WatchedThreshold: 95, PauseAction: PauseActionIgnore}, settings)
+
+	settings, err = settings.Override(url.Values{"id": {"id123"}})
+	require.NoError(t, err)
+	assert.Equal(t, ScrobbleSettings{WatchedThreshold: 95, PauseAction: PauseActionIgnore}, settings)
+
+	for _, query := range []url.Values{{"watched": {"ninety"}}, {"watched": {"101"}}, {"watched": {"70"}}, {"pause": {"rewind"}}} {
+		_, err := DefaultScrobbleSettings.Override(query)
+		assert.True(t, trace.IsBadParameter(err), "expected %v to be refused, got %v", query, err)
+	}
+}
+
+func TestWebhookSettings(t *testing.T) {
+	settings, err := WebhookSettings(url.Values{"id": {"id123"}, "watched": {"85"}})
+	require.NoError(t, err)
+	assert.Equal(t, "watched=85", settings.Encode())
+
+	_, err = WebhookSettings(url.Values{"id": {"id123"}, "pause": {"later"}})
+	assert.True(t, trace.IsBadParameter(err))
+}
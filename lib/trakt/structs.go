@@ -1,5 +1,7 @@
 package trakt
 
+import "time"
+
 // Ids represent the IDs representing a media item accross the metadata providers
 type Ids struct {
 	Trakt  int    `json:"trakt"`
@@ -16,6 +18,11 @@ type Show struct {
 	Ids   Ids
 }
 
+// ShowSearchResult represent a search result for a show
+type ShowSearchResult struct {
+	Show Show
+}
+
 // ShowInfo represent a show
 type ShowInfo struct {
 	Show    Show
@@ -44,6 +51,9 @@ type Movie struct {
 	Title string `json:"title"`
 	Year  int    `json:"year"`
 	Ids   Ids    `json:"ids"`
+
+	// Returned only with extended info, which movie searches ask for
+	Runtime int `json:"runtime,omitempty"`
 }
 
 // MovieSearchResult represent a search result for a movie
@@ -62,3 +72,29 @@ type MovieScrobbleBody struct {
 	Movie    Movie `json:"movie"`
 	Progress int   `json:"progress"`
 }
+
+// MovieHistory represent a movie watched at a given time
+type MovieHistory struct {
+	Movie
+	WatchedAt time.Time `json:"watched_at"`
+}
+
+// EpisodeHistory represent an episode watched at a given time
+type EpisodeHistory struct {
+	Episode
+	WatchedAt time.Time `json:"watched_at"`
+}
+
+// HistoryBody represent the items to add to the watched history
+type HistoryBody struct {
+	Movies   []MovieHistory   `json:"movies,omitempty"`
+	Episodes []EpisodeHistory `json:"episodes,omitempty"`
+}
+
+// HistoryResult represent how many of the items trakt added to the history
+type HistoryResult struct {
+	Added struct {
+		Movies   int `json:"movies"`
+		Episodes int `json:"episodes"`
+	} `json:"added"`
+}
@@ -0,0 +1,75 @@
+package trakt
+
+import (
+	"context"
+	"time"
+
+	"github.com/gravitational/trace"
+	log "github.com/sirupsen/logrus"
+	"github.com/xanderstrike/goplaxt/lib/store"
+)
+
+// TokenManager hands out trakt credentials that are good to use, refreshing
+// and saving them as they get close to expiring
+type TokenManager struct {
+	storage store.Store
+	// margin is how long before expiring a token gets refreshed
+	margin   time.Duration
+	exchange exchangeFunc
+	// wait is how long a refresh claimed by another replica is waited for
+	wait time.Duration
+	now  func() time.Time
+}
+
+// NewTokenManager creates a token manager refreshing through client and saving
+// to storage, root is the url trakt redirects to which it wants to hear again
+// on every refresh
+func NewTokenManager(client *Client, storage store.Store, root string, margin time.Duration) *TokenManager {
+	return &TokenManager{
+		storage:  storage,
+		margin:   margin,
+		exchange: authExchange(client, root),
+		wait:     client.refreshWait(),
+		now:      time.Now,
+	}
+}
+
+// Fresh returns user holding credentials valid for at least the margin,
+// refreshing them first when needed. A failed refresh is only logged while
+// the current token still works, the next call tries again. New tokens that
+// could not be saved are returned along with the error, so they can at least
+// be used this once.
+func (m *TokenManager) Fresh(ctx context.Context, user store.User) (*store.User, error) {
+	if !user.NeedsRefresh(m.now(), m.margin) {
+		return &user, nil
+	}
+	logger := log.WithContext(ctx).WithField("user", user.ID)
+	logger.WithField("expiresAt", user.ExpiresAt).Println("User access token outdated, refreshing...")
+
+	refreshed, err := m.Refresh(ctx, user)
+	switch {
+	case refreshed != nil:
+		return refreshed, trace.Wrap(err)
+	case !user.Expired(m.now()) && !trace.IsNotFound(err):
+		logger.WithField("expiresAt", user.ExpiresAt).Warnf("refresh failed, using the current token: %v", err)
+		return &user, nil
+	}
+	return nil, trace.Wrap(err)
+}
+
+// Refresh trades the refresh token of user for new credentials right away
+func (m *TokenManager) Refresh(ctx context.Context, user store.User) (*store.User, error) {
+	return refreshUser(ctx, m.storage, user, m.exchange, m.wait)
+}
+
+// AccessToken returns a bearer token for user valid for at least the margin
+func (m *TokenManager) AccessToken(ctx context.Context, user store.User) (string, error) {
+	fresh, err := m.Fresh(ctx, user)
+	if fresh == nil {
+		return "", trace.Wrap(err)
+	}
+	if err != nil {
+		log.WithContext(ctx).WithField("user", user.ID).Errorf("using tokens that were not saved: %v", err)
+	}
+	return fresh.AccessToken, nil
+}
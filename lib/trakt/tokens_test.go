@@ -0,0 +1,124 @@
+package trakt
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/xanderstrike/goplaxt/lib/store"
+	"github.com/xanderstrike/plexhooks"
+)
+
+// fakeTrakt answers the few endpoints a movie scrobble goes through
+type fakeTrakt struct {
+	mu         sync.Mutex
+	refreshes  int
+	scrobbles  []string
+	failTokens bool
+}
+
+func (f *fakeTrakt) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch r.URL.Path {
+	case "/oauth/token":
+		var body map[string]string
+		json.NewDecoder(r.Body).Decode(&body)
+		if f.failTokens || body["grant_type"] != "refresh_token" || body["refresh_token"] != "refresh123" {
+			w.WriteHeader(http.StatusUnauthorized)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+			return
+		}
+		f.refreshes++
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"access_token":  "access456",
+			"refresh_token": "refresh456",
+			"scope":         "public",
+			"created_at":    time.Now().Unix(),
+			"expires_in":    90 * 24 * 60 * 60,
+		})
+	case "/search/movie":
+		json.NewEncoder(w).Encode([]MovieSearchResult{{Movie: Movie{Title: "Heat", Year: 1995, Ids: Ids{Trakt: 1}}}})
+	case "/scrobble/start":
+		f.scrobbles = append(f.scrobbles, r.Header.Get("Authorization"))
+		w.WriteHeader(http.StatusCreated)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func newFakeTrakt(t *testing.T) (*fakeTrakt, *Client) {
+	fake := &fakeTrakt{}
+	return fake, serveTokens(t, fake.ServeHTTP)
+}
+
+func newTokenTestUser(t *testing.T, expiresAt time.Time) (store.Store, store.User) {
+	storage := store.NewDiskStore(t.TempDir())
+	user := store.User{
+		ID:           "id123",
+		Username:     "halkeye",
+		AccessToken:  "access123",
+		RefreshToken: "refresh123",
+		ExpiresAt:    expiresAt,
+		Updated:      time.Now(),
+	}
+	require.NoError(t, storage.WriteUser(context.TODO(), user))
+	return storage, user
+}
+
+func TestRefreshThenScrobble(t *testing.T) {
+	fake, client := newFakeTrakt(t)
+	storage, user := newTokenTestUser(t, time.Now().Add(time.Hour))
+	tokens := NewTokenManager(client, storage, "https://plaxt.example.com", 24*time.Hour)
+
+	play := plexhooks.PlexResponse{Event: "media.play"}
+	play.Metadata.LibrarySectionType = "movie"
+	play.Metadata.Title = "Heat"
+	play.Metadata.Year = 1995
+	play.Metadata.Duration = 10000
+	_, err := client.Handle(context.TODO(), play, time.Now(), DefaultScrobbleSettings, user, tokens, log.WithField("test", t.Name()))
+	require.NoError(t, err)
+
+	assert.Equal(t, 1, fake.refreshes)
+	assert.Equal(t, []string{"Bearer access456"}, fake.scrobbles)
+	stored, err := storage.GetUser(context.TODO(), user.ID)
+	require.NoError(t, err)
+	assert.Equal(t, "access456", stored.AccessToken)
+	assert.Equal(t, "refresh456", stored.RefreshToken)
+	assert.Equal(t, "public", stored.Scope)
+	assert.False(t, stored.NeedsRefresh(time.Now(), 24*time.Hour))
+
+	// The saved tokens are good for a while, so the next play doesn't refresh again
+	_, err = client.Handle(context.TODO(), play, time.Now(), DefaultScrobbleSettings, *stored, tokens, log.WithField("test", t.Name()))
+	require.NoError(t, err)
+	assert.Equal(t, 1, fake.refreshes)
+	assert.Equal(t, []string{"Bearer access456", "Bearer access456"}, fake.scrobbles)
+}
+
+func TestFreshKeepsWorkingTokenWhenRefreshFails(t *testing.T) {
+	fake, client := newFakeTrakt(t)
+	fake.failTokens = true
+	storage, user := newTokenTestUser(t, time.Now().Add(time.Hour))
+	tokens := NewTokenManager(client, storage, "https://plaxt.example.com", 24*time.Hour)
+
+	fresh, err := tokens.Fresh(context.TODO(), user)
+	require.NoError(t, err)
+	assert.Equal(t, "access123", fresh.AccessToken)
+}
+
+func TestFreshFailsOnExpiredToken(t *testing.T) {
+	fake, client := newFakeTrakt(t)
+	fake.failTokens = true
+	storage, user := newTokenTestUser(t, time.Now().Add(-time.Hour))
+	tokens := NewTokenManager(client, storage, "https://plaxt.example.com", 24*time.Hour)
+
+	fresh, err := tokens.Fresh(context.TODO(), user)
+	assert.Error(t, err)
+	assert.Nil(t, fresh)
+}
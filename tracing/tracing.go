@@ -12,6 +12,9 @@ import (
 	"go.opentelemetry.io/otel/exporters/otlp/otlptrace"
 	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
 	"go.opentelemetry.io/otel/metric/global"
+	"go.opentelemetry.io/otel/metric/instrument"
+	"go.opentelemetry.io/otel/metric/instrument/syncint64"
+	"go.opentelemetry.io/otel/metric/nonrecording"
 	"go.opentelemetry.io/otel/propagation"
 	"go.opentelemetry.io/otel/sdk/resource"
 	sdktrace "go.opentelemetry.io/otel/sdk/trace"
@@ -20,9 +23,20 @@ import (
 
 var (
 	Tracer = otel.Tracer(AppName)
-	Meter  = global.Meter(AppName)
+	Meter  = global.MeterProvider().Meter(AppName)
 )
 
+// Int64Counter creates a counter on Meter, one that records nothing when the
+// meter refuses it
+func Int64Counter(name, description string) syncint64.Counter {
+	counter, err := Meter.SyncInt64().Counter(name, instrument.WithDescription(description))
+	if err != nil {
+		otel.Handle(err)
+		counter, _ = nonrecording.NewNoopMeter().SyncInt64().Counter(name)
+	}
+	return counter
+}
+
 // Initializes an OTLP exporter, and configures the corresponding trace and
 // metric providers.
 func InitProvider(ctx context.Context) (func(), error) {